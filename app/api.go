@@ -3,6 +3,7 @@ package app
 import (
 	"github.com/foundriesio/fioconfig/internal"
 	"github.com/foundriesio/fioconfig/sotatoml"
+	"github.com/foundriesio/fioconfig/workflow"
 )
 
 type App internal.App
@@ -41,3 +42,15 @@ func (a *App) CheckIn() (bool, error) {
 func (a *App) RunAndReport(name, testId, artifactsDir string, args []string) error {
 	return (*internal.App)(a).RunAndReport(name, testId, artifactsDir, args)
 }
+
+// EventSink is a workflow.EventSink that must be closed when no longer needed.
+type EventSink interface {
+	workflow.EventSink
+	Close()
+}
+
+// NewEventSink returns an EventSink that reports a workflow's events to the
+// device-gateway the same way fioconfig's certificate rotation does.
+func (a *App) NewEventSink() EventSink {
+	return (*internal.App)(a).NewEventSync()
+}
@@ -2,6 +2,7 @@ package internal
 
 import (
 	"bytes"
+	"crypto"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -9,6 +10,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -39,26 +41,31 @@ type App struct {
 
 	configUrl      string
 	unsafeHandlers bool
+	sealConfig     bool
+	upgradeConfig  bool // Store config.encrypted as the current ConfigDocumentVersion
 	sota           *sotatoml.AppConfig
 
 	exitFunc func(int)
 }
 
-func createClient(cfg *sotatoml.AppConfig) (*http.Client, CryptoHandler) {
+func createClient(cfg *sotatoml.AppConfig) (*http.Client, DeviceCryptoHandler) {
 	tlsCfg, extra, err := transport.GetTlsConfig(cfg)
 	if err != nil {
 		Fatal("Unable to create TLS config", "error", err)
 	}
+	sessions := transport.Pkcs11MaxSessions(cfg)
 	transport := &http.Transport{TLSClientConfig: tlsCfg}
 	client := &http.Client{Timeout: time.Second * 30, Transport: transport}
 
 	if "file" == cfg.Get("tls.pkey_source") {
-		if handler := NewEciesLocalHandler(tlsCfg.Certificates[0].PrivateKey); handler != nil {
+		if handler := NewLocalCryptoHandler(tlsCfg.Certificates[0].PrivateKey); handler != nil {
 			return client, handler
 		}
 		Fatal("Unsupported private key")
 	}
-	return client, NewEciesPkcs11Handler(extra, tlsCfg.Certificates[0].PrivateKey)
+	handler := NewEciesPkcs11Handler(extra, tlsCfg.Certificates[0].PrivateKey, sessions).(*EciesCrypto)
+	handler.setPkcs11Login(cfg)
+	return client, handler
 }
 
 func NewApp(configPaths []string, secretsDir string, unsafeHandlers, testing bool) (*App, error) {
@@ -85,6 +92,15 @@ func NewAppWithConfig(sota *sotatoml.AppConfig, secretsDir string, unsafeHandler
 
 	storagePath := sota.GetOrDie("storage.path")
 
+	sealConfig, err := strconv.ParseBool(sota.GetDefault("fioconfig.seal_config", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid fioconfig.seal_config value: %w", err)
+	}
+	upgradeConfig, err := strconv.ParseBool(sota.GetDefault("fioconfig.upgrade_stored_config", "false"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid fioconfig.upgrade_stored_config value: %w", err)
+	}
+
 	app := App{
 		StorageDir:      storagePath,
 		EncryptedConfig: filepath.Join(storagePath, "config.encrypted"),
@@ -92,6 +108,8 @@ func NewAppWithConfig(sota *sotatoml.AppConfig, secretsDir string, unsafeHandler
 		configUrl:       url,
 		sota:            sota,
 		unsafeHandlers:  unsafeHandlers,
+		sealConfig:      sealConfig,
+		upgradeConfig:   upgradeConfig,
 		exitFunc:        os.Exit,
 	}
 
@@ -107,8 +125,11 @@ func updateSecret(secretFile string, newContent []byte) (bool, error) {
 	return true, sotatoml.SafeWrite(secretFile, newContent)
 }
 
-func (a *App) extract(config configSnapshot) (bool, error) {
-	configChanged := false
+func (a *App) extract(config configSnapshot, events *configEvents) (configChanged bool, err error) {
+	var changed, removed []string
+	defer func() {
+		events.applied(changed, removed, err)
+	}()
 	st, err := os.Stat(a.SecretsDir)
 	if err != nil {
 		return configChanged, err
@@ -116,20 +137,28 @@ func (a *App) extract(config configSnapshot) (bool, error) {
 
 	all_fname := make(map[string]bool)
 	for fname, cfgFile := range config.next {
-		slog.Info("Extracting file", "file", fname)
+		args := []any{"file", fname}
+		if len(cfgFile.Layer) > 0 {
+			args = append(args, "layer", cfgFile.Layer)
+		}
+		if len(cfgFile.Overrides) > 0 {
+			args = append(args, "overrides", strings.Join(cfgFile.Overrides, ","))
+		}
+		slog.Info("Extracting file", args...)
 		all_fname[fname] = true
 		fullpath := filepath.Join(a.SecretsDir, fname)
 		dirName := filepath.Dir(fullpath)
 		if err := os.MkdirAll(dirName, st.Mode()); err != nil {
 			return configChanged, fmt.Errorf("Unable to create parent directory secret: %s - %w", fullpath, err)
 		}
-		changed, err := updateSecret(fullpath, []byte(cfgFile.Value))
+		updated, err := updateSecret(fullpath, []byte(cfgFile.Value))
 		if err != nil {
-			return configChanged, err
+			return configChanged, fmt.Errorf("%s: %w", fname, err)
 		}
-		if changed {
+		if updated {
 			configChanged = true
-			a.runOnChanged(fname, fullpath, cfgFile.OnChanged)
+			changed = append(changed, fname)
+			a.runOnChanged(fname, fullpath, cfgFile.OnChanged, events)
 		}
 	}
 
@@ -143,11 +172,12 @@ func (a *App) extract(config configSnapshot) (bool, error) {
 		}
 		slog.Info("Removing file", "file", fname)
 		configChanged = true
+		removed = append(removed, fname)
 		fullpath := filepath.Join(a.SecretsDir, fname)
 		if err := os.Remove(fullpath); err != nil && !os.IsNotExist(err) {
-			return configChanged, err
+			return configChanged, fmt.Errorf("%s: %w", fname, err)
 		}
-		a.runOnChanged(fname, fullpath, cfgFile.OnChanged)
+		a.runOnChanged(fname, fullpath, cfgFile.OnChanged, events)
 	}
 	if err := DeleteEmptyDirs(a.SecretsDir); err != nil {
 		slog.Error("Unable to remove empty directories", "error", err)
@@ -156,17 +186,78 @@ func (a *App) extract(config configSnapshot) (bool, error) {
 }
 
 func (a *App) Extract() (bool, error) {
-	_, crypto := createClient(a.sota)
+	client, crypto := createClient(a.sota)
 	defer crypto.Close()
 
-	config, err := UnmarshallFile(crypto, a.EncryptedConfig, true)
-	if err != nil && !errors.Is(err, os.ErrNotExist) {
+	if err := a.migrateStoredConfig(crypto); err != nil {
 		return false, err
 	}
-	return a.extract(configSnapshot{nil, config})
+	config, err := UnmarshallFile(crypto, a.EncryptedConfig, false)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return a.extract(configSnapshot{nil, nil}, nil)
+		}
+		return false, err
+	}
+
+	// This runs at early boot, so events are queued to be sent on the next
+	// check-in rather than waiting for the network. Only a config that
+	// changes something is reported, not every boot.
+	events := newConfigEvents(func() EventSync {
+		sync := newDgEventSync(a, client)
+		sync.deferred = true
+		return sync
+	}, config)
+	events.onlyChanges = true
+	cipherHashes, err := a.decryptChanged(crypto, config)
+	if err != nil {
+		events.decryptFailed(err)
+		return false, err
+	}
+	changed, err := a.extract(configSnapshot{nil, config}, events)
+	if err != nil {
+		a.clearApplied()
+		return changed, err
+	}
+	a.recordApplied(crypto, config, cipherHashes)
+	a.checkRenewalRequest()
+	return changed, nil
+}
+
+// Inspect returns the stored config without decrypting its values. This
+// allows showing which files a device has and where they came from.
+func (a *App) Inspect() (ConfigStruct, error) {
+	_, crypto := createClient(a.sota)
+	defer crypto.Close()
+	return UnmarshallFile(crypto, a.EncryptedConfig, false)
+}
+
+// PublicKeyPem returns the PEM encoded public key of the device's TLS key that
+// config values are encrypted to.
+func (a *App) PublicKeyPem() ([]byte, error) {
+	_, crypto := createClient(a.sota)
+	defer crypto.Close()
+	return publicKeyPem(crypto.Public())
 }
 
-func (a *App) runOnChanged(fname string, fullpath string, onChanged []string) {
+// Encrypt encrypts a value the same way the server does. If pubPem is empty,
+// the value is encrypted to this device's key.
+func (a *App) Encrypt(value []byte, pubPem []byte) (string, error) {
+	var pub crypto.PublicKey
+	if len(pubPem) == 0 {
+		_, handler := createClient(a.sota)
+		defer handler.Close()
+		pub = handler.Public()
+	} else {
+		var err error
+		if pub, err = parsePublicKeyPem(pubPem); err != nil {
+			return "", err
+		}
+	}
+	return EncryptToPublicKey(pub, value)
+}
+
+func (a *App) runOnChanged(fname string, fullpath string, onChanged []string, events *configEvents) {
 	path, err := os.Readlink("/proc/self/exe")
 	if err != nil {
 		slog.Error("Unable to find path to self via /proc/self/exe", "error", err)
@@ -183,6 +274,7 @@ func (a *App) runOnChanged(fname string, fullpath string, onChanged []string) {
 
 			if err := ExecIndented(cmd, "| "); err != nil {
 				slog.Error("Unable to run command", "command", onChanged, "error", err)
+				events.handlerFailed(fname, onChanged, err)
 				if exitError, ok := err.(*exec.ExitError); ok {
 					if exitError.ExitCode() == onChangedForceExit {
 						a.exitFunc(onChangedForceExit)
@@ -195,11 +287,11 @@ func (a *App) runOnChanged(fname string, fullpath string, onChanged []string) {
 	}
 }
 
-func (a *App) checkin(client *http.Client, crypto CryptoHandler) (configChanged bool, err error) {
-	headers := make(map[string]string)
+func (a *App) checkin(client *http.Client, crypto DeviceCryptoHandler) (configChanged bool, err error) {
+	headers := map[string]string{"Accept": acceptHeader}
 	var config configSnapshot
 
-	if config.prev, err = UnmarshallFile(nil, a.EncryptedConfig, false); err != nil {
+	if config.prev, err = UnmarshallFile(crypto, a.EncryptedConfig, false); err != nil {
 		var perr *os.PathError
 		if !errors.As(err, &perr) || !os.IsNotExist(perr) {
 			slog.Error("Unable to load previous config version", "error", err)
@@ -215,16 +307,27 @@ func (a *App) checkin(client *http.Client, crypto CryptoHandler) (configChanged
 	if err != nil {
 		return // Unable to attempt request
 	}
+	a.flushEvents(client)
 
 	if res.StatusCode == 200 {
-		if config.next, err = UnmarshallBuffer(crypto, res.Body, true); err != nil {
+		if config.next, err = UnmarshallBuffer(crypto, res.Body, false); err != nil {
+			return
+		}
+		events := newConfigEvents(func() EventSync { return newDgEventSync(a, client) }, config.next)
+		events.downloaded(config.next)
+		var cipherHashes map[string]string
+		if cipherHashes, err = a.decryptChanged(crypto, config.next); err != nil {
+			events.decryptFailed(err)
 			return
 		}
 
-		if configChanged, err = a.extract(config); err != nil {
+		configChanged, err = a.extract(config, events)
+		if err != nil {
+			a.clearApplied()
 			return
 		}
-		if err = sotatoml.SafeWrite(a.EncryptedConfig, res.Body); err != nil {
+		a.recordApplied(crypto, config.next, cipherHashes)
+		if err = a.writeConfig(crypto, a.EncryptedConfig, res.Body); err != nil {
 			return
 		}
 
@@ -254,6 +357,9 @@ func (a *App) checkin(client *http.Client, crypto CryptoHandler) (configChanged
 func (a *App) CheckIn() (bool, error) {
 	client, crypto := createClient(a.sota)
 	defer crypto.Close()
+	if err := a.migrateStoredConfig(crypto); err != nil {
+		slog.Error("Unable to migrate stored config", "error", err)
+	}
 	callInitFunctions(a, client)
 	return a.checkin(client, crypto)
 }
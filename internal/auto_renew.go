@@ -0,0 +1,213 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+)
+
+// EstServerConfigFile is the config entry a server can use to tell devices
+// which EST server to renew their certificate with. It takes effect when
+// `fioconfig.renew_est_server` is not set in sota.toml.
+const EstServerConfigFile = "fio-est-server"
+
+// RenewFailuresFile records failed automatic and requested renewals so they
+// can be backed off from rather than retried on every daemon interval.
+const RenewFailuresFile = "cert-renewal.failures"
+
+const (
+	renewRetryMin = 15 * time.Minute
+	renewRetryMax = 12 * time.Hour
+)
+
+type renewFailures struct {
+	Count int
+	Last  time.Time
+	Error string
+}
+
+// retryAt returns when a renewal may be attempted again. The delay doubles
+// with each consecutive failure, up to renewRetryMax.
+func (f renewFailures) retryAt() time.Time {
+	delay := renewRetryMin
+	for i := 1; i < f.Count && delay < renewRetryMax; i++ {
+		delay *= 2
+	}
+	return f.Last.Add(min(delay, renewRetryMax))
+}
+
+type renewPolicy struct {
+	server        string
+	remaining     float64       // Renew once this fraction of the lifetime is left
+	window        time.Duration // Spread renewals over this long
+	updateCaCerts bool
+	serverKeyGen  bool
+}
+
+func (a *App) renewPolicy() (*renewPolicy, error) {
+	server := a.sota.Get("fioconfig.renew_est_server")
+	if len(server) == 0 {
+		buf, err := os.ReadFile(filepath.Join(a.SecretsDir, EstServerConfigFile))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("Unable to read EST server from config: %w", err)
+		}
+		server = strings.TrimSpace(string(buf))
+	}
+	if len(server) == 0 {
+		return nil, nil
+	}
+
+	policy := renewPolicy{server: server}
+	var err error
+	val := a.sota.GetDefault("fioconfig.renew_remaining", "0.2")
+	if policy.remaining, err = strconv.ParseFloat(val, 64); err != nil || policy.remaining <= 0 || policy.remaining > 1 {
+		return nil, fmt.Errorf("Invalid value for fioconfig.renew_remaining: %s", val)
+	}
+	val = a.sota.GetDefault("fioconfig.renew_window", "6h")
+	if policy.window, err = time.ParseDuration(val); err != nil || policy.window < 0 {
+		return nil, fmt.Errorf("Invalid value for fioconfig.renew_window: %s", val)
+	}
+	val = a.sota.GetDefault("fioconfig.renew_update_ca_certs", "false")
+	if policy.updateCaCerts, err = strconv.ParseBool(val); err != nil {
+		return nil, fmt.Errorf("Invalid value for fioconfig.renew_update_ca_certs: %s", val)
+	}
+	val = a.sota.GetDefault("fioconfig.renew_server_keygen", "false")
+	if policy.serverKeyGen, err = strconv.ParseBool(val); err != nil {
+		return nil, fmt.Errorf("Invalid value for fioconfig.renew_server_keygen: %s", val)
+	}
+	return &policy, nil
+}
+
+// renewTime returns when a certificate should be renewed. A delay within the
+// policy's window is derived from the certificate's serial, so devices given
+// certificates at the same time don't all hit the EST server at once, while a
+// restarted daemon still picks the same time.
+func (p renewPolicy) renewTime(cert *x509.Certificate) time.Time {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	start := cert.NotAfter.Add(-time.Duration(float64(lifetime) * p.remaining))
+	if p.window <= 0 {
+		return start
+	}
+	sum := sha256.Sum256(cert.SerialNumber.Bytes())
+	delay := time.Duration(binary.BigEndian.Uint64(sum[:8]) % uint64(p.window))
+	if renewAt := start.Add(delay); renewAt.Before(cert.NotAfter) {
+		return renewAt
+	}
+	return start
+}
+
+// certRenewalHandler returns a handler to rotate the device's certificate if
+// automatic renewal is configured and due. It returns nil otherwise.
+func (a *App) certRenewalHandler(now time.Time) (*CertRotationHandler, error) {
+	policy, err := a.renewPolicy()
+	if err != nil || policy == nil {
+		return nil, err
+	}
+
+	client, crypto := createClient(a.sota)
+	crypto.Close()
+	tlsCert := client.Transport.(*http.Transport).TLSClientConfig.Certificates[0]
+	cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse client certificate: %w", err)
+	}
+	renewAt := policy.renewTime(cert)
+	if now.Before(renewAt) {
+		slog.Debug("Certificate renewal not due", "renew-at", renewAt, "expires", cert.NotAfter)
+		return nil, nil
+	}
+
+	stateFile := filepath.Join(a.StorageDir, "cert-rotation.state")
+	if handler := RestoreCertRotationHandler(a, stateFile); handler != nil {
+		slog.Info("Resuming incomplete certificate rotation")
+		return handler, nil
+	}
+	slog.Info("Certificate renewal due", "renew-at", renewAt, "expires", cert.NotAfter, "est-server", policy.server)
+	handler := NewCertRotationHandler(a, stateFile, policy.server)
+	handler.State.PkeySlotIds = strings.Split(DefaultPkcs11KeyIds, ",")
+	handler.State.CertSlotIds = strings.Split(DefaultPkcs11CertIds, ",")
+	handler.State.UpdateCaCerts = policy.updateCaCerts
+	handler.State.ServerKeyGen = policy.serverKeyGen
+	return handler, nil
+}
+
+// RenewCertIfDue starts a certificate rotation when automatic renewal is
+// configured and the client certificate has reached its renewal time.
+func (a *App) RenewCertIfDue() error {
+	return a.renewCertIfDue(time.Now())
+}
+
+func (a *App) renewCertIfDue(now time.Time) error {
+	handler, err := a.certRenewalHandler(now)
+	if err != nil || handler == nil {
+		return err
+	}
+	return a.rotateWithBackoff(handler, now)
+}
+
+// rotateWithBackoff runs a renewal unless one failed too recently. Automatic
+// and requested renewals share the failure count, since a failing EST server
+// or device affects both the same way.
+func (a *App) rotateWithBackoff(handler *CertRotationHandler, now time.Time) error {
+	failures := a.loadRenewFailures()
+	if failures.Count > 0 && now.Before(failures.retryAt()) {
+		slog.Info("Backing off from failed certificate renewal",
+			"failures", failures.Count, "retry-at", failures.retryAt(), "error", failures.Error)
+		return nil
+	}
+	if err := handler.Rotate(); err != nil {
+		failures.Count++
+		failures.Last = now
+		failures.Error = err.Error()
+		a.saveRenewFailures(failures)
+		return err
+	}
+	a.saveRenewFailures(renewFailures{})
+	return nil
+}
+
+func (a *App) loadRenewFailures() renewFailures {
+	var failures renewFailures
+	buf, err := os.ReadFile(filepath.Join(a.StorageDir, RenewFailuresFile))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Unable to read certificate renewal failures", "error", err)
+		}
+		return failures
+	}
+	if err = json.Unmarshal(buf, &failures); err != nil {
+		slog.Warn("Ignoring unreadable certificate renewal failures", "error", err)
+	}
+	return failures
+}
+
+// saveRenewFailures persists failures, removing the file once there are none
+func (a *App) saveRenewFailures(failures renewFailures) {
+	path := filepath.Join(a.StorageDir, RenewFailuresFile)
+	var err error
+	if failures.Count == 0 {
+		if err = os.Remove(path); errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+	} else {
+		var buf []byte
+		if buf, err = json.Marshal(failures); err == nil {
+			err = sotatoml.SafeWrite(path, buf)
+		}
+	}
+	if err != nil {
+		slog.Warn("Unable to record certificate renewal failures", "error", err)
+	}
+}
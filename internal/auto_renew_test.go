@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenewTime(t *testing.T) {
+	start := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	cert := &x509.Certificate{
+		SerialNumber: big.NewInt(1234),
+		NotBefore:    start,
+		NotAfter:     start.Add(100 * 24 * time.Hour),
+	}
+
+	policy := renewPolicy{remaining: 0.2}
+	require.Equal(t, start.Add(80*24*time.Hour), policy.renewTime(cert))
+
+	// The delay is within the window and stable for a given cert
+	policy.window = 48 * time.Hour
+	renewAt := policy.renewTime(cert)
+	require.False(t, renewAt.Before(start.Add(80*24*time.Hour)))
+	require.True(t, renewAt.Before(start.Add(82*24*time.Hour)))
+	require.Equal(t, renewAt, policy.renewTime(cert))
+
+	// Devices with different certs are spread out
+	spread := map[time.Time]bool{}
+	for i := int64(0); i < 10; i++ {
+		cert.SerialNumber = big.NewInt(i)
+		spread[policy.renewTime(cert)] = true
+	}
+	require.Greater(t, len(spread), 1)
+}
+
+func TestCertRenewalHandler(t *testing.T) {
+	block, _ := pem.Decode([]byte(client_pem))
+	cert, err := x509.ParseCertificate(block.Bytes)
+	require.Nil(t, err)
+
+	testWrapper(t, nil, func(app *App, client *http.Client, tmpdir string) {
+		app.SecretsDir = filepath.Join(tmpdir, "secrets")
+		require.Nil(t, os.Mkdir(app.SecretsDir, 0o750))
+
+		// Not configured
+		handler, err := app.certRenewalHandler(cert.NotAfter)
+		require.Nil(t, err)
+		require.Nil(t, handler)
+
+		// EST server from config, not due yet
+		estFile := filepath.Join(app.SecretsDir, EstServerConfigFile)
+		require.Nil(t, os.WriteFile(estFile, []byte("https://est.example.com\n"), 0o644))
+		handler, err = app.certRenewalHandler(cert.NotBefore)
+		require.Nil(t, err)
+		require.Nil(t, handler)
+
+		handler, err = app.certRenewalHandler(cert.NotAfter)
+		require.Nil(t, err)
+		require.NotNil(t, handler)
+		require.Equal(t, "https://est.example.com", handler.State.EstServer)
+		require.Equal(t, []string{"01", "07"}, handler.State.PkeySlotIds)
+
+		// sota.toml wins over the config
+		sotaPath := filepath.Join(tmpdir, "sota.toml")
+		f, err := os.OpenFile(sotaPath, os.O_APPEND|os.O_WRONLY, 0)
+		require.Nil(t, err)
+		_, err = f.WriteString("\n[fioconfig]\nrenew_est_server = \"https://est.local\"\nrenew_remaining = \"1\"\nrenew_window = \"0s\"\n")
+		require.Nil(t, err)
+		require.Nil(t, f.Close())
+		app.sota, err = sotatoml.NewAppConfig([]string{sotaPath})
+		require.Nil(t, err)
+		handler, err = app.certRenewalHandler(cert.NotBefore)
+		require.Nil(t, err)
+		require.NotNil(t, handler)
+		require.Equal(t, "https://est.local", handler.State.EstServer)
+
+		// An incomplete rotation is resumed rather than restarted
+		handler.State.CorrelationId = "in-progress"
+		require.Nil(t, handler.Save())
+		handler, err = app.certRenewalHandler(cert.NotBefore)
+		require.Nil(t, err)
+		require.Equal(t, "in-progress", handler.State.CorrelationId)
+
+		require.Nil(t, app.sota.UpdateKeys(map[string]string{"fioconfig.renew_remaining": "2"}))
+		_, err = app.certRenewalHandler(cert.NotBefore)
+		require.ErrorContains(t, err, "fioconfig.renew_remaining")
+	})
+}
+
+func TestRenewBackoff(t *testing.T) {
+	last := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.Equal(t, last.Add(15*time.Minute), renewFailures{Count: 1, Last: last}.retryAt())
+	require.Equal(t, last.Add(time.Hour), renewFailures{Count: 3, Last: last}.retryAt())
+	require.Equal(t, last.Add(12*time.Hour), renewFailures{Count: 100, Last: last}.retryAt())
+
+	requests := 0
+	doGet := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(403)
+	})
+	testWrapper(t, doGet, func(app *App, client *http.Client, tmpdir string) {
+		withFioconfigSection(t, app, tmpdir, fmt.Sprintf(
+			"renew_est_server = \"%s/est\"\nrenew_remaining = \"1\"\nrenew_window = \"0s\"\n", app.sota.Get("tls.server")))
+		now := time.Now()
+
+		require.ErrorContains(t, app.renewCertIfDue(now), "Pre-flight checks failed")
+		failures := app.loadRenewFailures()
+		require.Equal(t, 1, failures.Count)
+		require.Contains(t, failures.Error, "Pre-flight checks failed")
+
+		// Nothing is attempted until the backoff has passed
+		requests = 0
+		require.Nil(t, app.renewCertIfDue(now.Add(time.Minute)))
+		require.Zero(t, requests)
+
+		require.NotNil(t, app.renewCertIfDue(now.Add(16*time.Minute)))
+		require.NotZero(t, requests)
+		failures = app.loadRenewFailures()
+		require.Equal(t, 2, failures.Count)
+		require.True(t, now.Add(46*time.Minute).Equal(failures.retryAt()))
+
+		app.saveRenewFailures(renewFailures{})
+		_, err := os.Stat(filepath.Join(tmpdir, RenewFailuresFile))
+		require.True(t, os.IsNotExist(err))
+	})
+}
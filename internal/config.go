@@ -1,10 +1,12 @@
 package internal
 
 import (
-	"encoding/json"
 	"fmt"
 	"log/slog"
 	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
 )
 
 var Commit string
@@ -13,6 +15,10 @@ type ConfigFile struct {
 	Value       string
 	OnChanged   []string
 	Unencrypted bool
+
+	// Provenance for configs built from multiple layers
+	Layer     string   `json:",omitempty"`
+	Overrides []string `json:",omitempty"` // Lower layers that also defined this file
 }
 
 type ConfigStruct = map[string]*ConfigFile
@@ -22,27 +28,97 @@ func UnmarshallFile(c CryptoHandler, encFile string, decrypt bool) (ConfigStruct
 	if err != nil {
 		return nil, fmt.Errorf("Unable to read encrypted file: %w", err)
 	}
+	if isSealed(content) {
+		if content, err = unsealConfig(c, content); err != nil {
+			return nil, err
+		}
+	}
 	return UnmarshallBuffer(c, content, decrypt)
 }
 
 func UnmarshallBuffer(c CryptoHandler, encContent []byte, decrypt bool) (ConfigStruct, error) {
-	var config map[string]*ConfigFile
-	if err := json.Unmarshal(encContent, &config); err != nil {
-		return nil, fmt.Errorf("Unable to parse encrypted json: %v", err)
+	doc, err := parseDocument(encContent)
+	if err != nil {
+		return nil, err
+	}
+	config, err := doc.Config()
+	if err != nil {
+		return nil, err
 	}
 	if decrypt {
-		for fname, cfgFile := range config {
-			if !cfgFile.Unencrypted {
-				slog.Debug("Decoding value", "file", fname)
-				decrypted, err := c.Decrypt(cfgFile.Value)
-				if err != nil {
-					return nil, fmt.Errorf("%s: %v", fname, err)
+		if err := decryptConfig(c, config); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// concurrentCryptoHandler is implemented by handlers that can safely
+// decrypt more than one value at a time.
+type concurrentCryptoHandler interface {
+	Concurrency() int
+}
+
+func decryptConfig(c CryptoHandler, config ConfigStruct) error {
+	workers := 1
+	if cc, ok := c.(concurrentCryptoHandler); ok {
+		workers = cc.Concurrency()
+	}
+	return decryptEntries(c, config, workers)
+}
+
+// decryptEntries decrypts config values using a pool of `workers`. Entries
+// are handed out in sorted order and we stop handing them out after the first
+// failure. Every entry before a failed one has already been handed out, so the
+// error reported is always that of the first failing file in sorted order.
+func decryptEntries(c CryptoHandler, config ConfigStruct, workers int) error {
+	var names []string
+	for fname, cfgFile := range config {
+		if !cfgFile.Unencrypted {
+			names = append(names, fname)
+		}
+	}
+	sort.Strings(names)
+	workers = min(workers, len(names))
+	if workers < 1 {
+		return nil
+	}
+
+	values := make([][]byte, len(names))
+	errs := make([]error, len(names))
+	var failed atomic.Bool
+	var wg sync.WaitGroup
+	jobs := make(chan int)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				slog.Debug("Decoding value", "file", names[idx])
+				if values[idx], errs[idx] = c.Decrypt(config[names[idx]].Value); errs[idx] != nil {
+					failed.Store(true)
 				}
-				cfgFile.Value = string(decrypted)
 			}
+		}()
+	}
+	for idx := range names {
+		if failed.Load() {
+			break
 		}
+		jobs <- idx
 	}
-	return config, nil
+	close(jobs)
+	wg.Wait()
+
+	for idx, err := range errs {
+		if err != nil {
+			return fmt.Errorf("%s: %v", names[idx], err)
+		}
+	}
+	for idx, fname := range names {
+		config[fname].Value = string(values[idx])
+	}
+	return nil
 }
 
 type ConfigFileReq struct {
@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+)
+
+// configEvents reports to the device-gateway what happened to a config
+// from the server: ConfigDownloaded, ConfigDecryptFailed, HandlerFailed,
+// and ConfigApplied. The events share a correlation ID derived from the
+// config's content, so the backend can tell which config a device applied.
+// A nil *configEvents reports nothing.
+type configEvents struct {
+	sink          EventSync
+	newSink       func() EventSync
+	correlationId string
+	onlyChanges   bool // Skip ConfigApplied when nothing changed
+}
+
+// newConfigEvents returns the events for a config. It must be called before
+// the config is decrypted, since its correlation ID is a hash of the
+// encrypted values. The sink is only built once there's something to report,
+// so a config that changes nothing doesn't need the device-gateway settings.
+func newConfigEvents(newSink func() EventSync, config ConfigStruct) *configEvents {
+	return &configEvents{newSink: newSink, correlationId: configCorrelationId(config)}
+}
+
+func (e *configEvents) getSink() EventSync {
+	if e.sink == nil {
+		e.sink = e.newSink()
+		e.sink.SetCorrelationId(e.correlationId)
+	}
+	return e.sink
+}
+
+// configCorrelationId identifies a config by a hash of its still encrypted
+// content. The same config gets the same ID whether it was just downloaded
+// or read from config.encrypted.
+func configCorrelationId(config ConfigStruct) string {
+	buf, err := json.Marshal(config)
+	if err != nil {
+		slog.Error("Unable to serialize config for its correlation ID", "error", err)
+	}
+	sum := sha256.Sum256(buf)
+	return "config-" + hex.EncodeToString(sum[:8])
+}
+
+func (e *configEvents) notify(event string, details map[string][]string, err error) {
+	if e == nil {
+		return
+	}
+	var detailStr string
+	if len(details) > 0 {
+		buf, _ := json.Marshal(details)
+		detailStr = string(buf)
+	}
+	sink := e.getSink()
+	if details, ok := sink.(interface {
+		NotifyDetails(event, details string, err error)
+	}); ok {
+		details.NotifyDetails(event, detailStr, err)
+	} else {
+		sink.Notify(event, err)
+	}
+}
+
+func (e *configEvents) downloaded(config ConfigStruct) {
+	files := make([]string, 0, len(config))
+	for fname := range config {
+		files = append(files, fname)
+	}
+	slices.Sort(files)
+	e.notify("ConfigDownloaded", map[string][]string{"files": files}, nil)
+}
+
+func (e *configEvents) decryptFailed(err error) {
+	e.notify("ConfigDecryptFailed", nil, err)
+}
+
+func (e *configEvents) handlerFailed(fname string, onChanged []string, err error) {
+	e.notify("HandlerFailed", map[string][]string{"file": {fname}, "command": onChanged}, err)
+}
+
+// applied reports the result of extracting a config along with the files
+// that were written or removed.
+func (e *configEvents) applied(changed, removed []string, err error) {
+	if e != nil && e.onlyChanges && err == nil && len(changed) == 0 && len(removed) == 0 {
+		return
+	}
+	details := map[string][]string{"changed": {}, "removed": {}}
+	for key, files := range map[string][]string{"changed": changed, "removed": removed} {
+		details[key] = append(details[key], files...)
+		slices.Sort(details[key])
+	}
+	if err != nil {
+		err = fmt.Errorf("Unable to apply config: %w", err)
+	}
+	e.notify("ConfigApplied", details, err)
+}
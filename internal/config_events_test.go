@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigEvents(t *testing.T) {
+	var encbuf []byte
+	var events []DgUpdateEvent
+	doGet := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/events" {
+			body, err := io.ReadAll(r.Body)
+			require.Nil(t, err)
+			var posted []DgUpdateEvent
+			require.Nil(t, json.Unmarshal(body, &posted))
+			events = append(events, posted...)
+			return
+		}
+		_, err := w.Write(encbuf)
+		require.Nil(t, err)
+	})
+
+	testWrapper(t, doGet, func(app *App, client *http.Client, tmpdir string) {
+		_, crypto := createClient(app.sota)
+		defer crypto.Close()
+
+		// Extract runs before the network is up, so its events are queued
+		stored, err := UnmarshallFile(crypto, app.EncryptedConfig, false)
+		require.Nil(t, err)
+		_, err = app.Extract()
+		require.Nil(t, err)
+		require.Len(t, events, 0)
+		queued, err := app.eventQueue().load()
+		require.Nil(t, err)
+		require.Len(t, queued, 1)
+		require.Equal(t, "ConfigApplied", queued[0].EventType.Id)
+		// The same ID a check-in of this config reports
+		require.Equal(t, configCorrelationId(stored), queued[0].Event.CorrelationId)
+		require.True(t, queued[0].Event.Success)
+		require.Equal(t, `{"changed":["bar","foo","random","with/subdir/1.txt"],"removed":[]}`, queued[0].Event.Details)
+
+		// Nothing is reported when a boot doesn't change anything
+		_, err = app.Extract()
+		require.Nil(t, err)
+		queued, err = app.eventQueue().load()
+		require.Nil(t, err)
+		require.Len(t, queued, 1)
+
+		config := ConfigStruct{
+			"foo":    &ConfigFile{Value: "new foo value"},
+			"failed": &ConfigFile{Value: "value", Unencrypted: true, OnChanged: []string{"/bin/false"}},
+		}
+		encrypt(t, config)
+		encbuf, err = json.Marshal(config)
+		require.Nil(t, err)
+		_, err = app.checkin(client, crypto)
+		require.Nil(t, err)
+
+		// The queued event is sent first, then the ones for the new config
+		require.Len(t, events, 4)
+		require.Equal(t, queued[0].Id, events[0].Id)
+		events = events[1:]
+		corId := configCorrelationId(config)
+		for _, evt := range events {
+			require.Equal(t, corId, evt.Event.CorrelationId)
+		}
+		require.Equal(t, "ConfigDownloaded", events[0].EventType.Id)
+		require.Equal(t, `{"files":["failed","foo"]}`, events[0].Event.Details)
+		require.Equal(t, "HandlerFailed", events[1].EventType.Id)
+		require.False(t, events[1].Event.Success)
+		require.Equal(t, `{"command":["/bin/false"],"file":["failed"]}: exit status 1`, events[1].Event.Details)
+		require.Equal(t, "ConfigApplied", events[2].EventType.Id)
+		require.True(t, events[2].Event.Success)
+		require.Equal(t, `{"changed":["failed","foo"],"removed":["bar","random","with/subdir/1.txt"]}`, events[2].Event.Details)
+
+		// A config that can't be decrypted
+		events = nil
+		config["foo"].Value = "bm90IGVuY3J5cHRlZA=="
+		encbuf, err = json.Marshal(config)
+		require.Nil(t, err)
+		_, err = app.checkin(client, crypto)
+		require.NotNil(t, err)
+		require.Len(t, events, 2)
+		require.Equal(t, "ConfigDownloaded", events[0].EventType.Id)
+		require.Equal(t, "ConfigDecryptFailed", events[1].EventType.Id)
+		require.False(t, events[1].Event.Success)
+		require.Contains(t, events[1].Event.Details, "foo: ")
+		require.Equal(t, configCorrelationId(config), events[1].Event.CorrelationId)
+		require.NotEqual(t, corId, events[1].Event.CorrelationId)
+
+		_, err = os.Stat(app.eventQueue().path)
+		require.True(t, os.IsNotExist(err))
+	})
+}
+
+func TestConfigEventsNoServer(t *testing.T) {
+	testWrapper(t, nil, func(app *App, client *http.Client, tmpdir string) {
+		// Extract can run on a device whose sota.toml has no tls.server yet
+		sotaPath := filepath.Join(tmpdir, "sota.toml")
+		buf, err := os.ReadFile(sotaPath)
+		require.Nil(t, err)
+		buf = regexp.MustCompile(`(?m)^server = .*$`).ReplaceAll(buf, nil)
+		require.Nil(t, os.WriteFile(sotaPath, buf, 0o644))
+		app.sota, err = sotatoml.NewAppConfig([]string{sotaPath})
+		require.Nil(t, err)
+		require.Empty(t, app.sota.Get("tls.server"))
+
+		_, err = app.Extract()
+		require.Nil(t, err)
+		queued, err := app.eventQueue().load()
+		require.Nil(t, err)
+		require.Len(t, queued, 1)
+		require.Equal(t, "ConfigApplied", queued[0].EventType.Id)
+
+		// Flushing without a server keeps the events queued
+		sync := newDgEventSync(app, client)
+		require.NotNil(t, sync.Flush())
+		queued, err = app.eventQueue().load()
+		require.Nil(t, err)
+		require.Len(t, queued, 1)
+	})
+}
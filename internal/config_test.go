@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func encryptedTestConfig(t testing.TB, crypto DeviceCryptoHandler, entries int) ConfigStruct {
+	config := make(ConfigStruct, entries)
+	for i := 0; i < entries; i++ {
+		enc, err := crypto.Encrypt(fmt.Sprintf("value %d", i))
+		require.Nil(t, err)
+		config[fmt.Sprintf("file-%02d", i)] = &ConfigFile{Value: enc}
+	}
+	config["plain"] = &ConfigFile{Value: "plain value", Unencrypted: true}
+	return config
+}
+
+func copyConfig(config ConfigStruct) ConfigStruct {
+	copied := make(ConfigStruct, len(config))
+	for fname, cfgFile := range config {
+		cfgFileCopy := *cfgFile
+		copied[fname] = &cfgFileCopy
+	}
+	return copied
+}
+
+func TestDecryptEntries(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	crypto := NewLocalCryptoHandler(key)
+	orig := encryptedTestConfig(t, crypto, 20)
+
+	for _, workers := range []int{1, 4, 64} {
+		config := copyConfig(orig)
+		require.Nil(t, decryptEntries(crypto, config, workers))
+		for i := 0; i < 20; i++ {
+			require.Equal(t, fmt.Sprintf("value %d", i), config[fmt.Sprintf("file-%02d", i)].Value)
+		}
+		require.Equal(t, "plain value", config["plain"].Value)
+	}
+
+	// The first broken file in sorted order is always reported
+	orig["file-07"].Value = "not base64!"
+	orig["file-13"].Value = "bm90IGVjaWVz"
+	for i := 0; i < 20; i++ {
+		config := copyConfig(orig)
+		err := decryptEntries(crypto, config, 4)
+		require.ErrorContains(t, err, "file-07: Unable to base64 decode")
+	}
+}
+
+func BenchmarkDecryptEntries(b *testing.B) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(b, err)
+	crypto := NewLocalCryptoHandler(key)
+	orig := encryptedTestConfig(b, crypto, 48)
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				config := copyConfig(orig)
+				b.StartTimer()
+				if err := decryptEntries(crypto, config, workers); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
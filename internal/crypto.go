@@ -0,0 +1,207 @@
+package internal
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+
+	ecies "github.com/foundriesio/go-ecies"
+)
+
+var ErrNoPkcs11 = errors.New("Operation not supported by a local crypto handler")
+
+// Key types that can be requested when renewing the device's certificate
+const (
+	KeyTypeP256    = "p256"
+	KeyTypeP384    = "p384"
+	KeyTypeRsa     = "rsa"
+	KeyTypeEd25519 = "ed25519"
+)
+
+var KeyTypes = []string{KeyTypeP256, KeyTypeP384, KeyTypeRsa, KeyTypeEd25519}
+
+// DeviceCryptoHandler is the full set of operations the cert rotation logic
+// needs from a device's key. In addition to decryption, it must be able to
+// encrypt values to its own public key and manage PKCS#11 objects when the
+// key lives in an HSM.
+type DeviceCryptoHandler interface {
+	CryptoHandler
+	Encrypt(value string) (string, error)
+	Public() crypto.PublicKey
+	UsePkcs11() bool
+	DeleteKeyPair(id []byte, label []byte) error
+	DeleteCertificate(id []byte, label []byte, serial *big.Int) error
+	ImportCertificateWithLabel(id []byte, label []byte, certificate *x509.Certificate) error
+	GenerateKeyPair(id []byte, label []byte, curve elliptic.Curve) (crypto.Signer, error)
+	FindTlsCertificate(keyId []byte, certId []byte) (tls.Certificate, error)
+	HasKeyPair(id []byte) (bool, error)
+	HasCertificate(id []byte) (bool, error)
+	ImportKeyPair(id []byte, label []byte, key crypto.PrivateKey) error
+}
+
+// NewLocalCryptoHandler returns a handler for a file based private key based
+// on the key's type. It returns nil if the key type is not supported.
+func NewLocalCryptoHandler(privKey crypto.PrivateKey) DeviceCryptoHandler {
+	switch key := privKey.(type) {
+	case *ecdsa.PrivateKey:
+		return NewEciesLocalHandler(key).(DeviceCryptoHandler)
+	case *rsa.PrivateKey:
+		return NewRsaLocalHandler(key)
+	case ed25519.PrivateKey:
+		if handler, err := NewX25519LocalHandler(key); err == nil {
+			return handler
+		}
+	}
+	return nil
+}
+
+// keyTypeOf returns the key type of an existing file or PKCS#11 private key
+func keyTypeOf(key crypto.PrivateKey) (string, error) {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return "", fmt.Errorf("Unsupported private key: %T", key)
+	}
+	switch pub := signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			return KeyTypeP256, nil
+		case elliptic.P384():
+			return KeyTypeP384, nil
+		}
+		return "", fmt.Errorf("Unsupported elliptic curve: %s", pub.Curve.Params().Name)
+	case *rsa.PublicKey:
+		return KeyTypeRsa, nil
+	case ed25519.PublicKey:
+		return KeyTypeEd25519, nil
+	}
+	return "", fmt.Errorf("Unsupported private key: %T", signer.Public())
+}
+
+// keyTypeCurve returns the elliptic curve for ECDSA key types or nil
+func keyTypeCurve(keyType string) elliptic.Curve {
+	switch keyType {
+	case KeyTypeP256:
+		return elliptic.P256()
+	case KeyTypeP384:
+		return elliptic.P384()
+	}
+	return nil
+}
+
+// parsePrivateKeyPem decodes the PEM encoded private keys we may find in
+// sota.toml's import.tls_pkey_path or generate during a cert rotation.
+func parsePrivateKeyPem(keyPem []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(keyPem)
+	if block == nil {
+		return nil, errors.New("Unable to decode private key PEM")
+	}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	return nil, fmt.Errorf("Unsupported private key PEM type: %s", block.Type)
+}
+
+// publicKeyPem returns the PEM encoded PKIX form of a public key
+func publicKeyPem(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// parsePublicKeyPem decodes a PEM encoded PKIX public key or certificate
+func parsePublicKeyPem(pubPem []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(pubPem)
+	if block == nil {
+		return nil, errors.New("Unable to decode public key PEM")
+	}
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	return nil, fmt.Errorf("Unsupported public key PEM type: %s", block.Type)
+}
+
+// EncryptToPublicKey encrypts a value in the format the device's
+// CryptoHandler for the given public key type can decrypt.
+func EncryptToPublicKey(pub crypto.PublicKey, value []byte) (string, error) {
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		return eciesEncrypt(ecies.ImportECDSAPublic(key), value)
+	case *rsa.PublicKey:
+		return rsaEncrypt(key, value)
+	case ed25519.PublicKey:
+		x25519Pub, err := ed25519PublicToX25519(key)
+		if err != nil {
+			return "", err
+		}
+		return x25519Encrypt(x25519Pub, value)
+	case *ecdh.PublicKey:
+		if key.Curve() == ecdh.X25519() {
+			return x25519Encrypt(key, value)
+		}
+	}
+	return "", fmt.Errorf("Unsupported public key: %T", pub)
+}
+
+func eciesEncrypt(pub *ecies.PublicKey, value []byte) (string, error) {
+	enc, err := ecies.Encrypt(rand.Reader, pub, value, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(enc), nil
+}
+
+// ed25519PublicToX25519 maps an Edwards25519 point to its Montgomery form as
+// per RFC 7748: u = (1 + y) / (1 - y) mod p
+func ed25519PublicToX25519(pub ed25519.PublicKey) (*ecdh.PublicKey, error) {
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, errors.New("Invalid Ed25519 public key size")
+	}
+	p := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+	// y is little endian with the sign of x in the top bit
+	yBytes := slices.Clone([]byte(pub))
+	yBytes[31] &= 0x7f
+	slices.Reverse(yBytes)
+	y := new(big.Int).SetBytes(yBytes)
+
+	one := big.NewInt(1)
+	num := new(big.Int).Add(one, y)
+	den := new(big.Int).Sub(one, y)
+	den.Mod(den, p)
+	if den.Sign() == 0 {
+		return nil, errors.New("Invalid Ed25519 public key")
+	}
+	u := num.Mul(num, den.ModInverse(den, p))
+	u.Mod(u, p)
+
+	uBytes := u.FillBytes(make([]byte, x25519KeySize))
+	slices.Reverse(uBytes)
+	return ecdh.X25519().NewPublicKey(uBytes)
+}
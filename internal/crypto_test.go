@@ -0,0 +1,93 @@
+package internal
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocalKeyTypes(t *testing.T) {
+	for _, keyType := range KeyTypes {
+		t.Run(keyType, func(t *testing.T) {
+			signer, keyPem, err := generateLocalKey(keyType, 0)
+			require.Nil(t, err)
+
+			detected, err := keyTypeOf(signer)
+			require.Nil(t, err)
+			require.Equal(t, keyType, detected)
+
+			key, err := parsePrivateKeyPem([]byte(keyPem))
+			require.Nil(t, err)
+			handler := NewLocalCryptoHandler(key)
+			require.NotNil(t, handler)
+			defer handler.Close()
+
+			pubPem, err := publicKeyPem(handler.Public())
+			require.Nil(t, err)
+
+			enc, err := handler.Encrypt("foo file value")
+			require.Nil(t, err)
+			dec, err := handler.Decrypt(enc)
+			require.Nil(t, err)
+			require.Equal(t, "foo file value", string(dec))
+
+			// Encrypting with only the public key is what `fioconfig encrypt`
+			// and the server do
+			pub, err := parsePublicKeyPem(pubPem)
+			require.Nil(t, err)
+			enc, err = EncryptToPublicKey(pub, []byte("pubkey value"))
+			require.Nil(t, err)
+			dec, err = handler.Decrypt(enc)
+			require.Nil(t, err)
+			require.Equal(t, "pubkey value", string(dec))
+
+			// Values encrypted to another key of the same type must fail
+			other, _, err := generateLocalKey(keyType, 0)
+			require.Nil(t, err)
+			_, err = NewLocalCryptoHandler(other).Decrypt(enc)
+			require.NotNil(t, err)
+		})
+	}
+
+	_, _, err := generateLocalKey("p192", 0)
+	require.NotNil(t, err)
+}
+
+func TestEd25519PublicToX25519(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		require.Nil(t, err)
+		handler, err := NewX25519LocalHandler(priv)
+		require.Nil(t, err)
+		converted, err := ed25519PublicToX25519(pub)
+		require.Nil(t, err)
+		require.Equal(t, handler.PrivKey.PublicKey().Bytes(), converted.Bytes())
+	}
+}
+
+func TestAppEncrypt(t *testing.T) {
+	testWrapper(t, nil, func(app *App, client *http.Client, tempdir string) {
+		_, crypto := createClient(app.sota)
+		defer crypto.Close()
+
+		pubPem, err := app.PublicKeyPem()
+		require.Nil(t, err)
+		expected, err := publicKeyPem(crypto.Public())
+		require.Nil(t, err)
+		require.Equal(t, expected, pubPem)
+
+		for _, pem := range [][]byte{nil, pubPem, []byte(client_pem)} {
+			enc, err := app.Encrypt([]byte("encrypted on device"), pem)
+			require.Nil(t, err)
+			dec, err := crypto.Decrypt(enc)
+			require.Nil(t, err)
+			require.Equal(t, "encrypted on device", string(dec))
+		}
+
+		_, err = app.Encrypt([]byte("value"), []byte("not a pem"))
+		require.NotNil(t, err)
+	})
+}
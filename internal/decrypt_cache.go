@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// AppliedCacheFile records what was last extracted so unchanged values don't
+// have to be decrypted again, even by a new fioconfig process.
+const AppliedCacheFile = "config.applied"
+
+// appliedEntry records what was extracted for an encrypted file: a hash of
+// the ciphertext it came from and a hash of the plaintext written to disk.
+// Only hashes are kept so that secrets aren't stored outside the secrets
+// directory.
+type appliedEntry struct {
+	CipherHash string
+	PlainHash  string
+}
+
+// appliedCache is what's persisted to AppliedCacheFile. The entries are only
+// valid for the key they were decrypted with.
+type appliedCache struct {
+	KeyId string
+	Files map[string]appliedEntry
+}
+
+func hashValue(value []byte) string {
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:])
+}
+
+func (a *App) appliedCachePath() string {
+	return filepath.Join(a.StorageDir, AppliedCacheFile)
+}
+
+// loadApplied returns the applied entries recorded for the crypto handler's
+// key. Nothing is returned when the key has changed, e.g. after a
+// certificate rotation, or if the cache can't be read.
+func (a *App) loadApplied(crypto DeviceCryptoHandler) map[string]appliedEntry {
+	buf, err := os.ReadFile(a.appliedCachePath())
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Unable to read applied config cache", "error", err)
+		}
+		return nil
+	}
+	var cache appliedCache
+	if err = json.Unmarshal(buf, &cache); err != nil {
+		slog.Warn("Ignoring unreadable applied config cache", "error", err)
+		return nil
+	}
+	id, err := KeyId(crypto.Public())
+	if err != nil || id != cache.KeyId {
+		slog.Debug("Applied config cache is for a different key, ignoring it")
+		return nil
+	}
+	return cache.Files
+}
+
+// clearApplied removes the cache so everything is decrypted next time
+func (a *App) clearApplied() {
+	if err := os.Remove(a.appliedCachePath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("Unable to remove applied config cache", "error", err)
+	}
+}
+
+// decryptChanged decrypts the entries of a config. Entries with the same
+// ciphertext as the previously applied config are read back from the secrets
+// directory instead, provided the file still holds what we last wrote. This
+// saves expensive decryptions (e.g. PKCS#11 derives) when only a few files
+// change between check-ins or boots.
+func (a *App) decryptChanged(crypto DeviceCryptoHandler, config ConfigStruct) (map[string]string, error) {
+	applied := a.loadApplied(crypto)
+	cipherHashes := make(map[string]string)
+	changed := make(ConfigStruct)
+	for fname, cfgFile := range config {
+		if cfgFile.Unencrypted {
+			continue
+		}
+		cipherHashes[fname] = hashValue([]byte(cfgFile.Value))
+		if value, ok := a.appliedValue(fname, cipherHashes[fname], applied); ok {
+			slog.Debug("Value unchanged, skipping decryption", "file", fname)
+			cfgFile.Value = value
+		} else {
+			changed[fname] = cfgFile
+		}
+	}
+	return cipherHashes, decryptConfig(crypto, changed)
+}
+
+func (a *App) appliedValue(fname, cipherHash string, applied map[string]appliedEntry) (string, bool) {
+	entry, ok := applied[fname]
+	if !ok || entry.CipherHash != cipherHash {
+		return "", false
+	}
+	content, err := os.ReadFile(filepath.Join(a.SecretsDir, fname))
+	if err != nil || entry.PlainHash != hashValue(content) {
+		return "", false
+	}
+	return string(content), true
+}
+
+// recordApplied persists the applied entries after a config was extracted
+func (a *App) recordApplied(crypto DeviceCryptoHandler, config ConfigStruct, cipherHashes map[string]string) {
+	id, err := KeyId(crypto.Public())
+	if err != nil {
+		slog.Warn("Unable to record applied config", "error", err)
+		a.clearApplied()
+		return
+	}
+	cache := appliedCache{KeyId: id, Files: make(map[string]appliedEntry, len(cipherHashes))}
+	for fname, cipherHash := range cipherHashes {
+		cache.Files[fname] = appliedEntry{
+			CipherHash: cipherHash,
+			PlainHash:  hashValue([]byte(config[fname].Value)),
+		}
+	}
+	buf, err := json.Marshal(cache)
+	if err != nil {
+		slog.Warn("Unable to record applied config", "error", err)
+		return
+	}
+	// Written by hand rather than with SafeWrite so it's never group readable
+	path := a.appliedCachePath()
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, buf, 0o600); err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		slog.Warn("Unable to record applied config", "error", err)
+		os.Remove(tmp)
+		a.clearApplied()
+	}
+}
@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type countingCrypto struct {
+	DeviceCryptoHandler
+	calls atomic.Int32
+}
+
+func (c *countingCrypto) Decrypt(value string) ([]byte, error) {
+	c.calls.Add(1)
+	return c.DeviceCryptoHandler.Decrypt(value)
+}
+
+func TestCheckinSkipsUnchanged(t *testing.T) {
+	var encbuf []byte
+	doGet := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := w.Write(encbuf)
+		require.Nil(t, err)
+	})
+
+	testWrapper(t, doGet, func(app *App, client *http.Client, tempdir string) {
+		_, handler := createClient(app.sota)
+		defer handler.Close()
+		crypto := &countingCrypto{DeviceCryptoHandler: handler}
+
+		var err error
+		encbuf, err = os.ReadFile(app.EncryptedConfig)
+		require.Nil(t, err)
+
+		// assertExtracted makes sure the secrets directory holds exactly
+		// what a full decryption of the server's config would produce.
+		assertExtracted := func() {
+			config, err := UnmarshallBuffer(handler, encbuf, true)
+			require.Nil(t, err)
+			for fname, cfgFile := range config {
+				assertFile(t, filepath.Join(tempdir, fname), []byte(cfgFile.Value))
+			}
+		}
+
+		// Nothing has been applied yet, everything gets decrypted
+		_, err = app.checkin(client, crypto)
+		require.Nil(t, err)
+		require.Equal(t, int32(3), crypto.calls.Load())
+		assertExtracted()
+
+		// Same config - nothing to decrypt
+		crypto.calls.Store(0)
+		changed, err := app.checkin(client, crypto)
+		require.Nil(t, err)
+		require.False(t, changed)
+		require.Equal(t, int32(0), crypto.calls.Load())
+		assertExtracted()
+
+		// Change one value
+		var config ConfigStruct
+		require.Nil(t, json.Unmarshal(encbuf, &config))
+		config["foo"].Value, err = handler.Encrypt("new foo value")
+		require.Nil(t, err)
+		encbuf, err = json.Marshal(config)
+		require.Nil(t, err)
+
+		crypto.calls.Store(0)
+		changed, err = app.checkin(client, crypto)
+		require.Nil(t, err)
+		require.True(t, changed)
+		require.Equal(t, int32(1), crypto.calls.Load())
+		assertFile(t, filepath.Join(tempdir, "foo"), []byte("new foo value"))
+		assertExtracted()
+
+		// If something else modified an extracted file, it must be decrypted
+		// again rather than trusting what's on disk
+		require.Nil(t, os.WriteFile(filepath.Join(tempdir, "with/subdir/1.txt"), []byte("tampered"), 0o644))
+		crypto.calls.Store(0)
+		changed, err = app.checkin(client, crypto)
+		require.Nil(t, err)
+		require.True(t, changed)
+		require.Equal(t, int32(1), crypto.calls.Load())
+		assertExtracted()
+
+		// The cache is kept on disk, so a new process (a one-shot check-in
+		// or extract at boot) doesn't have to decrypt either
+		st, err := os.Stat(filepath.Join(tempdir, AppliedCacheFile))
+		require.Nil(t, err)
+		require.Equal(t, os.FileMode(0o600), st.Mode().Perm())
+
+		fresh, err := NewApp([]string{tempdir}, tempdir, true, true)
+		require.Nil(t, err)
+		fresh.configUrl = app.configUrl
+		crypto.calls.Store(0)
+		changed, err = fresh.checkin(client, crypto)
+		require.Nil(t, err)
+		require.False(t, changed)
+		require.Equal(t, int32(0), crypto.calls.Load())
+
+		config, err = UnmarshallBuffer(nil, encbuf, false)
+		require.Nil(t, err)
+		_, err = fresh.decryptChanged(crypto, config)
+		require.Nil(t, err)
+		require.Equal(t, int32(0), crypto.calls.Load())
+		require.Equal(t, "new foo value", config["foo"].Value)
+		changed, err = fresh.Extract()
+		require.Nil(t, err)
+		require.False(t, changed)
+		assertExtracted()
+
+		// Entries recorded for another key can't be trusted
+		var cache appliedCache
+		buf, err := os.ReadFile(filepath.Join(tempdir, AppliedCacheFile))
+		require.Nil(t, err)
+		require.Nil(t, json.Unmarshal(buf, &cache))
+		cache.KeyId = "00000000"
+		buf, err = json.Marshal(cache)
+		require.Nil(t, err)
+		require.Nil(t, os.WriteFile(filepath.Join(tempdir, AppliedCacheFile), buf, 0o600))
+		config, err = UnmarshallBuffer(nil, encbuf, false)
+		require.Nil(t, err)
+		_, err = fresh.decryptChanged(crypto, config)
+		require.Nil(t, err)
+		require.Equal(t, int32(3), crypto.calls.Load())
+	})
+}
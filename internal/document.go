@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ConfigDocumentVersion is the newest config envelope format we understand
+const ConfigDocumentVersion = 1
+
+// ConfigMediaType is sent in the Accept header so the server knows it can
+// respond with a ConfigDocument rather than the legacy format.
+const ConfigMediaType = "application/vnd.fioconfig.v1+json"
+
+var acceptHeader = ConfigMediaType + ", application/json;q=0.9"
+
+// ConfigDocument is the versioned envelope for a config. Older servers send
+// either a bare map of files or a bare {"layers": [...]} object. These are
+// treated as version 0.
+//
+//	{"version": 1, "issued-at": "...", "files": {...}}
+//	{"version": 1, "issued-at": "...", "layers": [...]}
+type ConfigDocument struct {
+	Version  int           `json:"version"`
+	IssuedAt string        `json:"issued-at,omitempty"`
+	Files    ConfigStruct  `json:"files,omitempty"`
+	Layers   []ConfigLayer `json:"layers,omitempty"`
+}
+
+// isDocument detects the envelope. A legacy config could have a file named
+// "version", but its value would be an object rather than a number.
+func isDocument(top map[string]json.RawMessage) bool {
+	raw, ok := top["version"]
+	if !ok {
+		return false
+	}
+	raw = bytes.TrimSpace(raw)
+	return len(raw) > 0 && raw[0] >= '0' && raw[0] <= '9'
+}
+
+// parseDocument handles all the config formats a server may send
+func parseDocument(content []byte) (*ConfigDocument, error) {
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(content, &top); err != nil {
+		return nil, fmt.Errorf("Unable to parse encrypted json: %v", err)
+	}
+
+	var doc ConfigDocument
+	if isDocument(top) {
+		if err := json.Unmarshal(content, &doc); err != nil {
+			return nil, fmt.Errorf("Unable to parse config document: %v", err)
+		}
+		if doc.Version < 1 || doc.Version > ConfigDocumentVersion {
+			return nil, fmt.Errorf("Unsupported config document version: %d", doc.Version)
+		}
+		if doc.Files != nil && doc.Layers != nil {
+			return nil, errors.New("Config document can't include both files and layers")
+		}
+	} else if isLayered(top) {
+		var layered layeredConfig
+		if err := json.Unmarshal(content, &layered); err != nil {
+			return nil, fmt.Errorf("Unable to parse layered json: %v", err)
+		}
+		doc.Layers = layered.Layers
+	} else if err := json.Unmarshal(content, &doc.Files); err != nil {
+		return nil, fmt.Errorf("Unable to parse encrypted json: %v", err)
+	}
+	return &doc, nil
+}
+
+// Config returns the files defined by the document
+func (d ConfigDocument) Config() (ConfigStruct, error) {
+	if d.Layers != nil {
+		return mergeLayers(d.Layers)
+	}
+	if d.Files == nil {
+		return make(ConfigStruct), nil
+	}
+	return d.Files, nil
+}
+
+// upgradeDocument converts content in an older format into the current
+// ConfigDocumentVersion. Content already in this version is returned as is.
+func upgradeDocument(content []byte) ([]byte, bool, error) {
+	doc, err := parseDocument(content)
+	if err != nil {
+		return nil, false, err
+	}
+	if doc.Version == ConfigDocumentVersion {
+		return content, false, nil
+	}
+	doc.Version = ConfigDocumentVersion
+	upgraded, err := json.Marshal(doc)
+	if err != nil {
+		return nil, false, fmt.Errorf("Unable to marshal config document: %w", err)
+	}
+	return upgraded, true, nil
+}
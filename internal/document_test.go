@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigDocument(t *testing.T) {
+	buf := []byte(`{"version": 1, "issued-at": "2024-01-01T00:00:00Z", "files": {"foo": {"Value": "bar", "Unencrypted": true}}}`)
+	config, err := UnmarshallBuffer(nil, buf, true)
+	require.Nil(t, err)
+	require.Equal(t, "bar", config["foo"].Value)
+
+	buf = []byte(`{"version": 1, "layers": [{"name": "factory", "files": {"foo": {"Value": "bar", "Unencrypted": true}}}]}`)
+	config, err = UnmarshallBuffer(nil, buf, true)
+	require.Nil(t, err)
+	require.Equal(t, "factory", config["foo"].Layer)
+
+	// A legacy config with a file named "version"
+	buf = []byte(`{"version": {"Value": "1.2.3", "Unencrypted": true}}`)
+	config, err = UnmarshallBuffer(nil, buf, true)
+	require.Nil(t, err)
+	require.Equal(t, "1.2.3", config["version"].Value)
+
+	buf = []byte(`{"version": 1, "files": {}, "layers": []}`)
+	_, err = UnmarshallBuffer(nil, buf, true)
+	require.NotNil(t, err)
+
+	buf = []byte(`{"version": 99, "files": {}}`)
+	_, err = UnmarshallBuffer(nil, buf, true)
+	require.ErrorContains(t, err, "Unsupported config document version: 99")
+}
+
+func TestConfigDocumentMigration(t *testing.T) {
+	var accept string
+	var encbuf []byte
+	doGet := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/events" {
+			return
+		}
+		accept = r.Header.Get("Accept")
+		_, err := w.Write(encbuf)
+		require.Nil(t, err)
+	})
+
+	testWrapper(t, doGet, func(app *App, client *http.Client, tempdir string) {
+		legacy, err := os.ReadFile(app.EncryptedConfig)
+		require.Nil(t, err)
+		modtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+		require.Nil(t, os.Chtimes(app.EncryptedConfig, modtime, modtime))
+		_, crypto := createClient(app.sota)
+		defer crypto.Close()
+
+		// By default the config is stored as the server sent it, so older
+		// versions of fioconfig can still read it after a rollback
+		_, err = app.Extract()
+		require.Nil(t, err)
+		buf, err := os.ReadFile(app.EncryptedConfig)
+		require.Nil(t, err)
+		require.Equal(t, legacy, buf)
+		encbuf = legacy
+		_, err = app.checkin(client, crypto)
+		require.Nil(t, err)
+		buf, err = os.ReadFile(app.EncryptedConfig)
+		require.Nil(t, err)
+		require.Equal(t, legacy, buf)
+		require.Nil(t, os.Chtimes(app.EncryptedConfig, modtime, modtime))
+
+		app.upgradeConfig = true
+		_, err = app.Extract()
+		require.Nil(t, err)
+		assertFile(t, filepath.Join(tempdir, "foo"), []byte("foo file value"))
+
+		buf, err = os.ReadFile(app.EncryptedConfig)
+		require.Nil(t, err)
+		var doc ConfigDocument
+		require.Nil(t, json.Unmarshal(buf, &doc))
+		require.Equal(t, ConfigDocumentVersion, doc.Version)
+		require.Equal(t, 4, len(doc.Files))
+		fi, err := os.Stat(app.EncryptedConfig)
+		require.Nil(t, err)
+		require.True(t, modtime.Equal(fi.ModTime()))
+
+		// Migrating again is a no-op
+		require.Nil(t, app.migrateStoredConfig(nil))
+		after, err := os.ReadFile(app.EncryptedConfig)
+		require.Nil(t, err)
+		require.Equal(t, buf, after)
+
+		// Legacy configs from the server are stored in the new format too
+		require.Nil(t, os.WriteFile(app.EncryptedConfig, legacy, 0o644))
+		require.Nil(t, os.Chtimes(app.EncryptedConfig, modtime, modtime))
+		_, err = app.checkin(client, crypto)
+		require.Nil(t, err)
+		require.Contains(t, accept, ConfigMediaType)
+		buf, err = os.ReadFile(app.EncryptedConfig)
+		require.Nil(t, err)
+		require.Nil(t, json.Unmarshal(buf, &doc))
+		require.Equal(t, ConfigDocumentVersion, doc.Version)
+	})
+}
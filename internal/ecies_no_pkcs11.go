@@ -5,18 +5,18 @@ package internal
 import (
 	"crypto"
 	"crypto/ecdsa"
-	"crypto/rand"
+	"crypto/elliptic"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
-	"errors"
 	"fmt"
 	"math/big"
+	"runtime"
 
+	"github.com/foundriesio/fioconfig/sotatoml"
 	ecies "github.com/foundriesio/go-ecies"
 )
 
-var ErrNoPkcs11 = errors.New("DeleteKeyPair not supported in local ECIES handler")
-
 type EciesCrypto struct {
 	PrivKey ecies.KeyProvider
 }
@@ -29,6 +29,10 @@ func NewEciesLocalHandler(privKey crypto.PrivateKey) CryptoHandler {
 }
 
 func (ec *EciesCrypto) Decrypt(value string) ([]byte, error) {
+	value, err := untagValue(ec.Public(), value)
+	if err != nil {
+		return nil, err
+	}
 	data, err := base64.StdEncoding.DecodeString(value)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to base64 decode: %v", err)
@@ -41,17 +45,22 @@ func (ec *EciesCrypto) Decrypt(value string) ([]byte, error) {
 }
 
 func (ec *EciesCrypto) Encrypt(value string) (string, error) {
-	enc, err := ecies.Encrypt(rand.Reader, ec.PrivKey.Public(), []byte(value), nil, nil)
-	if err != nil {
-		return "", err
-	}
-	return base64.StdEncoding.EncodeToString(enc), nil
+	return eciesEncrypt(ec.PrivKey.Public(), []byte(value))
+}
+
+func (ec *EciesCrypto) Public() crypto.PublicKey {
+	return ec.PrivKey.Public().ExportECDSA()
 }
 
 func (ec *EciesCrypto) UsePkcs11() bool {
 	return false
 }
 
+// Concurrency returns how many values can be decrypted at once
+func (ec *EciesCrypto) Concurrency() int {
+	return runtime.NumCPU()
+}
+
 func (ec *EciesCrypto) DeleteKeyPair(id []byte, label []byte) error {
 	return ErrNoPkcs11
 }
@@ -64,14 +73,33 @@ func (ec *EciesCrypto) ImportCertificateWithLabel(id []byte, label []byte, certi
 	return ErrNoPkcs11
 }
 
-func (ec *EciesCrypto) GenerateKeyPair(id []byte, label []byte) (crypto.Signer, error) {
+func (ec *EciesCrypto) GenerateKeyPair(id []byte, label []byte, curve elliptic.Curve) (crypto.Signer, error) {
 	return nil, ErrNoPkcs11
 }
 
+func (ec *EciesCrypto) FindTlsCertificate(keyId []byte, certId []byte) (tls.Certificate, error) {
+	return tls.Certificate{}, ErrNoPkcs11
+}
+
+func (ec *EciesCrypto) ImportKeyPair(id []byte, label []byte, key crypto.PrivateKey) error {
+	return ErrNoPkcs11
+}
+
+func (ec *EciesCrypto) HasKeyPair(id []byte) (bool, error) {
+	return false, ErrNoPkcs11
+}
+
+func (ec *EciesCrypto) HasCertificate(id []byte) (bool, error) {
+	return false, ErrNoPkcs11
+}
+
 func (ec *EciesCrypto) Close() {
 }
 
-func NewEciesPkcs11Handler(ctx any, privKey crypto.PrivateKey) CryptoHandler {
+func (ec *EciesCrypto) setPkcs11Login(cfg *sotatoml.AppConfig) {
+}
+
+func NewEciesPkcs11Handler(ctx any, privKey crypto.PrivateKey, maxSessions int) CryptoHandler {
 	Fatal("NewEciesPkcs11Handler should not be called in disable_pkcs11 build")
 	return nil
 }
@@ -6,31 +6,45 @@ import (
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
-	"crypto/rand"
+	"crypto/tls"
 	"crypto/x509"
+	"encoding/asn1"
 	"encoding/base64"
 	"fmt"
 	"math/big"
+	"runtime"
 
 	"github.com/ThalesIgnite/crypto11"
 	"github.com/foundriesio/fioconfig/sotatoml"
+	"github.com/foundriesio/fioconfig/transport"
 	ecies "github.com/foundriesio/go-ecies"
 	"github.com/miekg/pkcs11"
 )
 
 type EciesCrypto struct {
-	PrivKey ecies.KeyProvider
-	ctx     *crypto11.Context
+	PrivKey  ecies.KeyProvider
+	ctx      *crypto11.Context
+	sessions int
+
+	// crypto11 can't import private keys, so ImportKeyPair logs in to the
+	// token on its own
+	module string
+	pin    string
+	token  string
 }
 
 func NewEciesLocalHandler(privKey crypto.PrivateKey) CryptoHandler {
 	if ec, ok := privKey.(*ecdsa.PrivateKey); ok {
-		return &EciesCrypto{ecies.ImportECDSA(ec), nil}
+		return &EciesCrypto{PrivKey: ecies.ImportECDSA(ec)}
 	}
 	return nil
 }
 
 func (ec *EciesCrypto) Decrypt(value string) ([]byte, error) {
+	value, err := untagValue(ec.Public(), value)
+	if err != nil {
+		return nil, err
+	}
 	data, err := base64.StdEncoding.DecodeString(value)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to base64 decode: %v", err)
@@ -43,17 +57,27 @@ func (ec *EciesCrypto) Decrypt(value string) ([]byte, error) {
 }
 
 func (ec *EciesCrypto) Encrypt(value string) (string, error) {
-	enc, err := ecies.Encrypt(rand.Reader, ec.PrivKey.Public(), []byte(value), nil, nil)
-	if err != nil {
-		return "", err
-	}
-	return base64.StdEncoding.EncodeToString(enc), nil
+	return eciesEncrypt(ec.PrivKey.Public(), []byte(value))
+}
+
+func (ec *EciesCrypto) Public() crypto.PublicKey {
+	return ec.PrivKey.Public().ExportECDSA()
 }
 
 func (ec *EciesCrypto) UsePkcs11() bool {
 	return ec.ctx != nil
 }
 
+// Concurrency returns how many values can be decrypted at once. crypto11
+// keeps one of its sessions for itself, so PKCS#11 keys get one less than
+// the configured maximum.
+func (ec *EciesCrypto) Concurrency() int {
+	if ec.ctx != nil {
+		return max(ec.sessions-1, 1)
+	}
+	return runtime.NumCPU()
+}
+
 func (ec *EciesCrypto) DeleteKeyPair(id []byte, label []byte) error {
 	return ec.ctx.DeleteKeyPair(id, label)
 }
@@ -66,7 +90,7 @@ func (ec *EciesCrypto) ImportCertificateWithLabel(id []byte, label []byte, certi
 	return ec.ctx.ImportCertificateWithLabel(id, label, certificate)
 }
 
-func (ec *EciesCrypto) GenerateKeyPair(id []byte, label []byte) (crypto.Signer, error) {
+func (ec *EciesCrypto) GenerateKeyPair(id []byte, label []byte, curve elliptic.Curve) (crypto.Signer, error) {
 	if err := ec.ctx.DeleteKeyPair(id, label); err != nil {
 		return nil, fmt.Errorf("Unable to free up slot(%s) for new keypair: %w", id, err)
 	}
@@ -78,21 +102,168 @@ func (ec *EciesCrypto) GenerateKeyPair(id []byte, label []byte) (crypto.Signer,
 	// derive which is required for ECIES decryption
 	pubAttr.AddIfNotPresent([]*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_DERIVE, true)})
 	privAttr := pubAttr.Copy()
-	signer, err := ec.ctx.GenerateECDSAKeyPairWithAttributes(pubAttr, privAttr, elliptic.P256())
+	signer, err := ec.ctx.GenerateECDSAKeyPairWithAttributes(pubAttr, privAttr, curve)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to generate new keypair in HSM: %w", err)
 	}
 	return signer, nil
 }
 
+// HasKeyPair reports whether the HSM holds a key pair with the given id
+func (ec *EciesCrypto) HasKeyPair(id []byte) (bool, error) {
+	signer, err := ec.ctx.FindKeyPair(id, nil)
+	return signer != nil, err
+}
+
+// HasCertificate reports whether the HSM holds a certificate with the given id
+func (ec *EciesCrypto) HasCertificate(id []byte) (bool, error) {
+	cert, err := ec.ctx.FindCertificate(id, nil, nil)
+	return cert != nil, err
+}
+
+// FindTlsCertificate loads a key pair and client certificate from the HSM so
+// they can be used for a TLS connection.
+func (ec *EciesCrypto) FindTlsCertificate(keyId []byte, certId []byte) (tls.Certificate, error) {
+	signer, err := ec.ctx.FindKeyPair(keyId, nil)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("Unable to load pkcs11 private key: %w", err)
+	} else if signer == nil {
+		return tls.Certificate{}, fmt.Errorf("No pkcs11 private key in slot %x", keyId)
+	}
+	cert, err := ec.ctx.FindCertificate(certId, nil, nil)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("Unable to load pkcs11 client certificate: %w", err)
+	} else if cert == nil {
+		return tls.Certificate{}, fmt.Errorf("No pkcs11 client certificate in slot %x", certId)
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{cert.Raw},
+		PrivateKey:  signer,
+		Leaf:        cert,
+	}, nil
+}
+
+// ImportKeyPair stores an ECDSA key generated elsewhere, like by an EST
+// server, in the HSM. Any key pair already in the slot is replaced.
+func (ec *EciesCrypto) ImportKeyPair(id []byte, label []byte, key crypto.PrivateKey) error {
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return fmt.Errorf("Unsupported key type for pkcs11 import: %T", key)
+	}
+	var curveOid asn1.ObjectIdentifier
+	switch ecKey.Curve {
+	case elliptic.P256():
+		curveOid = oidCurveP256
+	case elliptic.P384():
+		curveOid = oidCurveP384
+	default:
+		return fmt.Errorf("Unsupported curve for pkcs11 import: %s", ecKey.Curve.Params().Name)
+	}
+	ecdhKey, err := ecKey.ECDH()
+	if err != nil {
+		return err
+	}
+	ecParams, err := asn1.Marshal(curveOid)
+	if err != nil {
+		return err
+	}
+	ecPoint, err := asn1.Marshal(ecdhKey.PublicKey().Bytes())
+	if err != nil {
+		return err
+	}
+
+	if err := ec.ctx.DeleteKeyPair(id, label); err != nil {
+		return fmt.Errorf("Unable to free up slot(%s) for new keypair: %w", id, err)
+	}
+
+	p := pkcs11.New(ec.module)
+	if p == nil {
+		return fmt.Errorf("Unable to load pkcs11 module: %s", ec.module)
+	}
+	// The module is shared with crypto11, so it must not be finalized here
+	defer p.Destroy()
+	if err := p.Initialize(); err != nil && err != pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		return fmt.Errorf("Unable to initialize pkcs11 module: %w", err)
+	}
+	slot, err := ec.findTokenSlot(p)
+	if err != nil {
+		return err
+	}
+	session, err := p.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		return fmt.Errorf("Unable to open pkcs11 session: %w", err)
+	}
+	defer func() {
+		_ = p.CloseSession(session)
+	}()
+	// Logging out would also log out crypto11's sessions
+	if err := p.Login(session, pkcs11.CKU_USER, ec.pin); err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+		return fmt.Errorf("Unable to log in to pkcs11 token: %w", err)
+	}
+
+	common := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, ecParams),
+		// Required for ECIES decryption, like in GenerateKeyPair
+		pkcs11.NewAttribute(pkcs11.CKA_DERIVE, true),
+	}
+	private := append([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, ecdhKey.Bytes()),
+	}, common...)
+	if _, err := p.CreateObject(session, private); err != nil {
+		return fmt.Errorf("Unable to import private key into HSM: %w", err)
+	}
+	public := append([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, ecPoint),
+	}, common...)
+	if _, err := p.CreateObject(session, public); err != nil {
+		return fmt.Errorf("Unable to import public key into HSM: %w", err)
+	}
+	return nil
+}
+
+func (ec *EciesCrypto) findTokenSlot(p *pkcs11.Ctx) (uint, error) {
+	slots, err := p.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to list pkcs11 slots: %w", err)
+	}
+	for _, slot := range slots {
+		info, err := p.GetTokenInfo(slot)
+		if err == nil && info.Label == ec.token {
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("Unable to find pkcs11 token: %s", ec.token)
+}
+
+// setPkcs11Login records what ImportKeyPair needs to log in to the token.
+func (ec *EciesCrypto) setPkcs11Login(cfg *sotatoml.AppConfig) {
+	ec.module = cfg.Get("p11.module")
+	ec.pin = cfg.Get("p11.pass")
+	ec.token = cfg.GetDefault("p11.label", "aktualizr")
+}
+
 func (ec *EciesCrypto) Close() {
 	if ec.ctx != nil {
 		ec.ctx.Close()
 	}
 }
 
-func NewEciesPkcs11Handler(ctx interface{}, privKey crypto.PrivateKey) CryptoHandler {
-	return &EciesCrypto{ImportPcks11(ctx.(*crypto11.Context), privKey), ctx.(*crypto11.Context)}
+func NewEciesPkcs11Handler(ctx interface{}, privKey crypto.PrivateKey, maxSessions int) CryptoHandler {
+	return &EciesCrypto{
+		PrivKey:  ImportPcks11(ctx.(*crypto11.Context), privKey),
+		ctx:      ctx.(*crypto11.Context),
+		sessions: maxSessions,
+	}
 }
 
 func getPkcs11CryptoHandler(h *certRotationContext) (*EciesCrypto, error) {
@@ -103,7 +274,7 @@ func getPkcs11CryptoHandler(h *certRotationContext) (*EciesCrypto, error) {
 		Path:        module,
 		TokenLabel:  h.app.sota.GetDefault("p11.label", "aktualizr"),
 		Pin:         pin,
-		MaxSessions: 2,
+		MaxSessions: transport.Pkcs11MaxSessions(h.app.sota),
 	}
 
 	ctx, err := crypto11.Configure(&cfg)
@@ -115,7 +286,9 @@ func getPkcs11CryptoHandler(h *certRotationContext) (*EciesCrypto, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Unable to find new HSM private key: %w", err)
 	}
-	return NewEciesPkcs11Handler(ctx, privKey).(*EciesCrypto), nil
+	handler := NewEciesPkcs11Handler(ctx, privKey, cfg.MaxSessions).(*EciesCrypto)
+	handler.setPkcs11Login(h.app.sota)
+	return handler, nil
 }
 
 type PrivateKeyPkcs11 struct {
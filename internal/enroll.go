@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.mozilla.org/pkcs7"
+)
+
+// The protocols a certificate can be renewed with
+const (
+	EnrollProtocolEst  = "est"
+	EnrollProtocolScep = "scep"
+)
+
+var EnrollProtocols = []string{EnrollProtocolEst, EnrollProtocolScep}
+
+// enroller requests certificates from a PKI on behalf of the device.
+type enroller interface {
+	// csrAttrs returns what the PKI would like in a CSR, or nil if it has
+	// no preference.
+	csrAttrs() (*csrAttrs, error)
+	// enroll submits a DER encoded CSR for a new key and returns the
+	// certificate issued for it.
+	enroll(csr []byte) (*x509.Certificate, error)
+	// caCerts returns the PKI's current CA certificates.
+	caCerts() ([]*x509.Certificate, error)
+	// reachable returns an error if the server can't be talked to.
+	reachable() error
+}
+
+// serverKeyGenerator is implemented by enrollers that can have the PKI
+// generate the new key. decrypt is used when the PKI encrypts the key to the
+// device's current key.
+type serverKeyGenerator interface {
+	serverKeyGen(csr []byte, decrypt func(*pkcs7.PKCS7) ([]byte, error)) (crypto.PrivateKey, *x509.Certificate, error)
+}
+
+// enrollProtocol works out which protocol to use for a server URL. A URL
+// like `scep+https://ca.example.com/scep` selects SCEP unless a protocol was
+// given explicitly. The URL is returned without the protocol prefix.
+func enrollProtocol(protocol, server string) (string, string, error) {
+	if prefix, url, ok := strings.Cut(server, "+"); ok && !strings.Contains(prefix, "/") {
+		if len(protocol) == 0 {
+			protocol = prefix
+		}
+		server = url
+	}
+	switch protocol {
+	case "", EnrollProtocolEst:
+		return EnrollProtocolEst, server, nil
+	case EnrollProtocolScep:
+		return EnrollProtocolScep, server, nil
+	}
+	return "", "", fmt.Errorf("Unsupported enrollment protocol: %s, must be one of: %s", protocol, strings.Join(EnrollProtocols, ", "))
+}
+
+// newEnroller returns the enroller for a rotation's server and protocol.
+func newEnroller(handler *certRotationContext) (enroller, error) {
+	protocol, server, err := enrollProtocol(handler.State.Protocol, handler.State.EstServer)
+	if err != nil {
+		return nil, err
+	}
+	if protocol == EnrollProtocolScep {
+		tlsCert := handler.client.Transport.(*http.Transport).TLSClientConfig.Certificates[0]
+		cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse client certificate: %w", err)
+		}
+		return &scepEnroller{client: handler.client, server: server, cert: cert, key: tlsCert.PrivateKey}, nil
+	}
+	return &estEnroller{client: handler.client, server: server}, nil
+}
+
+// estEnroller implements EST (RFC 7030) simple re-enrollment.
+type estEnroller struct {
+	client *http.Client
+	server string
+}
+
+func (e *estEnroller) csrAttrs() (*csrAttrs, error) {
+	return estCsrAttrs(e.client, e.server)
+}
+
+func (e *estEnroller) enroll(csr []byte) (*x509.Certificate, error) {
+	buf, ct, err := estPost(e.client, e.server, "/simplereenroll", []byte(base64.StdEncoding.EncodeToString(csr)))
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(ct, "application/pkcs7-mime") {
+		return nil, fmt.Errorf("Unexpected content-type return in certificate response: %s", ct)
+	}
+	return decodeEstResponse(string(buf))
+}
+
+func (e *estEnroller) caCerts() ([]*x509.Certificate, error) {
+	return estCaCerts(e.client, e.server)
+}
+
+// reachable fetches the CA certs. A server without /cacerts is still up.
+func (e *estEnroller) reachable() error {
+	_, err := estGet(e.client, e.server, "/cacerts", "application/pkcs7-mime")
+	return err
+}
+
+func (e *estEnroller) serverKeyGen(csr []byte, decrypt func(*pkcs7.PKCS7) ([]byte, error)) (crypto.PrivateKey, *x509.Certificate, error) {
+	buf, ct, err := estPost(e.client, e.server, "/serverkeygen", []byte(base64.StdEncoding.EncodeToString(csr)))
+	if err != nil {
+		return nil, nil, err
+	}
+	return parseServerKeyGenResponse(ct, buf, decrypt)
+}
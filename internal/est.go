@@ -0,0 +1,295 @@
+package internal
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/foundriesio/fioconfig/transport"
+	"go.mozilla.org/pkcs7"
+)
+
+var (
+	oidEcPublicKey   = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	oidCurveP256     = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+	oidCurveP384     = asn1.ObjectIdentifier{1, 3, 132, 0, 34}
+	oidRsaEncryption = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidEd25519       = asn1.ObjectIdentifier{1, 3, 101, 112}
+
+	csrSignatureAlgorithms = map[string]x509.SignatureAlgorithm{
+		"1.2.840.10045.4.3.2":   x509.ECDSAWithSHA256,
+		"1.2.840.10045.4.3.3":   x509.ECDSAWithSHA384,
+		"1.2.840.10045.4.3.4":   x509.ECDSAWithSHA512,
+		"1.2.840.113549.1.1.11": x509.SHA256WithRSA,
+		"1.2.840.113549.1.1.12": x509.SHA384WithRSA,
+		"1.2.840.113549.1.1.13": x509.SHA512WithRSA,
+		"1.3.101.112":           x509.PureEd25519,
+	}
+)
+
+// csrAttrs holds the parts of an EST server's CSR attributes (RFC 7030
+// section 4.5) that fioconfig knows how to honor.
+type csrAttrs struct {
+	KeyType            string
+	RsaBits            int
+	SignatureAlgorithm x509.SignatureAlgorithm
+}
+
+type csrAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+// estGet performs a GET against an EST endpoint and returns the base64
+// decoded body. It returns nil when the server does not implement it.
+func estGet(client *http.Client, server, path, contentType string) ([]byte, error) {
+	res, err := transport.HttpGet(client, server+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch res.StatusCode {
+	case 200:
+	case 204, 404, 501:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("Unable to get %s: HTTP_%d - %s", path, res.StatusCode, res.String())
+	}
+	if ct := res.Header.Get("content-type"); !strings.HasPrefix(ct, contentType) {
+		return nil, fmt.Errorf("Unexpected content-type return in %s response: %s", path, ct)
+	}
+	buf, err := base64.StdEncoding.DecodeString(string(res.Body))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to base64 decode %s response: %w", path, err)
+	}
+	return buf, nil
+}
+
+// estCaCerts returns the EST server's current CA certificates.
+func estCaCerts(client *http.Client, server string) ([]*x509.Certificate, error) {
+	buf, err := estGet(client, server, "/cacerts", "application/pkcs7-mime")
+	if err != nil {
+		return nil, err
+	}
+	if buf == nil {
+		return nil, errors.New("EST server does not provide CA certificates")
+	}
+	p7, err := pkcs7.Parse(buf)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid pkcs7 data in /cacerts response: %w", err)
+	}
+	if len(p7.Certificates) == 0 {
+		return nil, errors.New("EST server returned no CA certificates")
+	}
+	for _, cert := range p7.Certificates {
+		if !cert.IsCA {
+			return nil, fmt.Errorf("EST server returned a non CA certificate: %s", cert.Subject)
+		}
+	}
+	return p7.Certificates, nil
+}
+
+// estCsrAttrs returns the attributes the EST server would like in a CSR.
+// It returns nil if the server has no preference.
+func estCsrAttrs(client *http.Client, server string) (*csrAttrs, error) {
+	buf, err := estGet(client, server, "/csrattrs", "application/csrattrs")
+	if err != nil || len(buf) == 0 {
+		return nil, err
+	}
+	return parseCsrAttrs(buf)
+}
+
+func parseCsrAttrs(der []byte) (*csrAttrs, error) {
+	var items []asn1.RawValue
+	if rest, err := asn1.Unmarshal(der, &items); err != nil {
+		return nil, fmt.Errorf("Invalid CSR attributes: %w", err)
+	} else if len(rest) > 0 {
+		return nil, errors.New("Invalid CSR attributes: trailing data")
+	}
+
+	attrs := &csrAttrs{}
+	for _, item := range items {
+		if item.Class == asn1.ClassUniversal && item.Tag == asn1.TagOID {
+			var oid asn1.ObjectIdentifier
+			if _, err := asn1.Unmarshal(item.FullBytes, &oid); err != nil {
+				return nil, fmt.Errorf("Invalid CSR attributes: %w", err)
+			}
+			if alg, ok := csrSignatureAlgorithms[oid.String()]; ok {
+				attrs.SignatureAlgorithm = alg
+				if oid.Equal(oidEd25519) {
+					attrs.KeyType = KeyTypeEd25519
+				}
+			} else {
+				slog.Info("Ignoring unsupported CSR attribute", "oid", oid)
+			}
+			continue
+		}
+
+		var attr csrAttribute
+		if _, err := asn1.Unmarshal(item.FullBytes, &attr); err != nil {
+			return nil, fmt.Errorf("Invalid CSR attributes: %w", err)
+		}
+		switch {
+		case attr.Type.Equal(oidEcPublicKey) && len(attr.Values) == 1:
+			var curve asn1.ObjectIdentifier
+			if _, err := asn1.Unmarshal(attr.Values[0].FullBytes, &curve); err != nil {
+				return nil, fmt.Errorf("Invalid CSR attributes: %w", err)
+			}
+			if curve.Equal(oidCurveP256) {
+				attrs.KeyType = KeyTypeP256
+			} else if curve.Equal(oidCurveP384) {
+				attrs.KeyType = KeyTypeP384
+			} else {
+				slog.Info("Ignoring unsupported curve in CSR attributes", "oid", curve)
+			}
+		case attr.Type.Equal(oidRsaEncryption) && len(attr.Values) == 1:
+			if _, err := asn1.Unmarshal(attr.Values[0].FullBytes, &attrs.RsaBits); err != nil {
+				return nil, fmt.Errorf("Invalid CSR attributes: %w", err)
+			}
+			attrs.KeyType = KeyTypeRsa
+		default:
+			slog.Info("Ignoring unsupported CSR attribute", "oid", attr.Type)
+		}
+	}
+	return attrs, nil
+}
+
+// signatureAlgorithmFor returns the signature algorithm requested by the EST
+// server if it can be used with the given key. Otherwise it returns
+// x509.UnknownSignatureAlgorithm so that Go picks a default.
+func (a *csrAttrs) signatureAlgorithmFor(pub crypto.PublicKey) x509.SignatureAlgorithm {
+	if a == nil || a.SignatureAlgorithm == x509.UnknownSignatureAlgorithm {
+		return x509.UnknownSignatureAlgorithm
+	}
+	var ok bool
+	switch pub.(type) {
+	case *ecdsa.PublicKey:
+		ok = a.SignatureAlgorithm == x509.ECDSAWithSHA256 || a.SignatureAlgorithm == x509.ECDSAWithSHA384 || a.SignatureAlgorithm == x509.ECDSAWithSHA512
+	case *rsa.PublicKey:
+		ok = a.SignatureAlgorithm == x509.SHA256WithRSA || a.SignatureAlgorithm == x509.SHA384WithRSA || a.SignatureAlgorithm == x509.SHA512WithRSA
+	case ed25519.PublicKey:
+		ok = a.SignatureAlgorithm == x509.PureEd25519
+	}
+	if !ok {
+		slog.Warn("Requested CSR signature algorithm does not match the key", "algorithm", a.SignatureAlgorithm)
+		return x509.UnknownSignatureAlgorithm
+	}
+	return a.SignatureAlgorithm
+}
+
+// estPost submits a base64 encoded CSR to an EST endpoint and returns the
+// response body along with its content type.
+func estPost(client *http.Client, server, path string, csr []byte) ([]byte, string, error) {
+	res, err := client.Post(server+path, "application/pkcs10", bytes.NewBuffer(csr))
+	if err != nil {
+		return nil, "", fmt.Errorf("Unable to submit certificate signing request: %w", err)
+	}
+	defer res.Body.Close()
+	buf, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("Unable to read certificate response body: HTTP_%d - %w", res.StatusCode, err)
+	}
+
+	// Older version of foundriesio/estserver returned the status code 201, which is also required by older versions of foundriesio/fioconfig
+	// The spec requires status code 200.
+	if res.StatusCode != 200 && res.StatusCode != 201 {
+		return nil, "", fmt.Errorf("Unable to obtain new certificate: HTTP_%d - %s", res.StatusCode, string(buf))
+	}
+	return buf, res.Header.Get("content-type"), nil
+}
+
+// parseServerKeyGenResponse extracts the private key and certificate from an
+// EST /serverkeygen response (RFC 7030 section 4.4.2). The key is either a
+// plain PKCS#8 part, protected only by TLS, or a CMS EnvelopedData part which
+// is passed to decrypt.
+func parseServerKeyGenResponse(contentType string, body []byte, decrypt func(*pkcs7.PKCS7) ([]byte, error)) (crypto.PrivateKey, *x509.Certificate, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "multipart/mixed" {
+		return nil, nil, fmt.Errorf("Unexpected content-type return in serverkeygen response: %s", contentType)
+	}
+
+	var key crypto.PrivateKey
+	var cert *x509.Certificate
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("Invalid multipart serverkeygen response: %w", err)
+		}
+		buf, err := io.ReadAll(part)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to read serverkeygen response: %w", err)
+		}
+		der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(buf)), ""))
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to base64 decode serverkeygen response: %w", err)
+		}
+
+		partType, partParams, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		switch {
+		case partType == "application/pkcs8":
+			if key, err = x509.ParsePKCS8PrivateKey(der); err != nil {
+				return nil, nil, fmt.Errorf("Invalid private key in serverkeygen response: %w", err)
+			}
+		case partType == "application/pkcs7-mime" && partParams["smime-type"] == "server-generated-key":
+			if key, err = decryptServerKey(der, decrypt); err != nil {
+				return nil, nil, err
+			}
+		case partType == "application/pkcs7-mime":
+			p7, err := pkcs7.Parse(der)
+			if err != nil || len(p7.Certificates) == 0 {
+				return nil, nil, fmt.Errorf("Invalid certificate in serverkeygen response: %v", err)
+			}
+			cert = p7.Certificates[0]
+		default:
+			slog.Warn("Ignoring unexpected part of serverkeygen response", "content-type", partType)
+		}
+	}
+	if key == nil || cert == nil {
+		return nil, nil, errors.New("Serverkeygen response must include a private key and a certificate")
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("Unsupported server generated key type: %T", key)
+	}
+	pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(cert.PublicKey) {
+		return nil, nil, errors.New("Server generated key does not match its certificate")
+	}
+	return key, cert, nil
+}
+
+func decryptServerKey(der []byte, decrypt func(*pkcs7.PKCS7) ([]byte, error)) (crypto.PrivateKey, error) {
+	p7, err := pkcs7.Parse(der)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid encrypted key in serverkeygen response: %w", err)
+	}
+	content, err := decrypt(p7)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decrypt server generated key: %w", err)
+	}
+	// The key may be signed by the server inside the envelope
+	if signed, err := pkcs7.Parse(content); err == nil && len(signed.Content) > 0 {
+		content = signed.Content
+	}
+	key, err := x509.ParsePKCS8PrivateKey(content)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid private key in serverkeygen response: %w", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,298 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+	"github.com/stretchr/testify/require"
+	"go.mozilla.org/pkcs7"
+)
+
+func testCsrAttrs(t *testing.T, items ...any) []byte {
+	der, err := asn1.Marshal(items)
+	require.Nil(t, err)
+	return der
+}
+
+func testCsrAttribute(t *testing.T, oid asn1.ObjectIdentifier, value any) csrAttribute {
+	der, err := asn1.Marshal(value)
+	require.Nil(t, err)
+	return csrAttribute{Type: oid, Values: []asn1.RawValue{{FullBytes: der}}}
+}
+
+func testCaCert(t *testing.T, isCA bool) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	return cert
+}
+
+func TestParseCsrAttrs(t *testing.T) {
+	oidChallengePassword := asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 7}
+
+	attrs, err := parseCsrAttrs(testCsrAttrs(t,
+		oidChallengePassword,
+		asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3},
+		testCsrAttribute(t, oidEcPublicKey, oidCurveP384),
+	))
+	require.Nil(t, err)
+	require.Equal(t, KeyTypeP384, attrs.KeyType)
+	require.Equal(t, x509.ECDSAWithSHA384, attrs.SignatureAlgorithm)
+
+	attrs, err = parseCsrAttrs(testCsrAttrs(t, testCsrAttribute(t, oidRsaEncryption, 3072)))
+	require.Nil(t, err)
+	require.Equal(t, KeyTypeRsa, attrs.KeyType)
+	require.Equal(t, 3072, attrs.RsaBits)
+
+	attrs, err = parseCsrAttrs(testCsrAttrs(t, oidEd25519))
+	require.Nil(t, err)
+	require.Equal(t, KeyTypeEd25519, attrs.KeyType)
+	require.Equal(t, x509.PureEd25519, attrs.SignatureAlgorithm)
+
+	// A signature algorithm that doesn't suit the key is left to Go
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	require.Equal(t, x509.UnknownSignatureAlgorithm, attrs.signatureAlgorithmFor(key.Public()))
+	require.Equal(t, x509.UnknownSignatureAlgorithm, (*csrAttrs)(nil).signatureAlgorithmFor(key.Public()))
+
+	_, err = parseCsrAttrs([]byte("garbage"))
+	require.NotNil(t, err)
+}
+
+func TestEstCsrAttrs(t *testing.T) {
+	WithEstServer(t, func(tc testClient) {
+		testWrapper(t, nil, func(app *App, client *http.Client, tmpdir string) {
+			tc.est.csrAttrs = testCsrAttrs(t,
+				asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3},
+				testCsrAttribute(t, oidEcPublicKey, oidCurveP384),
+			)
+			stateFile := filepath.Join(tmpdir, "rotate.state")
+			handler := NewCertRotationHandler(app, stateFile, tc.srv.URL+"/.well-known/est")
+
+			step := estStep{}
+			require.Nil(t, step.Execute(&handler.stateContext))
+			require.Equal(t, x509.ECDSAWithSHA384, tc.est.csr.SignatureAlgorithm)
+			require.Equal(t, elliptic.P384(), tc.est.csr.PublicKey.(*ecdsa.PublicKey).Curve)
+
+			// The user's choice of key type wins over the server's, while the
+			// signature algorithm still suits the key
+			handler.State.KeyType = KeyTypeP256
+			require.Nil(t, step.Execute(&handler.stateContext))
+			require.Equal(t, elliptic.P256(), tc.est.csr.PublicKey.(*ecdsa.PublicKey).Curve)
+			require.Equal(t, x509.ECDSAWithSHA384, tc.est.csr.SignatureAlgorithm)
+		})
+	})
+}
+
+func TestRotateCaCerts(t *testing.T) {
+	WithEstServer(t, func(tc testClient) {
+		testWrapper(t, nil, func(app *App, client *http.Client, tmpdir string) {
+			require.Nil(t, app.sota.UpdateKeys(map[string]string{"storage.path": tmpdir}))
+			stateFile := filepath.Join(tmpdir, "rotate.state")
+			handler := NewCertRotationHandler(app, stateFile, tc.srv.URL+"/.well-known/est")
+			step := caCertsStep{}
+
+			// Nothing is done unless asked for
+			require.Nil(t, step.Execute(&handler.stateContext))
+			require.Empty(t, handler.State.NewCaCerts)
+
+			handler.State.UpdateCaCerts = true
+			require.NotNil(t, step.Execute(&handler.stateContext))
+
+			tc.est.caCerts = testCaCert(t, false).Raw
+			require.ErrorContains(t, step.Execute(&handler.stateContext), "non CA certificate")
+
+			ca := testCaCert(t, true)
+			tc.est.caCerts = ca.Raw
+			require.Nil(t, step.Execute(&handler.stateContext))
+			// The gateway's current roots are kept along with the new CA
+			expected, err := os.ReadFile(filepath.Join(tmpdir, "root.crt"))
+			require.Nil(t, err)
+			expected = append(expected, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})...)
+			require.Equal(t, string(expected), handler.State.NewCaCerts)
+
+			handler.State.NewKey = "newkey"
+			handler.State.NewCert = "newcert"
+			require.Nil(t, finalizeStep{}.Execute(&handler.stateContext))
+			sota, err := sotatoml.NewAppConfig([]string{filepath.Join(tmpdir, "sota.toml")})
+			require.Nil(t, err)
+			caPath := sota.GetOrDie("import.tls_cacert_path")
+			require.NotEqual(t, filepath.Join(tmpdir, "root.crt"), caPath)
+			assertFile(t, caPath, expected)
+
+			// An unchanged bundle is left alone
+			app.sota = sota
+			handler.State.NewCaCerts = ""
+			require.Nil(t, step.Execute(&handler.stateContext))
+			require.Empty(t, handler.State.NewCaCerts)
+			_, err = os.Stat(caPath)
+			require.Nil(t, err)
+		})
+	})
+}
+
+// testServerKey creates a key and a client certificate for it, as an EST
+// server doing server-side key generation would.
+func testServerKey(t *testing.T) (*ecdsa.PrivateKey, *x509.Certificate) {
+	block, _ := pem.Decode([]byte(client_pem))
+	clientCert, err := x509.ParseCertificate(block.Bytes)
+	require.Nil(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		RawSubject:   clientCert.RawSubject,
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{
+			{Id: oidKeyUsage, Critical: true, Value: asn1DigitalSignature},
+			{Id: oidExtendedKeyUsage, Critical: true, Value: asn1TlsWebClientAuth},
+		},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	return key, cert
+}
+
+// testServerKeyGenBody builds a /serverkeygen response with a key part of
+// the given content type and a certs-only part.
+func testServerKeyGenBody(t *testing.T, keyType string, keyDer []byte, cert *x509.Certificate) (string, []byte) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	writePart := func(contentType string, der []byte) {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", contentType)
+		header.Set("Content-Transfer-Encoding", "base64")
+		w, err := writer.CreatePart(header)
+		require.Nil(t, err)
+		_, err = w.Write([]byte(base64.StdEncoding.EncodeToString(der)))
+		require.Nil(t, err)
+	}
+	writePart(keyType, keyDer)
+	if cert != nil {
+		der, err := pkcs7.DegenerateCertificate(cert.Raw)
+		require.Nil(t, err)
+		writePart("application/pkcs7-mime; smime-type=certs-only", der)
+	}
+	require.Nil(t, writer.Close())
+	return "multipart/mixed; boundary=" + writer.Boundary(), buf.Bytes()
+}
+
+func TestParseServerKeyGenResponse(t *testing.T) {
+	key, cert := testServerKey(t)
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	require.Nil(t, err)
+	noDecrypt := func(*pkcs7.PKCS7) ([]byte, error) {
+		return nil, errors.New("not encrypted")
+	}
+
+	ct, body := testServerKeyGenBody(t, "application/pkcs8", keyDer, cert)
+	parsedKey, parsedCert, err := parseServerKeyGenResponse(ct, body, noDecrypt)
+	require.Nil(t, err)
+	require.True(t, key.Equal(parsedKey))
+	require.Equal(t, cert.Raw, parsedCert.Raw)
+
+	// A key encrypted to the device's RSA key
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	template := x509.Certificate{SerialNumber: big.NewInt(4), NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, rsaKey.Public(), rsaKey)
+	require.Nil(t, err)
+	rsaCert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	enveloped, err := pkcs7.Encrypt(keyDer, []*x509.Certificate{rsaCert})
+	require.Nil(t, err)
+	ct, body = testServerKeyGenBody(t, "application/pkcs7-mime; smime-type=server-generated-key", enveloped, cert)
+	parsedKey, _, err = parseServerKeyGenResponse(ct, body, func(p7 *pkcs7.PKCS7) ([]byte, error) {
+		return p7.Decrypt(rsaCert, rsaKey)
+	})
+	require.Nil(t, err)
+	require.True(t, key.Equal(parsedKey))
+	_, _, err = parseServerKeyGenResponse(ct, body, noDecrypt)
+	require.ErrorContains(t, err, "Unable to decrypt server generated key")
+
+	// A key that doesn't match the certificate
+	other, _ := testServerKey(t)
+	otherDer, err := x509.MarshalPKCS8PrivateKey(other)
+	require.Nil(t, err)
+	ct, body = testServerKeyGenBody(t, "application/pkcs8", otherDer, cert)
+	_, _, err = parseServerKeyGenResponse(ct, body, noDecrypt)
+	require.ErrorContains(t, err, "does not match")
+
+	ct, body = testServerKeyGenBody(t, "application/pkcs8", keyDer, nil)
+	_, _, err = parseServerKeyGenResponse(ct, body, noDecrypt)
+	require.ErrorContains(t, err, "must include a private key and a certificate")
+
+	_, _, err = parseServerKeyGenResponse("application/pkcs7-mime", body, noDecrypt)
+	require.ErrorContains(t, err, "Unexpected content-type")
+}
+
+func TestEstServerKeyGen(t *testing.T) {
+	key, cert := testServerKey(t)
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	require.Nil(t, err)
+
+	WithEstServer(t, func(tc testClient) {
+		tc.est.serverKeyGenType, tc.est.serverKeyGen = testServerKeyGenBody(t, "application/pkcs8", keyDer, cert)
+
+		testWrapper(t, nil, func(app *App, client *http.Client, tmpdir string) {
+			stateFile := filepath.Join(tmpdir, "rotate.state")
+			handler := NewCertRotationHandler(app, stateFile, tc.srv.URL+"/.well-known/est")
+			handler.State.ServerKeyGen = true
+			require.Nil(t, estStep{}.Execute(&handler.stateContext))
+			require.NotNil(t, tc.est.csr)
+
+			parsedKey, err := parsePrivateKeyPem([]byte(handler.State.NewKey))
+			require.Nil(t, err)
+			require.True(t, key.Equal(parsedKey))
+			block, _ := pem.Decode([]byte(handler.State.NewCert))
+			require.Equal(t, cert.Raw, block.Bytes)
+
+			// The key is imported into the HSM's next slot
+			withPkcs11Slots(t, app, tmpdir)
+			handler = NewCertRotationHandler(app, stateFile, tc.srv.URL+"/.well-known/est")
+			hsm := &fakeHsm{DeviceCryptoHandler: handler.crypto}
+			handler.crypto = hsm
+			handler.State.ServerKeyGen = true
+			handler.State.PkeySlotIds = []string{"01", "07"}
+			handler.State.CertSlotIds = []string{"03", "09"}
+			require.Nil(t, estStep{}.Execute(&handler.stateContext))
+			require.Equal(t, "07", handler.State.NewKey)
+			require.Equal(t, "09", handler.State.NewCert)
+			require.True(t, key.Equal(hsm.importedKeys["\x07"]))
+			require.Equal(t, cert.Raw, hsm.importedCerts["\x09"].Raw)
+		})
+	})
+}
@@ -0,0 +1,173 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+	"golang.org/x/sys/unix"
+)
+
+// EventQueueFile holds device-gateway events until the server accepts them
+const EventQueueFile = "events.queue"
+
+const (
+	eventQueueMax = 1000 // The oldest events are dropped beyond this
+	eventBatchMax = 50   // Events sent in one POST
+)
+
+// errEventsRejected is returned when the server won't accept events. Sending
+// them again wouldn't help, so they are dropped rather than retried.
+var errEventsRejected = errors.New("Server could not process events")
+
+// eventQueue persists device-gateway events so the ones emitted while the
+// server can't be reached are sent later instead of being lost. Events are
+// kept in order as a JSON array and are unique by Id.
+type eventQueue struct {
+	path string
+	max  int
+}
+
+// lock serializes access to the queue between fioconfig processes, such as
+// the daemon and a renew-cert command.
+func (q eventQueue) lock() (func(), error) {
+	f, err := os.OpenFile(q.path+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open event queue lock: %w", err)
+	}
+	if err = unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Unable to lock event queue: %w", err)
+	}
+	return func() {
+		_ = unix.Flock(int(f.Fd()), unix.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+func (q eventQueue) load() ([]DgUpdateEvent, error) {
+	buf, err := os.ReadFile(q.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Unable to read event queue: %w", err)
+	}
+	var events []DgUpdateEvent
+	if err = json.Unmarshal(buf, &events); err != nil {
+		// A corrupt queue must not stop new events from being sent
+		slog.Error("Discarding unreadable event queue", "path", q.path, "error", err)
+		return nil, nil
+	}
+	return events, nil
+}
+
+func (q eventQueue) save(events []DgUpdateEvent) error {
+	if len(events) == 0 {
+		if err := os.Remove(q.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("Unable to remove event queue: %w", err)
+		}
+		return nil
+	}
+	if dropped := len(events) - q.max; dropped > 0 {
+		slog.Warn("Event queue is full, dropping oldest events", "dropped", dropped)
+		events = events[dropped:]
+	}
+	buf, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	return sotatoml.SafeWrite(q.path, buf)
+}
+
+// push adds events to the end of the queue, skipping any already queued.
+func (q eventQueue) push(events ...DgUpdateEvent) error {
+	unlock, err := q.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	queued, err := q.load()
+	if err != nil {
+		return err
+	}
+	ids := make(map[string]bool, len(queued))
+	for _, evt := range queued {
+		ids[evt.Id] = true
+	}
+	for _, evt := range events {
+		if !ids[evt.Id] {
+			ids[evt.Id] = true
+			queued = append(queued, evt)
+		}
+	}
+	return q.save(queued)
+}
+
+// flush passes queued events to send in order, in batches of up to
+// eventBatchMax, removing each batch once sent. It stops at the first batch
+// send fails with, leaving it and the ones after it queued, unless the
+// server rejected the batch. The queue is only locked while it is read and
+// trimmed, not while a batch is sent, so other processes can keep queueing
+// events when the server is slow.
+func (q eventQueue) flush(send func([]DgUpdateEvent) error) error {
+	for {
+		batch, err := q.peek(eventBatchMax)
+		if err != nil || len(batch) == 0 {
+			return err
+		}
+		if err = send(batch); err != nil {
+			if !errors.Is(err, errEventsRejected) {
+				return err
+			}
+			slog.Error("Dropping events", "count", len(batch), "error", err)
+		}
+		if err = q.remove(batch); err != nil {
+			return err
+		}
+	}
+}
+
+// peek returns up to n events from the front of the queue
+func (q eventQueue) peek(n int) ([]DgUpdateEvent, error) {
+	unlock, err := q.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	events, err := q.load()
+	if err != nil {
+		return nil, err
+	}
+	return events[:min(len(events), n)], nil
+}
+
+// remove drops the given events from the queue. Events are matched by Id
+// since others may have been queued, or removed by another flush, while the
+// queue was unlocked.
+func (q eventQueue) remove(events []DgUpdateEvent) error {
+	unlock, err := q.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	queued, err := q.load()
+	if err != nil {
+		return err
+	}
+	ids := make(map[string]bool, len(events))
+	for _, evt := range events {
+		ids[evt.Id] = true
+	}
+	queued = slices.DeleteFunc(queued, func(evt DgUpdateEvent) bool {
+		return ids[evt.Id]
+	})
+	return q.save(queued)
+}
@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testEvents(ids ...string) []DgUpdateEvent {
+	var events []DgUpdateEvent
+	for _, id := range ids {
+		events = append(events, DgUpdateEvent{Id: id, EventType: DgEventType{Id: "Event-" + id}})
+	}
+	return events
+}
+
+func eventIds(events []DgUpdateEvent) []string {
+	var ids []string
+	for _, evt := range events {
+		ids = append(ids, evt.Id)
+	}
+	return ids
+}
+
+func TestEventQueue(t *testing.T) {
+	q := eventQueue{path: filepath.Join(t.TempDir(), EventQueueFile), max: 4}
+
+	// Events are deduplicated by Id and the oldest dropped past max
+	require.Nil(t, q.push(testEvents("1", "2")...))
+	require.Nil(t, q.push(testEvents("2", "3")...))
+	events, err := q.load()
+	require.Nil(t, err)
+	require.Equal(t, []string{"1", "2", "3"}, eventIds(events))
+	require.Nil(t, q.push(testEvents("4", "5")...))
+	events, err = q.load()
+	require.Nil(t, err)
+	require.Equal(t, []string{"2", "3", "4", "5"}, eventIds(events))
+
+	// A failed send leaves everything queued
+	offline := errors.New("offline")
+	require.ErrorIs(t, q.flush(func([]DgUpdateEvent) error { return offline }), offline)
+	events, err = q.load()
+	require.Nil(t, err)
+	require.Len(t, events, 4)
+
+	// Rejected events are dropped rather than retried forever
+	var sent []string
+	require.Nil(t, q.flush(func(batch []DgUpdateEvent) error {
+		if batch[0].Id == "2" {
+			return errEventsRejected
+		}
+		sent = append(sent, eventIds(batch)...)
+		return nil
+	}))
+	require.Nil(t, sent)
+	_, err = os.Stat(q.path)
+	require.True(t, os.IsNotExist(err))
+
+	// Events are sent in order and in batches. A failure part way through
+	// keeps the unsent batches.
+	q.max = eventQueueMax
+	var ids []string
+	for i := 0; i < 2*eventBatchMax+1; i++ {
+		ids = append(ids, fmt.Sprintf("%03d", i))
+	}
+	require.Nil(t, q.push(testEvents(ids...)...))
+	var batches [][]string
+	require.ErrorIs(t, q.flush(func(batch []DgUpdateEvent) error {
+		if len(batches) == 1 {
+			return offline
+		}
+		batches = append(batches, eventIds(batch))
+		return nil
+	}), offline)
+	events, err = q.load()
+	require.Nil(t, err)
+	require.Equal(t, ids[eventBatchMax:], eventIds(events))
+	require.Nil(t, q.flush(func(batch []DgUpdateEvent) error {
+		batches = append(batches, eventIds(batch))
+		return nil
+	}))
+	require.Equal(t, [][]string{ids[:eventBatchMax], ids[eventBatchMax : 2*eventBatchMax], ids[2*eventBatchMax:]}, batches)
+
+	// The queue isn't locked while a batch is sent, so events can be queued
+	// meanwhile. They are sent by the same flush.
+	require.Nil(t, q.push(testEvents("a")...))
+	batches = nil
+	require.Nil(t, q.flush(func(batch []DgUpdateEvent) error {
+		if len(batches) == 0 {
+			require.Nil(t, q.push(testEvents("b")...))
+		}
+		batches = append(batches, eventIds(batch))
+		return nil
+	}))
+	require.Equal(t, [][]string{{"a"}, {"b"}}, batches)
+
+	// An unreadable queue is discarded
+	require.Nil(t, os.WriteFile(q.path, []byte("not json"), 0o640))
+	events, err = q.load()
+	require.Nil(t, err)
+	require.Nil(t, events)
+}
+
+func TestEventQueueFlush(t *testing.T) {
+	var posts [][]DgUpdateEvent
+	doGet := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/events" {
+			body, err := io.ReadAll(r.Body)
+			require.Nil(t, err)
+			var events []DgUpdateEvent
+			require.Nil(t, json.Unmarshal(body, &events))
+			posts = append(posts, events)
+		}
+	})
+	testWrapper(t, doGet, func(app *App, client *http.Client, tmpdir string) {
+		// Events queued while offline go out with the next one, in order
+		require.Nil(t, app.eventQueue().push(testEvents("offline-1", "offline-2")...))
+		events := newDgEventSync(app, client)
+		events.SetCorrelationId("cor-1")
+		events.Notify("Online", nil)
+		require.Len(t, posts, 1)
+		require.Len(t, posts[0], 3)
+		require.Equal(t, []string{"offline-1", "offline-2"}, eventIds(posts[0][:2]))
+		require.Equal(t, "Online", posts[0][2].EventType.Id)
+		require.Equal(t, "cor-1", posts[0][2].Event.CorrelationId)
+		_, err := os.Stat(app.eventQueue().path)
+		require.True(t, os.IsNotExist(err))
+
+		// Checking in sends them too
+		require.Nil(t, app.eventQueue().push(testEvents("offline-3")...))
+		app.configUrl = app.sota.Get("tls.server") + "/config"
+		_, _ = app.CheckIn()
+		require.Len(t, posts, 2)
+		require.Equal(t, []string{"offline-3"}, eventIds(posts[1]))
+
+		// Nothing is sent when nothing is queued
+		_, _ = app.CheckIn()
+		require.Len(t, posts, 2)
+	})
+}
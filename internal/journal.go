@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"path/filepath"
+	"time"
+
+	"github.com/foundriesio/fioconfig/workflow"
+)
+
+// WorkflowJournalFile is the name of the journal of workflow executions in
+// the storage directory.
+const WorkflowJournalFile = "workflow.journal"
+
+// Journal returns the history of workflows, like certificate rotations, run
+// on this device.
+func (a *App) Journal() workflow.Journal {
+	return workflow.Journal{Path: filepath.Join(a.StorageDir, WorkflowJournalFile)}
+}
+
+// journalDetails identifies the keys and certificates of a rotation. Key
+// material itself is never journaled.
+func (s *CertRotationState) journalDetails() map[string]string {
+	details := make(map[string]string)
+	if block, _ := pem.Decode([]byte(s.NewCert)); block != nil {
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			details["new-cert-serial"] = cert.SerialNumber.Text(16)
+			if keyId, err := KeyId(cert.PublicKey); err == nil {
+				details["new-key-id"] = keyId
+			}
+		}
+	} else if len(s.NewCert) > 0 {
+		details["new-key-slot"] = s.NewKey
+		details["new-cert-slot"] = s.NewCert
+	}
+	if len(s.PrevKey) > 0 {
+		details["prev-key"] = s.PrevKey
+		details["prev-cert"] = s.PrevCert
+	}
+	return details
+}
+
+func (s *CaRotationState) journalDetails() map[string]string {
+	details := make(map[string]string)
+	if len(s.NewCaPath) > 0 {
+		details["new-ca-path"] = s.NewCaPath
+	}
+	if len(s.PrevCaPath) > 0 {
+		details["prev-ca-path"] = s.PrevCaPath
+	}
+	return details
+}
+
+// WorkflowRun summarizes one execution of a workflow from the journal.
+type WorkflowRun struct {
+	Workflow      string
+	CorrelationId string
+	Started       time.Time
+	Updated       time.Time
+	LastEvent     string
+	Error         string
+	InProgress    bool
+	Entries       []workflow.JournalEntry
+}
+
+// WorkflowRuns returns the workflows run on this device, oldest first, along
+// with any that are currently in progress. A workflow is in progress while
+// its state file exists.
+func (a *App) WorkflowRuns() ([]*WorkflowRun, error) {
+	entries, err := a.Journal().Read()
+	if err != nil {
+		return nil, err
+	}
+	var runs []*WorkflowRun
+	byId := make(map[string]*WorkflowRun)
+	for _, entry := range entries {
+		key := entry.Workflow + "/" + entry.CorrelationId
+		run := byId[key]
+		if run == nil {
+			run = &WorkflowRun{
+				Workflow:      entry.Workflow,
+				CorrelationId: entry.CorrelationId,
+				Started:       entry.Time,
+			}
+			byId[key] = run
+			runs = append(runs, run)
+		}
+		run.Updated = entry.Time
+		run.LastEvent = entry.Event
+		run.Error = entry.Error
+		run.Entries = append(run.Entries, entry)
+	}
+
+	for _, name := range []string{"cert-rotation", "ca-rotation"} {
+		var state BaseState
+		found, err := workflow.FileStore{Path: filepath.Join(a.StorageDir, name+".state")}.Load(&state)
+		if err != nil {
+			return nil, err
+		} else if !found {
+			continue
+		}
+		run := byId[name+"/"+state.CorrelationId]
+		if run == nil {
+			// Started by a version of fioconfig without a journal
+			run = &WorkflowRun{Workflow: name, CorrelationId: state.CorrelationId}
+			runs = append(runs, run)
+		}
+		run.InProgress = true
+	}
+	return runs, nil
+}
@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotationJournal(t *testing.T) {
+	testWrapper(t, nil, func(app *App, client *http.Client, tmpdir string) {
+		stateFile := filepath.Join(tmpdir, "cert-rotation.state")
+		handler := NewCertRotationHandler(app, stateFile, "est-server-doesn't-matter")
+		handler.eventSync = NoOpEventSync{}
+		handler.cienv = true
+		handler.State.CorrelationId = "rotation-1"
+		handler.State.NewCert = client_pem
+		handler.steps = []certRotationStep{testStep{"step1", nil}}
+		require.Nil(t, handler.Rotate())
+
+		handler = NewCertRotationHandler(app, stateFile, "est-server-doesn't-matter")
+		handler.eventSync = NoOpEventSync{}
+		handler.State.CorrelationId = "rotation-2"
+		handler.State.NewKey = "07"
+		handler.State.NewCert = "09"
+		handler.steps = []certRotationStep{testStep{"step1", nil}, testStep{"step2", errors.New("step2 failed")}}
+		require.NotNil(t, handler.Rotate())
+
+		runs, err := app.WorkflowRuns()
+		require.Nil(t, err)
+		require.Len(t, runs, 2)
+
+		run := runs[0]
+		require.Equal(t, "cert-rotation", run.Workflow)
+		require.Equal(t, "rotation-1", run.CorrelationId)
+		require.Equal(t, "CertRotationCompleted", run.LastEvent)
+		require.Equal(t, "", run.Error)
+		require.False(t, run.InProgress)
+		require.Len(t, run.Entries, 3)
+		details := run.Entries[2].Details
+		require.NotEmpty(t, details["new-key-id"])
+		require.NotEmpty(t, details["new-cert-serial"])
+		for _, val := range details {
+			require.NotContains(t, val, "PRIVATE KEY")
+		}
+
+		run = runs[1]
+		require.Equal(t, "rotation-2", run.CorrelationId)
+		require.Equal(t, "step2 failed", run.Error)
+		require.True(t, run.InProgress)
+		require.Equal(t, []string{"CertRotationStarted", "step1", "step2", "CertRotationCompleted"}, []string{
+			run.Entries[0].Event, run.Entries[1].Event, run.Entries[2].Event, run.Entries[3].Event,
+		})
+		require.Equal(t, "07", run.Entries[3].Details["new-key-slot"])
+
+		// Aborting is journaled as part of the same rotation
+		handler = RestoreCertRotationHandler(app, stateFile)
+		handler.eventSync = NoOpEventSync{}
+		require.Nil(t, handler.Abort())
+		runs, err = app.WorkflowRuns()
+		require.Nil(t, err)
+		require.Len(t, runs, 2)
+		require.Equal(t, "CertRotationAborted", runs[1].LastEvent)
+		require.False(t, runs[1].InProgress)
+	})
+}
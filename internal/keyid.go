@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// Encrypted values may be tagged with the key they were encrypted to:
+//
+//	kid:<key id>:<base64 payload>
+//
+// The colon is not part of the base64 alphabet, so untagged legacy values can
+// never be mistaken for tagged ones.
+const keyIdPrefix = "kid:"
+
+var ErrKeyIdMismatch = errors.New("Value is encrypted to a different key")
+
+// KeyId returns a short identifier for a public key: the hex encoded first 4
+// bytes of the SHA-256 fingerprint of its PKIX encoding.
+func KeyId(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", fmt.Errorf("Unable to compute key id: %w", err)
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:4]), nil
+}
+
+// TagKeyId prefixes an encrypted value with the id of the key it was
+// encrypted to.
+func TagKeyId(id, value string) string {
+	return keyIdPrefix + id + ":" + value
+}
+
+// splitKeyId returns the key id and payload of a value. The id is empty for
+// untagged values.
+func splitKeyId(value string) (string, string) {
+	rest, found := strings.CutPrefix(value, keyIdPrefix)
+	if !found {
+		return "", value
+	}
+	id, payload, found := strings.Cut(rest, ":")
+	if !found {
+		return "", value
+	}
+	return id, payload
+}
+
+// untagValue strips the key id from a value after making sure it was
+// encrypted to the given public key.
+func untagValue(pub crypto.PublicKey, value string) (string, error) {
+	id, payload := splitKeyId(value)
+	if len(id) == 0 {
+		return value, nil
+	}
+	own, err := KeyId(pub)
+	if err != nil {
+		return "", err
+	}
+	if id != own {
+		return "", fmt.Errorf("%w: %s", ErrKeyIdMismatch, id)
+	}
+	return payload, nil
+}
+
+// encryptTagged encrypts a value and tags it with the handler's key id.
+func encryptTagged(crypto DeviceCryptoHandler, value string) (string, error) {
+	id, err := KeyId(crypto.Public())
+	if err != nil {
+		return "", err
+	}
+	enc, err := crypto.Encrypt(value)
+	if err != nil {
+		return "", err
+	}
+	return TagKeyId(id, enc), nil
+}
+
+// encryptValue encrypts a value, tagging it with the key id if tag is set.
+func encryptValue(crypto DeviceCryptoHandler, value string, tag bool) (string, error) {
+	if tag {
+		return encryptTagged(crypto, value)
+	}
+	return crypto.Encrypt(value)
+}
+
+// tagKeyIds returns true if values fioconfig encrypts should be tagged with
+// the key id. Versions of fioconfig without key id support can't decrypt
+// tagged values, so tagging must be turned on in sota.toml.
+func (a *App) tagKeyIds() bool {
+	val := a.sota.GetDefault("fioconfig.tag_key_ids", "false")
+	tag, err := strconv.ParseBool(val)
+	if err != nil {
+		slog.Warn("Invalid value for fioconfig.tag_key_ids, not tagging values", "value", val)
+	}
+	return tag
+}
+
+// MultiKeyCrypto decrypts values using one of several keys, such as the
+// current and next key during a cert rotation. Tagged values are decrypted
+// with the key they name. Untagged values are decrypted with the first key.
+// The caller owns the keys and is responsible for closing them.
+type MultiKeyCrypto struct {
+	keys []DeviceCryptoHandler
+	ids  []string
+}
+
+func NewMultiKeyCrypto(keys ...DeviceCryptoHandler) (*MultiKeyCrypto, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("At least one key is required")
+	}
+	m := &MultiKeyCrypto{keys: keys}
+	for _, key := range keys {
+		id, err := KeyId(key.Public())
+		if err != nil {
+			return nil, err
+		}
+		m.ids = append(m.ids, id)
+	}
+	return m, nil
+}
+
+func (m *MultiKeyCrypto) Decrypt(value string) ([]byte, error) {
+	id, _ := splitKeyId(value)
+	if len(id) == 0 {
+		return m.keys[0].Decrypt(value)
+	}
+	for i, keyId := range m.ids {
+		if keyId == id {
+			return m.keys[i].Decrypt(value)
+		}
+	}
+	return nil, fmt.Errorf("%w: no key available for id %s", ErrKeyIdMismatch, id)
+}
+
+func (m *MultiKeyCrypto) Close() {}
+
+// Concurrency follows the first key, which decrypts most values.
+func (m *MultiKeyCrypto) Concurrency() int {
+	if c, ok := m.keys[0].(concurrentCryptoHandler); ok {
+		return c.Concurrency()
+	}
+	return 1
+}
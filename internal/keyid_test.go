@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyIds(t *testing.T) {
+	newKey := func() DeviceCryptoHandler {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.Nil(t, err)
+		return NewLocalCryptoHandler(key)
+	}
+	current, next, other := newKey(), newKey(), newKey()
+
+	legacy, err := current.Encrypt("legacy value")
+	require.Nil(t, err)
+	tagged, err := encryptTagged(next, "tagged value")
+	require.Nil(t, err)
+	id, payload := splitKeyId(tagged)
+	require.Len(t, id, 8)
+	require.NotContains(t, payload, ":")
+
+	// A single handler accepts its own tagged values
+	dec, err := next.Decrypt(tagged)
+	require.Nil(t, err)
+	require.Equal(t, "tagged value", string(dec))
+	_, err = current.Decrypt(tagged)
+	require.True(t, errors.Is(err, ErrKeyIdMismatch))
+
+	keys, err := NewMultiKeyCrypto(current, next)
+	require.Nil(t, err)
+	dec, err = keys.Decrypt(legacy)
+	require.Nil(t, err)
+	require.Equal(t, "legacy value", string(dec))
+	dec, err = keys.Decrypt(tagged)
+	require.Nil(t, err)
+	require.Equal(t, "tagged value", string(dec))
+
+	unknown, err := encryptTagged(other, "unknown value")
+	require.Nil(t, err)
+	_, err = keys.Decrypt(unknown)
+	require.True(t, errors.Is(err, ErrKeyIdMismatch))
+
+	// Tags work for whole configs too
+	config := ConfigStruct{
+		"a": &ConfigFile{Value: legacy},
+		"b": &ConfigFile{Value: tagged},
+		"c": &ConfigFile{Value: "plain", Unencrypted: true},
+	}
+	require.False(t, encryptedWith(config, id))
+	require.Nil(t, decryptConfig(keys, config))
+	require.Equal(t, "legacy value", config["a"].Value)
+	require.Equal(t, "tagged value", config["b"].Value)
+}
+
+func TestRotatedConfigTagging(t *testing.T) {
+	testWrapper(t, nil, func(app *App, client *http.Client, tmpdir string) {
+		signer, newKey, err := generateLocalKey(KeyTypeP256, 0)
+		require.Nil(t, err)
+		next := NewLocalCryptoHandler(signer)
+		handler := NewCertRotationHandler(app, filepath.Join(tmpdir, "rotate.state"), "est-server-doesn't-matter")
+		handler.State.NewKey = newKey
+
+		// By default values are untagged, so older versions of fioconfig
+		// and a device reverted to them can still read the config
+		require.Nil(t, fullCfgStep{}.Execute(&handler.stateContext))
+		var config ConfigStruct
+		require.Nil(t, json.Unmarshal([]byte(handler.State.FullConfigEncrypted), &config))
+		for name, cfgFile := range config {
+			if cfgFile.Unencrypted {
+				continue
+			}
+			require.False(t, strings.HasPrefix(cfgFile.Value, keyIdPrefix), name)
+			legacy, err := base64.StdEncoding.DecodeString(cfgFile.Value)
+			require.Nil(t, err, name)
+			require.NotEmpty(t, legacy)
+			_, err = next.Decrypt(cfgFile.Value)
+			require.Nil(t, err, name)
+		}
+
+		withFioconfigSection(t, app, tmpdir, "tag_key_ids = \"true\"\n")
+		id, err := KeyId(next.Public())
+		require.Nil(t, err)
+		require.Nil(t, fullCfgStep{}.Execute(&handler.stateContext))
+		require.Nil(t, json.Unmarshal([]byte(handler.State.FullConfigEncrypted), &config))
+		require.True(t, encryptedWith(config, id))
+	})
+}
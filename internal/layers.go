@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+// ConfigLayer is one named set of config files. A layered config looks like:
+//
+//	{"layers": [
+//	  {"name": "factory", "files": {"foo": {"Value": ...}}},
+//	  {"name": "device", "files": {"foo": {"Value": ...}}}
+//	]}
+//
+// Layers are merged in order, so a file in a later layer takes precedence
+// over the same file in an earlier one.
+type ConfigLayer struct {
+	Name  string       `json:"name"`
+	Files ConfigStruct `json:"files"`
+}
+
+type layeredConfig struct {
+	Layers []ConfigLayer `json:"layers"`
+}
+
+// isLayered detects the layered format. A legacy config could have a file
+// named "layers", but its value would be an object rather than an array.
+func isLayered(top map[string]json.RawMessage) bool {
+	raw, ok := top["layers"]
+	return ok && bytes.HasPrefix(bytes.TrimSpace(raw), []byte("["))
+}
+
+// mergeLayers flattens layers into a single config, recording which layer
+// each file came from and which layers it overrode.
+func mergeLayers(layers []ConfigLayer) (ConfigStruct, error) {
+	config := make(ConfigStruct)
+	seen := make(map[string]bool, len(layers))
+	for _, layer := range layers {
+		if len(layer.Name) == 0 {
+			return nil, fmt.Errorf("Config layer is missing a name")
+		}
+		if seen[layer.Name] {
+			return nil, fmt.Errorf("Duplicate config layer: %s", layer.Name)
+		}
+		seen[layer.Name] = true
+		for fname, cfgFile := range layer.Files {
+			if cfgFile == nil {
+				continue
+			}
+			cfgFile.Layer = layer.Name
+			cfgFile.Overrides = nil
+			if prev, ok := config[fname]; ok {
+				cfgFile.Overrides = append(slices.Clone(prev.Overrides), prev.Layer)
+			}
+			config[fname] = cfgFile
+		}
+	}
+	return config, nil
+}
@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLayeredConfig(t *testing.T) {
+	testWrapper(t, nil, func(app *App, client *http.Client, tempdir string) {
+		buf, err := os.ReadFile(app.EncryptedConfig)
+		require.Nil(t, err)
+		var device ConfigStruct
+		require.Nil(t, json.Unmarshal(buf, &device))
+
+		layered := layeredConfig{
+			Layers: []ConfigLayer{
+				{
+					Name: "factory",
+					Files: ConfigStruct{
+						"foo":     &ConfigFile{Value: "factory foo", Unencrypted: true},
+						"factory": &ConfigFile{Value: "factory only", Unencrypted: true},
+					},
+				},
+				{
+					Name: "group",
+					Files: ConfigStruct{
+						"foo": &ConfigFile{Value: "group foo", Unencrypted: true},
+					},
+				},
+				{
+					Name:  "device",
+					Files: device,
+				},
+			},
+		}
+		buf, err = json.Marshal(layered)
+		require.Nil(t, err)
+		require.Nil(t, os.WriteFile(app.EncryptedConfig, buf, 0o644))
+
+		_, err = app.Extract()
+		require.Nil(t, err)
+		assertFile(t, filepath.Join(tempdir, "foo"), []byte("foo file value"))
+		assertFile(t, filepath.Join(tempdir, "factory"), []byte("factory only"))
+
+		config, err := app.Inspect()
+		require.Nil(t, err)
+		require.Equal(t, "device", config["foo"].Layer)
+		require.Equal(t, []string{"factory", "group"}, config["foo"].Overrides)
+		require.Equal(t, "factory", config["factory"].Layer)
+		require.Nil(t, config["factory"].Overrides)
+		require.Equal(t, "device", config["bar"].Layer)
+	})
+}
+
+func TestLayeredConfigLegacy(t *testing.T) {
+	// A legacy config with a file named "layers" must still work
+	buf := []byte(`{"layers": {"Value": "a file", "Unencrypted": true}}`)
+	config, err := UnmarshallBuffer(nil, buf, true)
+	require.Nil(t, err)
+	require.Equal(t, "a file", config["layers"].Value)
+	require.Empty(t, config["layers"].Layer)
+
+	buf = []byte(`{"layers": [{"name": "a", "files": {}}, {"name": "a", "files": {}}]}`)
+	_, err = UnmarshallBuffer(nil, buf, true)
+	require.NotNil(t, err)
+
+	buf = []byte(`{"layers": [{"files": {}}]}`)
+	_, err = UnmarshallBuffer(nil, buf, true)
+	require.NotNil(t, err)
+}
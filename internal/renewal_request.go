@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// CertRenewalConfigFile is the config entry operators can use to have a
+// device renew its certificate. It holds a certRenewalRequest as JSON:
+//
+//	{"est-server": "https://est.example.com/.well-known/est", "rotation-id": "renew-2024-06"}
+//
+// The rotation ID identifies the request, so each one is only executed once.
+const CertRenewalConfigFile = "fio-cert-renewal"
+
+type certRenewalRequest struct {
+	EstServer     string `json:"est-server"`
+	RotationId    string `json:"rotation-id"`
+	KeyType       string `json:"key-type,omitempty"`
+	UpdateCaCerts bool   `json:"update-ca-certs,omitempty"`
+	ServerKeyGen  bool   `json:"server-keygen,omitempty"`
+}
+
+func (a *App) certRenewalRequest() (*certRenewalRequest, error) {
+	buf, err := os.ReadFile(filepath.Join(a.SecretsDir, CertRenewalConfigFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Unable to read certificate renewal request: %w", err)
+	}
+	var req certRenewalRequest
+	if err := json.Unmarshal(buf, &req); err != nil {
+		return nil, fmt.Errorf("Invalid certificate renewal request: %w", err)
+	}
+	if len(req.EstServer) == 0 || len(req.RotationId) == 0 {
+		return nil, errors.New("Certificate renewal request must include est-server and rotation-id")
+	}
+	if len(req.KeyType) > 0 && !slices.Contains(KeyTypes, req.KeyType) {
+		return nil, fmt.Errorf("Invalid key type in certificate renewal request: %s, must be one of: %s", req.KeyType, strings.Join(KeyTypes, ", "))
+	}
+	return &req, nil
+}
+
+// rotationExecuted checks the journal and the last completed rotation for a
+// rotation with the given ID.
+func (a *App) rotationExecuted(stateFile, rotationId string) (bool, error) {
+	entries, err := a.Journal().Read()
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		if entry.CorrelationId == rotationId {
+			return true, nil
+		}
+	}
+	// The journal may not have been around when the rotation ran
+	state, err := loadCompletedState(stateFile + ".completed")
+	if err != nil {
+		return false, err
+	}
+	return state != nil && state.CorrelationId == rotationId, nil
+}
+
+// certRequestHandler returns a handler for the renewal requested with the
+// `fio-cert-renewal` config entry. It returns nil if there is no request, or
+// it has already been executed.
+func (a *App) certRequestHandler() (*CertRotationHandler, error) {
+	req, err := a.certRenewalRequest()
+	if err != nil || req == nil {
+		return nil, err
+	}
+	stateFile := filepath.Join(a.StorageDir, "cert-rotation.state")
+	if _, err := os.Stat(stateFile); err == nil {
+		// An incomplete rotation is resumed when fioconfig starts. The
+		// request is picked up once it is out of the way.
+		slog.Info("Deferring requested certificate renewal until the current rotation completes", "id", req.RotationId)
+		return nil, nil
+	}
+	if executed, err := a.rotationExecuted(stateFile, req.RotationId); err != nil || executed {
+		return nil, err
+	}
+
+	slog.Info("Certificate renewal requested by config", "id", req.RotationId, "est-server", req.EstServer)
+	handler := NewCertRotationHandler(a, stateFile, req.EstServer)
+	handler.State.CorrelationId = req.RotationId
+	handler.State.PkeySlotIds = strings.Split(DefaultPkcs11KeyIds, ",")
+	handler.State.CertSlotIds = strings.Split(DefaultPkcs11CertIds, ",")
+	handler.State.KeyType = req.KeyType
+	handler.State.UpdateCaCerts = req.UpdateCaCerts
+	handler.State.ServerKeyGen = req.ServerKeyGen
+	return handler, nil
+}
+
+// checkRenewalRequest is run by Extract. A renewal needs the network, which
+// isn't up yet when `fioconfig extract` runs at boot, so the request is only
+// validated and logged here. It is started from the extracted config entry by
+// the next online run, e.g. the daemon's first check-in.
+func (a *App) checkRenewalRequest() {
+	req, err := a.certRenewalRequest()
+	if err != nil {
+		slog.Error("Ignoring certificate renewal request", "error", err)
+		return
+	} else if req == nil {
+		return
+	}
+	stateFile := filepath.Join(a.StorageDir, "cert-rotation.state")
+	if executed, err := a.rotationExecuted(stateFile, req.RotationId); err != nil {
+		slog.Error("Unable to check if certificate renewal request was executed", "id", req.RotationId, "error", err)
+	} else if !executed {
+		slog.Info("Certificate renewal requested by config, it will start once online", "id", req.RotationId)
+	}
+}
+
+// RenewCertIfRequested starts a certificate rotation when one has been
+// requested with the `fio-cert-renewal` config entry and not yet executed.
+// A request that fails, even before it is journaled, is backed off from the
+// same way as automatic renewals.
+func (a *App) RenewCertIfRequested() error {
+	return a.renewCertIfRequested(time.Now())
+}
+
+func (a *App) renewCertIfRequested(now time.Time) error {
+	handler, err := a.certRequestHandler()
+	if err != nil || handler == nil {
+		return err
+	}
+	return a.rotateWithBackoff(handler, now)
+}
@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertRenewalRequest(t *testing.T) {
+	testWrapper(t, nil, func(app *App, client *http.Client, tmpdir string) {
+		app.SecretsDir = filepath.Join(tmpdir, "secrets")
+		require.Nil(t, os.Mkdir(app.SecretsDir, 0o750))
+		reqPath := filepath.Join(app.SecretsDir, CertRenewalConfigFile)
+
+		handler, err := app.certRequestHandler()
+		require.Nil(t, err)
+		require.Nil(t, handler)
+
+		require.Nil(t, os.WriteFile(reqPath, []byte(`{"est-server": "https://est.local"}`), 0o644))
+		_, err = app.certRequestHandler()
+		require.ErrorContains(t, err, "must include est-server and rotation-id")
+
+		require.Nil(t, os.WriteFile(reqPath, []byte(`{"est-server": "https://est.local", "rotation-id": "renew-1", "key-type": "p384", "update-ca-certs": true}`), 0o644))
+		handler, err = app.certRequestHandler()
+		require.Nil(t, err)
+		require.NotNil(t, handler)
+		require.Equal(t, "renew-1", handler.State.CorrelationId)
+		require.Equal(t, "https://est.local", handler.State.EstServer)
+		require.Equal(t, KeyTypeP384, handler.State.KeyType)
+		require.True(t, handler.State.UpdateCaCerts)
+		require.Equal(t, []string{"01", "07"}, handler.State.PkeySlotIds)
+
+		// While the rotation is incomplete, the request is deferred
+		require.Nil(t, handler.Save())
+		deferred, err := app.certRequestHandler()
+		require.Nil(t, err)
+		require.Nil(t, deferred)
+
+		handler.eventSync = NoOpEventSync{}
+		handler.cienv = true
+		handler.steps = []certRotationStep{testStep{"step1", nil}}
+		require.Nil(t, handler.Rotate())
+
+		// The same request isn't executed again, like after a reboot
+		handler, err = app.certRequestHandler()
+		require.Nil(t, err)
+		require.Nil(t, handler)
+
+		// Even if the journal is lost
+		require.Nil(t, os.Remove(app.Journal().Path))
+		handler, err = app.certRequestHandler()
+		require.Nil(t, err)
+		require.Nil(t, handler)
+
+		require.Nil(t, os.WriteFile(reqPath, []byte(`{"est-server": "https://est.local", "rotation-id": "renew-2"}`), 0o644))
+		handler, err = app.certRequestHandler()
+		require.Nil(t, err)
+		require.Equal(t, "renew-2", handler.State.CorrelationId)
+	})
+}
+
+func TestCertRenewalRequestBackoff(t *testing.T) {
+	requests := 0
+	doGet := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(403)
+	})
+	testWrapper(t, doGet, func(app *App, client *http.Client, tmpdir string) {
+		app.SecretsDir = filepath.Join(tmpdir, "secrets")
+		require.Nil(t, os.Mkdir(app.SecretsDir, 0o750))
+		req := `{"est-server": "` + app.sota.Get("tls.server") + `/est", "rotation-id": "renew-1"}`
+		require.Nil(t, os.WriteFile(filepath.Join(app.SecretsDir, CertRenewalConfigFile), []byte(req), 0o644))
+		now := time.Now()
+
+		// A request failing pre-flight leaves nothing in the journal
+		require.ErrorContains(t, app.renewCertIfRequested(now), "Pre-flight checks failed")
+		executed, err := app.rotationExecuted(filepath.Join(tmpdir, "cert-rotation.state"), "renew-1")
+		require.Nil(t, err)
+		require.False(t, executed)
+		require.Equal(t, 1, app.loadRenewFailures().Count)
+
+		// It isn't retried on every daemon interval
+		requests = 0
+		require.Nil(t, app.renewCertIfRequested(now.Add(time.Minute)))
+		require.Zero(t, requests)
+
+		require.NotNil(t, app.renewCertIfRequested(now.Add(16*time.Minute)))
+		require.NotZero(t, requests)
+		require.Equal(t, 2, app.loadRenewFailures().Count)
+	})
+}
+
+func TestExtractChecksRenewalRequest(t *testing.T) {
+	testWrapper(t, nil, func(app *App, client *http.Client, tmpdir string) {
+		var logs bytes.Buffer
+		defer slog.SetDefault(slog.Default())
+		slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+		// Extract runs before the network is up, so the request is only
+		// reported until fioconfig is online
+		reqPath := filepath.Join(app.SecretsDir, CertRenewalConfigFile)
+		require.Nil(t, os.WriteFile(reqPath, []byte(`{"est-server": "https://est.local", "rotation-id": "renew-1"}`), 0o644))
+		_, err := app.Extract()
+		require.Nil(t, err)
+		require.Contains(t, logs.String(), "Certificate renewal requested by config")
+		require.Contains(t, logs.String(), "renew-1")
+		_, err = os.Stat(filepath.Join(tmpdir, "cert-rotation.state"))
+		require.True(t, os.IsNotExist(err))
+
+		logs.Reset()
+		require.Nil(t, os.WriteFile(reqPath, []byte(`{"rotation-id": "renew-1"}`), 0o644))
+		_, err = app.Extract()
+		require.Nil(t, err)
+		require.Contains(t, logs.String(), "Ignoring certificate renewal request")
+	})
+}
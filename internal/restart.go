@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/coreos/go-systemd/v22/dbus"
+)
+
+// The ways a service can be restarted after a workflow completes. The hook
+// strategy runs `fioconfig.restart_hook` with the services as arguments.
+const (
+	RestartStrategyRestart         = "restart"
+	RestartStrategyReload          = "reload"
+	RestartStrategyTryRestart      = "try-restart"
+	RestartStrategyReloadOrRestart = "reload-or-restart"
+	RestartStrategyHook            = "hook"
+)
+
+// By default aktualizr-lite is only restarted if it is running
+const defaultRestartServices = "try-restart:aktualizr-lite.service,fioconfig.service"
+
+// fioconfigUnit is always restarted last, since restarting it stops the
+// process doing the restarts.
+const fioconfigUnit = "fioconfig.service"
+
+type unitJob func(c *dbus.Conn, ctx context.Context, name string, mode string, ch chan<- string) (int, error)
+
+var restartJobs = map[string]unitJob{
+	RestartStrategyRestart:         (*dbus.Conn).RestartUnitContext,
+	RestartStrategyReload:          (*dbus.Conn).ReloadUnitContext,
+	RestartStrategyTryRestart:      (*dbus.Conn).TryRestartUnitContext,
+	RestartStrategyReloadOrRestart: (*dbus.Conn).ReloadOrRestartUnitContext,
+}
+
+type serviceRestart struct {
+	Unit     string
+	Strategy string
+}
+
+func validRestartStrategy(strategy string) bool {
+	_, ok := restartJobs[strategy]
+	return ok || strategy == RestartStrategyHook
+}
+
+// restartPolicy reads the services to restart from sota.toml:
+//
+//	[fioconfig]
+//	restart_strategy = "restart"
+//	restart_services = "try-restart:aktualizr-lite.service,fioconfig.service"
+//
+// A service can override the strategy with a `<strategy>:` prefix. Services
+// are returned in order, except that fioconfigUnit is moved to the end.
+func (a *App) restartPolicy() ([]serviceRestart, error) {
+	strategy := a.sota.GetDefault("fioconfig.restart_strategy", RestartStrategyRestart)
+	if !validRestartStrategy(strategy) {
+		return nil, fmt.Errorf("Invalid value for fioconfig.restart_strategy: %s", strategy)
+	}
+	var restarts []serviceRestart
+	for _, item := range strings.Split(a.sota.GetDefault("fioconfig.restart_services", defaultRestartServices), ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		restart := serviceRestart{Unit: item, Strategy: strategy}
+		if prefix, unit, ok := strings.Cut(item, ":"); ok {
+			if !validRestartStrategy(prefix) {
+				return nil, fmt.Errorf("Invalid restart strategy for %s in fioconfig.restart_services: %s", unit, prefix)
+			}
+			restart = serviceRestart{Unit: unit, Strategy: prefix}
+		}
+		restarts = append(restarts, restart)
+	}
+	slices.SortStableFunc(restarts, func(a, b serviceRestart) int {
+		if a.Unit == fioconfigUnit && b.Unit != fioconfigUnit {
+			return 1
+		} else if b.Unit == fioconfigUnit && a.Unit != fioconfigUnit {
+			return -1
+		}
+		return 0
+	})
+	return restarts, nil
+}
+
+// restartServices restarts the configured services. The restart hook runs
+// first, then every other service is attempted even if an earlier one fails.
+// Failures are passed to report before fioconfigUnit is restarted, since
+// that may stop this process. All the errors are returned.
+func (a *App) restartServices(ctx context.Context, report func(error)) error {
+	restarts, err := a.restartPolicy()
+	if err != nil {
+		report(err)
+		return err
+	}
+
+	var errs []error
+	var hookArgs []string
+	var units []serviceRestart
+	for _, restart := range restarts {
+		if restart.Strategy == RestartStrategyHook {
+			hookArgs = append(hookArgs, restart.Unit)
+		} else {
+			units = append(units, restart)
+		}
+	}
+
+	if len(hookArgs) > 0 || a.sota.Get("fioconfig.restart_strategy") == RestartStrategyHook {
+		hook := a.sota.Get("fioconfig.restart_hook")
+		if len(hook) == 0 {
+			errs = append(errs, errors.New("fioconfig.restart_hook must be set to use the hook restart strategy"))
+		} else {
+			slog.Info("Running restart hook", "hook", hook, "services", hookArgs)
+			if err := ExecIndented(exec.Command(hook, hookArgs...), "| "); err != nil {
+				errs = append(errs, fmt.Errorf("Restart hook failed: %w", err))
+			}
+		}
+	}
+
+	var con *dbus.Conn
+	reported := -1 // How many of errs were reported before restarting fioconfig
+	for _, restart := range units {
+		if restart.Unit == fioconfigUnit && len(errs) > 0 {
+			report(errors.Join(errs...))
+			reported = len(errs)
+		}
+		if con == nil {
+			if con, err = dbus.NewSystemConnectionContext(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("Unable to connect to DBUS for service restarts: %w", err))
+				break
+			}
+			defer con.Close()
+		}
+		slog.Info("Restarting service", "service", restart.Unit, "strategy", restart.Strategy)
+		result := make(chan string, 1)
+		if _, err := restartJobs[restart.Strategy](con, ctx, restart.Unit, "replace", result); err != nil {
+			errs = append(errs, fmt.Errorf("Unable to %s %s: %w", restart.Strategy, restart.Unit, err))
+		} else if res := <-result; res != "done" {
+			errs = append(errs, fmt.Errorf("Unable to %s %s: %s", restart.Strategy, restart.Unit, res))
+		}
+	}
+	if reported < 0 && len(errs) > 0 {
+		report(errors.Join(errs...))
+	} else if reported >= 0 && len(errs) > reported {
+		report(errors.Join(errs[reported:]...))
+	}
+	return errors.Join(errs...)
+}
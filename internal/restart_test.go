@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+	"github.com/stretchr/testify/require"
+)
+
+// withFioconfigSection adds a [fioconfig] section to the app's sota.toml
+func withFioconfigSection(t *testing.T, app *App, tmpdir, section string) {
+	sotaPath := filepath.Join(tmpdir, "sota.toml")
+	f, err := os.OpenFile(sotaPath, os.O_APPEND|os.O_WRONLY, 0)
+	require.Nil(t, err)
+	_, err = f.WriteString("\n[fioconfig]\n" + section)
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+	app.sota, err = sotatoml.NewAppConfig([]string{sotaPath})
+	require.Nil(t, err)
+}
+
+func TestRestartPolicy(t *testing.T) {
+	testWrapper(t, nil, func(app *App, client *http.Client, tmpdir string) {
+		restarts, err := app.restartPolicy()
+		require.Nil(t, err)
+		require.Equal(t, []serviceRestart{
+			{"aktualizr-lite.service", RestartStrategyTryRestart},
+			{"fioconfig.service", RestartStrategyRestart},
+		}, restarts)
+
+		withFioconfigSection(t, app, tmpdir, `restart_strategy = "reload"
+restart_services = "my-ota.service, hook:cert-consumer.service"
+`)
+		restarts, err = app.restartPolicy()
+		require.Nil(t, err)
+		require.Equal(t, []serviceRestart{
+			{"my-ota.service", RestartStrategyReload},
+			{"cert-consumer.service", RestartStrategyHook},
+		}, restarts)
+
+		// fioconfig is restarted last, since that can stop this process
+		require.Nil(t, app.sota.UpdateKeys(map[string]string{
+			"fioconfig.restart_services": "fioconfig.service,my-ota.service,hook:cert-consumer.service",
+		}))
+		restarts, err = app.restartPolicy()
+		require.Nil(t, err)
+		require.Equal(t, []serviceRestart{
+			{"my-ota.service", RestartStrategyReload},
+			{"cert-consumer.service", RestartStrategyHook},
+			{"fioconfig.service", RestartStrategyReload},
+		}, restarts)
+
+		require.Nil(t, app.sota.UpdateKeys(map[string]string{"fioconfig.restart_strategy": "bounce"}))
+		_, err = app.restartPolicy()
+		require.ErrorContains(t, err, "Invalid value for fioconfig.restart_strategy")
+
+		require.Nil(t, app.sota.UpdateKeys(map[string]string{
+			"fioconfig.restart_strategy": "restart",
+			"fioconfig.restart_services": "bounce:my-ota.service",
+		}))
+		_, err = app.restartPolicy()
+		require.ErrorContains(t, err, "Invalid restart strategy for my-ota.service")
+	})
+}
+
+func TestRestartServicesHook(t *testing.T) {
+	testWrapper(t, nil, func(app *App, client *http.Client, tmpdir string) {
+		hook := filepath.Join(tmpdir, "restart-hook")
+		args := filepath.Join(tmpdir, "hook-args")
+		require.Nil(t, os.WriteFile(hook, []byte("#!/bin/sh\necho \"$@\" > "+args+"\n"), 0o755))
+		withFioconfigSection(t, app, tmpdir, `restart_strategy = "hook"
+restart_services = "my-ota.service,cert-consumer.service"
+restart_hook = "`+hook+`"
+`)
+		require.Nil(t, app.restartServices(context.Background(), func(err error) { require.Nil(t, err) }))
+		buf, err := os.ReadFile(args)
+		require.Nil(t, err)
+		require.Equal(t, "my-ota.service cert-consumer.service\n", string(buf))
+
+		// Failures are reported as events rather than exiting
+		require.Nil(t, os.WriteFile(hook, []byte("#!/bin/sh\nexit 1\n"), 0o755))
+		stateFile := filepath.Join(tmpdir, "cert-rotation.state")
+		handler := NewCertRotationHandler(app, stateFile, "est-server-doesn't-matter")
+		events := &testEventSync{}
+		handler.eventSync = events
+		handler.RestartServices()
+		require.Len(t, events.events, 1)
+		require.Equal(t, "ServiceRestartFailed", events.events[0].name)
+		require.ErrorContains(t, events.events[0].err, "Restart hook failed")
+
+		require.Nil(t, app.sota.UpdateKeys(map[string]string{"fioconfig.restart_hook": ""}))
+		var reported error
+		err = app.restartServices(context.Background(), func(err error) { reported = err })
+		require.ErrorContains(t, err, "fioconfig.restart_hook must be set")
+		require.Equal(t, err, reported)
+
+		// The hook runs and its failure is reported before fioconfig is
+		// restarted, which would stop this process. DBUS isn't available
+		// here, so that restart fails and is reported too.
+		require.Nil(t, app.sota.UpdateKeys(map[string]string{
+			"fioconfig.restart_hook":     hook,
+			"fioconfig.restart_strategy": "restart",
+			"fioconfig.restart_services": "fioconfig.service,hook:cert-consumer.service",
+		}))
+		var reports []error
+		err = app.restartServices(context.Background(), func(err error) { reports = append(reports, err) })
+		require.NotNil(t, err)
+		require.Len(t, reports, 2)
+		require.ErrorContains(t, reports[0], "Restart hook failed")
+		require.NotContains(t, reports[0].Error(), "fioconfig.service")
+		require.NotContains(t, reports[1].Error(), "Restart hook failed")
+	})
+}
@@ -1,18 +1,33 @@
 package internal
 
 import (
+	"fmt"
 	"log/slog"
 )
 
+// The two PKCS#11 slot ids rotations toggle between by default
+const (
+	DefaultPkcs11KeyIds  = "01,07"
+	DefaultPkcs11CertIds = "03,09"
+)
+
 type CertRotationState struct {
 	BaseState
-	EstServer   string
-	PkeySlotIds []string // Available IDs we can use when generating a new key
-	CertSlotIds []string // Available IDs we can use when saving the new cert
+	EstServer     string   // URL of the EST server, or other PKI as selected by Protocol
+	Protocol      string   // Enrollment protocol, see enrollProtocol. Empty means EST
+	PkeySlotIds   []string // Available IDs we can use when generating a new key
+	CertSlotIds   []string // Available IDs we can use when saving the new cert
+	KeyType       string   // Type of key to generate. Empty means same as current
+	UpdateCaCerts bool     // Add the EST server's CA certs to the CA bundle
+	ServerKeyGen  bool     // Have the EST server generate the new key
 
 	// Used by estStep
-	NewKey  string // Path to key or HSM slot id
-	NewCert string // Path to cert or HSM slot id
+	NewKey     string // Path to key or HSM slot id
+	NewCert    string // Path to cert or HSM slot id
+	EstStarted bool   // The HSM slots for NewKey and NewCert may have been written
+
+	// Used by caCertsStep
+	NewCaCerts string // Current PEM bundle plus the new certs, empty if unchanged
 
 	// Used by fullCfgStep
 	FullConfigEncrypted string
@@ -20,8 +35,22 @@ type CertRotationState struct {
 	// Used by deviceCfgStep
 	DeviceConfigUpdated bool
 
+	// Set by fullCfgStep. What was in use before the rotation
+	PrevKey    string // Path to key or HSM slot id
+	PrevCert   string // Path to cert or HSM slot id
+	PrevCaPath string
+
 	// Used by finalizeStep
 	Finalized bool
+
+	// Used by HealthCheck after the rotation completed
+	HealthChecked        bool
+	Reverted             bool
+	DeviceConfigReverted bool // The server expects the previous key again
+}
+
+func (s *CertRotationState) GetCorrelationId() string {
+	return defaultCorrelationId(&s.BaseState, "certs")
 }
 
 type certRotationContext = stateContext[*CertRotationState]
@@ -39,9 +68,14 @@ func NewCertRotationHandler(app *App, stateFile, estServer string) *CertRotation
 	return &CertRotationHandler{
 		stateHandler[*CertRotationState]{
 			stateContext: newStateContext(app, stateFile, state),
+			// The new credentials are verified before the server's config
+			// is encrypted to the new key, so a rejected certificate leaves
+			// a rotation that can still be aborted.
 			steps: []certRotationStep{
 				estStep{},
+				caCertsStep{},
 				lockStep{},
+				verifyStep{},
 				fullCfgStep{},
 				deviceCfgStep{},
 				finalizeStep{},
@@ -62,6 +96,13 @@ func RestoreCertRotationHandler(app *App, stateFile string) *CertRotationHandler
 }
 
 func (h *CertRotationHandler) Rotate() error {
+	// Nothing changes on the server until lockStep, so this is the last
+	// chance to give up cleanly when the rotation can't complete.
+	if h.lockStepPending() {
+		if err := preflightError(h.Preflight()); err != nil {
+			return fmt.Errorf("Pre-flight checks failed, not starting certificate rotation:\n%w", err)
+		}
+	}
 	return h.execute("CertRotationStarted", "CertRotationCompleted", true)
 }
 
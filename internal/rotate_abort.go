@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+	"github.com/foundriesio/fioconfig/transport"
+)
+
+var ErrRotationNotAbortable = errors.New("The device configuration has already been updated with the new key. The rotation must be completed")
+
+// Abort unwinds an incomplete rotation. Key material generated in the unused
+// PKCS#11 slots is removed, the server is told to forget the next public key,
+// and the state file is archived, without the new key and certificate, with
+// an `.aborted` suffix so the rotation is no longer resumed. A rotation can't
+// be aborted once the device's config on the server has been encrypted with
+// the new key.
+func (h *CertRotationHandler) Abort() error {
+	if h.State.DeviceConfigUpdated || h.State.Finalized {
+		return ErrRotationNotAbortable
+	}
+	events := h.journaled(h.eventSync)
+	events.SetCorrelationId(h.State.GetCorrelationId())
+
+	err := h.abort()
+	events.Notify("CertRotationAborted", err)
+	return err
+}
+
+func (h *CertRotationHandler) abort() error {
+	if h.usePkcs11() {
+		if err := h.deleteUnusedPkcs11Objects(); err != nil {
+			return err
+		}
+	}
+
+	if h.lockStepDone() {
+		if err := clearNextPubKey(h.app, h.client); err != nil {
+			slog.Warn("Continuing with abort", "error", err)
+		}
+	}
+
+	// For file based keys the state holds the new private key itself. It
+	// must not be left behind in the archived state.
+	h.State.NewKey = ""
+	h.State.NewCert = ""
+	h.State.FullConfigEncrypted = ""
+	if err := secureRemove(h.stateFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Unable to remove state file: %w", err)
+	}
+	if err := h.Save(); err != nil {
+		return fmt.Errorf("Unable to save state file: %w", err)
+	}
+	if err := h.store().Archive(".aborted"); err != nil {
+		return fmt.Errorf("Unable to archive state file: %w", err)
+	}
+	return nil
+}
+
+// deleteUnusedPkcs11Objects removes the key and certificate the rotation
+// generated. The estStep may have generated a key before recording it in the
+// state, so once it has started the slots are found the same way estStep
+// picks them. Slots in use by the current key and certificate are never
+// touched.
+func (h *CertRotationHandler) deleteUnusedPkcs11Objects() error {
+	if !h.State.EstStarted && len(h.State.NewKey) == 0 {
+		slog.Info("No key material was generated")
+		return nil
+	}
+	step := estStep{}
+	keyId := h.State.NewKey
+	if len(keyId) == 0 {
+		keyId = step.nextPkeyId(&h.stateContext)
+	}
+	if keyId != h.app.sota.Get("p11.tls_pkey_id") {
+		slog.Info("Deleting generated key", "slot", keyId)
+		if err := h.crypto.DeleteKeyPair(sotatoml.IdToBytes(keyId), nil); err != nil {
+			return fmt.Errorf("Unable to delete key in slot %s: %w", keyId, err)
+		}
+	}
+
+	certId := h.State.NewCert
+	if len(certId) == 0 {
+		certId = step.nextCertId(&h.stateContext)
+	}
+	if certId != h.app.sota.Get("p11.tls_clientcert_id") {
+		slog.Info("Deleting generated certificate", "slot", certId)
+		if err := h.crypto.DeleteCertificate(sotatoml.IdToBytes(certId), nil, nil); err != nil {
+			return fmt.Errorf("Unable to delete certificate in slot %s: %w", certId, err)
+		}
+	}
+	return nil
+}
+
+// clearNextPubKey tells the server to forget the next public key set by
+// lockStep.
+func clearNextPubKey(app *App, client *http.Client) error {
+	url := app.sota.GetOrDie("tls.server") + "/device"
+	res, err := transport.HttpPatch(client, url, DeviceUpdate{})
+	if err != nil {
+		return fmt.Errorf("Unable to clear device's next public key: %w", err)
+	} else if res.StatusCode != 200 {
+		return fmt.Errorf("Unable to clear device's next public key: HTTP_%d - %s", res.StatusCode, res.String())
+	}
+	return nil
+}
+
+// lockStepDone returns true if the server may have the next public key set.
+// That includes a lockStep that was interrupted before its completion was
+// saved. Clearing the key when it was never set does no harm.
+func (h *CertRotationHandler) lockStepDone() bool {
+	idx := stepIndex[lockStep](h)
+	return idx >= 0 && h.State.GetCurrentStep() >= idx
+}
@@ -0,0 +1,186 @@
+package internal
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeHsm pretends the device's key lives in PKCS#11 and records the objects
+// deleted from it
+type fakeHsm struct {
+	DeviceCryptoHandler
+	deletedKeys   []string
+	deletedCerts  []string
+	importedKeys  map[string]crypto.PrivateKey
+	importedCerts map[string]*x509.Certificate
+}
+
+func (f *fakeHsm) UsePkcs11() bool {
+	return true
+}
+
+func (f *fakeHsm) DeleteKeyPair(id []byte, label []byte) error {
+	f.deletedKeys = append(f.deletedKeys, string(id))
+	return nil
+}
+
+func (f *fakeHsm) DeleteCertificate(id []byte, label []byte, serial *big.Int) error {
+	f.deletedCerts = append(f.deletedCerts, string(id))
+	return nil
+}
+
+func (f *fakeHsm) ImportKeyPair(id []byte, label []byte, key crypto.PrivateKey) error {
+	if f.importedKeys == nil {
+		f.importedKeys = make(map[string]crypto.PrivateKey)
+	}
+	f.importedKeys[string(id)] = key
+	return nil
+}
+
+func (f *fakeHsm) HasKeyPair(id []byte) (bool, error) {
+	return f.importedKeys[string(id)] != nil, nil
+}
+
+func (f *fakeHsm) HasCertificate(id []byte) (bool, error) {
+	return f.importedCerts[string(id)] != nil, nil
+}
+
+func (f *fakeHsm) ImportCertificateWithLabel(id []byte, label []byte, certificate *x509.Certificate) error {
+	if f.importedCerts == nil {
+		f.importedCerts = make(map[string]*x509.Certificate)
+	}
+	f.importedCerts[string(id)] = certificate
+	return nil
+}
+
+type testEvent struct {
+	name string
+	err  error
+}
+
+type testEventSync struct {
+	events []testEvent
+}
+
+func (s *testEventSync) Notify(name string, err error) {
+	s.events = append(s.events, testEvent{name, err})
+}
+
+func (s *testEventSync) SetCorrelationId(corId string) {}
+
+// withPkcs11Slots points the app's sota.toml at PKCS#11 slots 01 and 03
+func withPkcs11Slots(t *testing.T, app *App, tmpdir string) {
+	sotaPath := filepath.Join(tmpdir, "sota.toml")
+	f, err := os.OpenFile(sotaPath, os.O_APPEND|os.O_WRONLY, 0)
+	require.Nil(t, err)
+	_, err = f.WriteString("\n[p11]\ntls_pkey_id = \"01\"\ntls_clientcert_id = \"03\"\n")
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+	app.sota, err = sotatoml.NewAppConfig([]string{sotaPath})
+	require.Nil(t, err)
+}
+
+func TestRotateAbort(t *testing.T) {
+	var nextPubKey *DeviceUpdate
+	doGet := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPatch && r.URL.Path == "/device" {
+			body, err := io.ReadAll(r.Body)
+			require.Nil(t, err)
+			nextPubKey = &DeviceUpdate{"not-cleared"}
+			require.Nil(t, json.Unmarshal(body, nextPubKey))
+		}
+	})
+
+	testWrapper(t, doGet, func(app *App, client *http.Client, tmpdir string) {
+		withPkcs11Slots(t, app, tmpdir)
+		stateFile := filepath.Join(tmpdir, "rotate.state")
+		handler := NewCertRotationHandler(app, stateFile, "est-server-doesn't-matter")
+		events := &testEventSync{}
+		hsm := &fakeHsm{DeviceCryptoHandler: handler.crypto}
+		handler.crypto = hsm
+		handler.eventSync = events
+		handler.State.PkeySlotIds = []string{"01", "07"}
+		handler.State.CertSlotIds = []string{"03", "09"}
+
+		// A rotation that never got to the estStep has nothing to delete
+		require.Nil(t, handler.Save())
+		require.Nil(t, handler.Abort())
+		require.Nil(t, hsm.deletedKeys)
+		require.Nil(t, hsm.deletedCerts)
+		require.Nil(t, os.Rename(stateFile+".aborted", stateFile))
+		events.events = nil
+
+		// A rotation that failed in the estStep after generating a key
+		handler.State.EstStarted = true
+		require.Nil(t, handler.Save())
+		require.Nil(t, handler.Abort())
+		require.Equal(t, []string{"\x07"}, hsm.deletedKeys)
+		require.Equal(t, []string{"\x09"}, hsm.deletedCerts)
+		require.Nil(t, nextPubKey) // The lock step never ran
+		require.Equal(t, []testEvent{{"CertRotationAborted", nil}}, events.events)
+		_, err := os.Stat(stateFile)
+		require.True(t, os.IsNotExist(err))
+		_, err = os.Stat(stateFile + ".aborted")
+		require.Nil(t, err)
+		require.Nil(t, RestoreCertRotationHandler(app, stateFile))
+
+		// A rotation that crashed after lockStep's PATCH, before saving
+		hsm.deletedKeys, hsm.deletedCerts = nil, nil
+		handler.State.StepIdx = stepIndex[lockStep](handler)
+		handler.State.NewKey = "07"
+		handler.State.NewCert = "09"
+		require.Nil(t, handler.Save())
+		require.Nil(t, handler.Abort())
+		require.Equal(t, []string{"\x07"}, hsm.deletedKeys)
+		require.NotNil(t, nextPubKey)
+		require.Empty(t, nextPubKey.NextPubKey)
+
+		// Slots in use are never deleted
+		hsm.deletedKeys, hsm.deletedCerts = nil, nil
+		handler.State.NewKey = "01"
+		handler.State.NewCert = "03"
+		require.Nil(t, handler.Save())
+		require.Nil(t, handler.Abort())
+		require.Nil(t, hsm.deletedKeys)
+		require.Nil(t, hsm.deletedCerts)
+
+		// Past the point of no return
+		handler.State.DeviceConfigUpdated = true
+		require.Nil(t, handler.Save())
+		require.Equal(t, ErrRotationNotAbortable, handler.Abort())
+		_, err = os.Stat(stateFile)
+		require.Nil(t, err)
+	})
+}
+
+func TestRotateAbortFileKey(t *testing.T) {
+	testWrapper(t, nil, func(app *App, client *http.Client, tmpdir string) {
+		stateFile := filepath.Join(tmpdir, "rotate.state")
+		handler := NewCertRotationHandler(app, stateFile, "est-server-doesn't-matter")
+		handler.State.StepIdx = 1
+		handler.State.NewKey = pkey_pem
+		handler.State.NewCert = client_pem
+		require.Nil(t, handler.Save())
+		require.Nil(t, handler.Abort())
+
+		// The generated private key isn't left behind in the archive
+		buf, err := os.ReadFile(stateFile + ".aborted")
+		require.Nil(t, err)
+		require.NotContains(t, string(buf), "PRIVATE KEY")
+		require.NotContains(t, string(buf), "CERTIFICATE")
+		var state CertRotationState
+		require.Nil(t, json.Unmarshal(buf, &state))
+		require.Equal(t, 1, state.StepIdx)
+		require.Empty(t, state.NewKey)
+	})
+}
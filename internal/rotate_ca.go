@@ -0,0 +1,334 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// CaBundleConfigFile is the config entry `rotate-ca` reads the new CA bundle
+// from when no EST server is given.
+const CaBundleConfigFile = "fio-ca-bundle"
+
+var ErrCaRotationRolledBack = errors.New("Unable to reach the server with the new CA bundle, the previous bundle has been restored")
+
+type CaRotationState struct {
+	BaseState
+	EstServer string // Where to get the bundle from. Empty means the config
+
+	// Used by caDownloadStep
+	NewCaCerts string // PEM bundle as downloaded
+
+	// Used by caInstallStep
+	PrevCaPath string
+	NewCaPath  string
+}
+
+func (s *CaRotationState) GetCorrelationId() string {
+	return defaultCorrelationId(&s.BaseState, "ca")
+}
+
+type caRotationContext = stateContext[*CaRotationState]
+type caRotationStep = stateStep[*CaRotationState]
+
+type CaRotationHandler struct {
+	stateHandler[*CaRotationState]
+}
+
+// NewCaRotationHandler constructs a handler to rotate the CA bundle used to
+// verify the device-gateway. The bundle is fetched from the EST server's
+// /cacerts, or from the CaBundleConfigFile config entry when estServer is
+// empty.
+func NewCaRotationHandler(app *App, stateFile, estServer string) *CaRotationHandler {
+	state := &CaRotationState{EstServer: estServer}
+	return &CaRotationHandler{
+		stateHandler[*CaRotationState]{
+			stateContext: newStateContext(app, stateFile, state),
+			steps: []caRotationStep{
+				caDownloadStep{},
+				caVerifyStep{},
+				caHandshakeStep{},
+				caInstallStep{},
+				caCheckStep{},
+			},
+		},
+	}
+}
+
+// RestoreCaRotationHandler loads an incomplete CA rotation. It returns nil
+// when `stateFile` does not exist.
+func RestoreCaRotationHandler(app *App, stateFile string) *CaRotationHandler {
+	handler := NewCaRotationHandler(app, stateFile, "")
+	if ok := handler.Restore(); !ok {
+		handler = nil
+	}
+	return handler
+}
+
+func (h *CaRotationHandler) Rotate() error {
+	err := h.execute("CaRotationStarted", "CaRotationCompleted", true)
+	if errors.Is(err, ErrCaRotationRolledBack) {
+		// There's nothing to resume, a new rotation has to be started
+		if archiveErr := h.store().Archive(".rolledback"); archiveErr != nil {
+			slog.Error("Unable to archive state file", "error", archiveErr)
+		}
+	}
+	return err
+}
+
+type caDownloadStep struct{}
+
+func (s caDownloadStep) Name() string {
+	return "Download new CA bundle"
+}
+
+func (s caDownloadStep) Execute(handler *caRotationContext) error {
+	var certs []*x509.Certificate
+	var err error
+	if len(handler.State.EstServer) > 0 {
+		if certs, err = estCaCerts(handler.client, handler.State.EstServer); err != nil {
+			return err
+		}
+	} else {
+		path := filepath.Join(handler.app.SecretsDir, CaBundleConfigFile)
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("Unable to read CA bundle from config: %w", err)
+		}
+		if certs, err = parseCertsPem(buf); err != nil {
+			return err
+		}
+	}
+	var bundle bytes.Buffer
+	for _, cert := range certs {
+		if !cert.IsCA {
+			return fmt.Errorf("CA bundle contains a non CA certificate: %s", cert.Subject)
+		}
+		if err := pem.Encode(&bundle, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}); err != nil {
+			return err
+		}
+	}
+	handler.State.NewCaCerts = bundle.String()
+	return nil
+}
+
+type caVerifyStep struct{}
+
+func (s caVerifyStep) Name() string {
+	return "Verify new CA bundle against current trust chain"
+}
+
+func (s caVerifyStep) Execute(handler *caRotationContext) error {
+	current, err := readCaBundle(handler.app.sota.GetOrDie("import.tls_cacert_path"))
+	if err != nil {
+		return err
+	}
+	newCerts, err := parseCertsPem([]byte(handler.State.NewCaCerts))
+	if err != nil {
+		return err
+	}
+	return verifyCaBundle(current, newCerts)
+}
+
+type caHandshakeStep struct{}
+
+func (s caHandshakeStep) Name() string {
+	return "Test TLS handshake with combined CA bundle"
+}
+
+func (s caHandshakeStep) Execute(handler *caRotationContext) error {
+	bundle, err := combinedCaBundle(handler)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(bundle)
+
+	transport := handler.client.Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.RootCAs = pool
+	client := &http.Client{Timeout: 30 * time.Second, Transport: transport}
+	return checkServerConnectivity(client, handler.app.sota.GetOrDie("tls.server"))
+}
+
+type caInstallStep struct{}
+
+func (s caInstallStep) Name() string {
+	return "Update sota.toml with combined CA bundle"
+}
+
+func (s caInstallStep) Execute(handler *caRotationContext) error {
+	curPath := handler.app.sota.GetOrDie("import.tls_cacert_path")
+	if len(handler.State.NewCaPath) > 0 && curPath == handler.State.NewCaPath {
+		// We updated sota.toml but lost power before saving the state
+		return nil
+	}
+	bundle, err := combinedCaBundle(handler)
+	if err != nil {
+		return err
+	}
+	path, err := writeUniqueFile(handler.app.StorageDir, "root.*.crt", string(bundle))
+	if err != nil {
+		return err
+	}
+	handler.State.PrevCaPath = curPath
+	handler.State.NewCaPath = path
+	// The paths must be on disk before sota.toml changes, or a resumed step
+	// would treat the new bundle as the one to roll back to.
+	if err = handler.Save(); err != nil {
+		return err
+	}
+	return handler.app.sota.UpdateKeys(map[string]string{"import.tls_cacert_path": path})
+}
+
+type caCheckStep struct{}
+
+func (s caCheckStep) Name() string {
+	return "Verify connectivity with new CA bundle"
+}
+
+func (s caCheckStep) Execute(handler *caRotationContext) error {
+	// Build the client exactly how every fioconfig invocation will from now on
+	client, crypto := createClient(handler.app.sota)
+	defer crypto.Close()
+	err := checkServerConnectivity(client, handler.app.sota.GetOrDie("tls.server"))
+	if err == nil {
+		return nil
+	}
+
+	slog.Error("Unable to reach server with new CA bundle, rolling back", "error", err)
+	keyvals := map[string]string{"import.tls_cacert_path": handler.State.PrevCaPath}
+	if rollbackErr := handler.app.sota.UpdateKeys(keyvals); rollbackErr != nil {
+		return fmt.Errorf("Unable to roll back to %s: %w (server check: %s)", handler.State.PrevCaPath, rollbackErr, err)
+	}
+	return fmt.Errorf("%w: %s", ErrCaRotationRolledBack, err)
+}
+
+// checkServerConnectivity makes sure a TLS session can be established with
+// the server. Any HTTP response is good enough to prove that.
+func checkServerConnectivity(client *http.Client, server string) error {
+	res, err := client.Get(server + "/device")
+	if err != nil {
+		return fmt.Errorf("Unable to connect to %s: %w", server, err)
+	}
+	res.Body.Close()
+	return nil
+}
+
+// combinedCaBundle returns the current bundle followed by any new certs so
+// the device keeps trusting the current CA while the server migrates.
+func combinedCaBundle(handler *caRotationContext) ([]byte, error) {
+	path := handler.app.sota.GetOrDie("import.tls_cacert_path")
+	if path == handler.State.NewCaPath && len(handler.State.PrevCaPath) > 0 {
+		path = handler.State.PrevCaPath
+	}
+	current, err := readCaBundle(path)
+	if err != nil {
+		return nil, err
+	}
+	newCerts, err := parseCertsPem([]byte(handler.State.NewCaCerts))
+	if err != nil {
+		return nil, err
+	}
+	return mergeCaBundles(current, newCerts)
+}
+
+// mergeCaBundles PEM encodes the current certs followed by the new ones that
+// aren't already in it.
+func mergeCaBundles(current, newCerts []*x509.Certificate) ([]byte, error) {
+	var bundle bytes.Buffer
+	var added []*x509.Certificate
+	for _, cert := range append(slices.Clip(current), newCerts...) {
+		if slices.ContainsFunc(added, cert.Equal) {
+			continue
+		}
+		if err := pem.Encode(&bundle, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}); err != nil {
+			return nil, err
+		}
+		added = append(added, cert)
+	}
+	return bundle.Bytes(), nil
+}
+
+func readCaBundle(path string) ([]*x509.Certificate, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read current CA bundle: %w", err)
+	}
+	return parseCertsPem(buf)
+}
+
+func parseCertsPem(buf []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, buf = pem.Decode(buf)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("No certificates found in CA bundle")
+	}
+	return certs, nil
+}
+
+// verifyCaBundle makes sure every certificate in the new bundle is trusted by
+// the current one. A new root is trusted if it is already in the bundle, is
+// signed by the current roots, or has the same subject and key as a
+// certificate in the new bundle that is (i.e. it is cross-signed).
+func verifyCaBundle(current, newCerts []*x509.Certificate) error {
+	roots := x509.NewCertPool()
+	for _, cert := range current {
+		roots.AddCert(cert)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range newCerts {
+		intermediates.AddCert(cert)
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+
+	trusted := func(cert *x509.Certificate) bool {
+		if slices.ContainsFunc(current, cert.Equal) {
+			return true
+		}
+		_, err := cert.Verify(opts)
+		return err == nil
+	}
+	for _, cert := range newCerts {
+		if trusted(cert) {
+			continue
+		}
+		crossSigned := false
+		for _, other := range newCerts {
+			if other != cert && bytes.Equal(other.RawSubject, cert.RawSubject) &&
+				bytes.Equal(other.RawSubjectPublicKeyInfo, cert.RawSubjectPublicKeyInfo) && trusted(other) {
+				crossSigned = true
+				break
+			}
+		}
+		if !crossSigned {
+			return fmt.Errorf("CA certificate is not trusted by the current CA bundle: %s", cert.Subject)
+		}
+	}
+	return nil
+}
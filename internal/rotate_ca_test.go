@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+	"github.com/stretchr/testify/require"
+)
+
+// testNewRoot creates a new root CA along with a cross-signed copy of it
+// issued by the CA that testWrapper's server uses.
+func testNewRoot(t *testing.T) (*x509.Certificate, *x509.Certificate) {
+	ts := httptest.NewTLSServer(nil)
+	ts.Close()
+	curRoot := ts.Certificate()
+	curKey := ts.TLS.Certificates[0].PrivateKey.(crypto.Signer)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "new-gateway-ca"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	require.Nil(t, err)
+	newRoot, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	der, err = x509.CreateCertificate(rand.Reader, &template, curRoot, key.Public(), curKey)
+	require.Nil(t, err)
+	cross, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	return newRoot, cross
+}
+
+func testCertsPem(certs ...*x509.Certificate) []byte {
+	var buf []byte
+	for _, cert := range certs {
+		buf = append(buf, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return buf
+}
+
+func TestVerifyCaBundle(t *testing.T) {
+	ts := httptest.NewTLSServer(nil)
+	ts.Close()
+	current := []*x509.Certificate{ts.Certificate()}
+	newRoot, cross := testNewRoot(t)
+
+	require.Nil(t, verifyCaBundle(current, current))
+	require.Nil(t, verifyCaBundle(current, []*x509.Certificate{cross}))
+	require.Nil(t, verifyCaBundle(current, []*x509.Certificate{newRoot, cross}))
+	require.NotNil(t, verifyCaBundle(current, []*x509.Certificate{newRoot}))
+	require.NotNil(t, verifyCaBundle(current, []*x509.Certificate{testCaCert(t, true)}))
+}
+
+func TestRotateCa(t *testing.T) {
+	testWrapper(t, nil, func(app *App, client *http.Client, tmpdir string) {
+		newRoot, cross := testNewRoot(t)
+		app.SecretsDir = filepath.Join(tmpdir, "secrets")
+		require.Nil(t, os.Mkdir(app.SecretsDir, 0o750))
+		bundlePath := filepath.Join(app.SecretsDir, CaBundleConfigFile)
+		require.Nil(t, os.WriteFile(bundlePath, testCertsPem(newRoot, cross), 0o644))
+		origPath := app.sota.GetOrDie("import.tls_cacert_path")
+		orig, err := readCaBundle(origPath)
+		require.Nil(t, err)
+
+		stateFile := filepath.Join(tmpdir, "ca-rotation.state")
+		handler := NewCaRotationHandler(app, stateFile, "")
+		handler.eventSync = NoOpEventSync{}
+		handler.cienv = true
+		require.Nil(t, handler.Rotate())
+
+		sota, err := sotatoml.NewAppConfig([]string{filepath.Join(tmpdir, "sota.toml")})
+		require.Nil(t, err)
+		installed, err := readCaBundle(sota.GetOrDie("import.tls_cacert_path"))
+		require.Nil(t, err)
+		require.Equal(t, append(orig, newRoot, cross), installed)
+		_, err = os.Stat(stateFile + ".completed")
+		require.Nil(t, err)
+
+		// A bundle not trusted by the current one is refused
+		require.Nil(t, os.WriteFile(bundlePath, testCertsPem(testCaCert(t, true)), 0o644))
+		handler = NewCaRotationHandler(app, stateFile, "")
+		handler.eventSync = NoOpEventSync{}
+		handler.cienv = true
+		require.ErrorContains(t, handler.Rotate(), "not trusted by the current CA bundle")
+	})
+}
+
+func TestRotateCaRollback(t *testing.T) {
+	testWrapper(t, nil, func(app *App, client *http.Client, tmpdir string) {
+		newRoot, cross := testNewRoot(t)
+		app.SecretsDir = tmpdir
+		require.Nil(t, os.WriteFile(filepath.Join(tmpdir, CaBundleConfigFile), testCertsPem(newRoot, cross), 0o644))
+		origPath := app.sota.GetOrDie("import.tls_cacert_path")
+
+		stateFile := filepath.Join(tmpdir, "ca-rotation.state")
+		handler := NewCaRotationHandler(app, stateFile, "")
+		for _, step := range handler.steps[:4] {
+			require.Nil(t, step.Execute(&handler.stateContext))
+		}
+		require.NotEqual(t, origPath, app.sota.GetOrDie("import.tls_cacert_path"))
+
+		// Re-running the install step after a power loss is a no-op. The
+		// state is only what the step saved itself before updating sota.toml.
+		newPath := handler.State.NewCaPath
+		handler = RestoreCaRotationHandler(app, stateFile)
+		require.NotNil(t, handler)
+		require.Equal(t, newPath, handler.State.NewCaPath)
+		require.Nil(t, caInstallStep{}.Execute(&handler.stateContext))
+		require.Equal(t, newPath, handler.State.NewCaPath)
+		require.Equal(t, origPath, handler.State.PrevCaPath)
+
+		// Pretend the server is unreachable with the new bundle
+		require.Nil(t, app.sota.UpdateKeys(map[string]string{"tls.server": "https://127.0.0.1:1"}))
+		err := caCheckStep{}.Execute(&handler.stateContext)
+		require.True(t, errors.Is(err, ErrCaRotationRolledBack))
+		require.Equal(t, origPath, app.sota.GetOrDie("import.tls_cacert_path"))
+	})
+}
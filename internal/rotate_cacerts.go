@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"log/slog"
+	"slices"
+)
+
+type caCertsStep struct{}
+
+func (s caCertsStep) Name() string {
+	return "Fetch CA certificates from server"
+}
+
+func (s caCertsStep) Execute(handler *certRotationContext) error {
+	if !handler.State.UpdateCaCerts {
+		return nil
+	}
+	pki, err := newEnroller(handler)
+	if err != nil {
+		return err
+	}
+	certs, err := pki.caCerts()
+	if err != nil {
+		return err
+	}
+	// The EST server's CA certs are what issue device certificates, which
+	// isn't necessarily what the device-gateway's TLS certificate chains to.
+	// They are added to the current bundle so the gateway stays trusted.
+	current, err := readCaBundle(handler.app.sota.GetOrDie("import.tls_cacert_path"))
+	if err != nil {
+		return err
+	}
+	added := 0
+	for _, cert := range certs {
+		if !slices.ContainsFunc(current, cert.Equal) {
+			added++
+		}
+	}
+	if added == 0 {
+		slog.Info("CA certificates are unchanged")
+		return nil
+	}
+	bundle, err := mergeCaBundles(current, certs)
+	if err != nil {
+		return err
+	}
+	slog.Info("CA certificates will be updated", "added", added)
+	handler.State.NewCaCerts = string(bundle)
+	return nil
+}
@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+)
+
+// SupersededCredential is a key or certificate left behind by a certificate
+// rotation that the device no longer uses.
+type SupersededCredential struct {
+	Kind     string // "key" or "certificate"
+	Location string // File path or PKCS#11 slot id
+	Pkcs11   bool
+}
+
+func (c SupersededCredential) String() string {
+	if c.Pkcs11 {
+		return fmt.Sprintf("%s in PKCS#11 slot %s", c.Kind, c.Location)
+	}
+	return fmt.Sprintf("%s %s", c.Kind, c.Location)
+}
+
+// rotationKeep returns how many superseded keys and certificates to retain.
+func (a *App) rotationKeep() (int, error) {
+	val := a.sota.GetDefault("fioconfig.rotation_keep", "1")
+	keep, err := strconv.Atoi(val)
+	if err != nil || keep < 0 {
+		return 0, fmt.Errorf("Invalid value for fioconfig.rotation_keep: %s", val)
+	}
+	return keep, nil
+}
+
+// CleanupSupersededCredentials removes keys and certificates replaced by
+// earlier certificate rotations, keeping the `keep` most recent. A negative
+// keep uses the `fioconfig.rotation_keep` policy. With dryRun set, nothing is
+// removed and the list of what would be is returned.
+func (a *App) CleanupSupersededCredentials(stateFile string, keep int, dryRun bool) ([]SupersededCredential, error) {
+	if _, err := os.Stat(stateFile); err == nil {
+		return nil, errors.New("A certificate rotation is in progress")
+	}
+	if keep < 0 {
+		var err error
+		if keep, err = a.rotationKeep(); err != nil {
+			return nil, err
+		}
+	}
+	completed := stateFile + ".completed"
+	state, err := loadCompletedState(completed)
+	if err != nil {
+		return nil, err
+	}
+	handler := NewCertRotationHandler(a, completed, "")
+	if state != nil {
+		handler.State = state
+	}
+	return handler.cleanupSuperseded(keep, dryRun)
+}
+
+func (h *CertRotationHandler) cleanupSuperseded(keep int, dryRun bool) ([]SupersededCredential, error) {
+	var superseded []SupersededCredential
+	var err error
+	if h.usePkcs11() {
+		superseded = h.supersededPkcs11Objects(keep)
+	} else if superseded, err = h.supersededFiles(keep); err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return superseded, nil
+	}
+
+	for _, cred := range superseded {
+		slog.Info("Removing superseded", "credential", cred.String())
+		if cred.Pkcs11 {
+			id := sotatoml.IdToBytes(cred.Location)
+			if cred.Kind == "key" {
+				err = h.crypto.DeleteKeyPair(id, nil)
+			} else {
+				err = h.crypto.DeleteCertificate(id, nil, nil)
+			}
+		} else {
+			err = secureRemove(cred.Location)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Unable to remove superseded %s: %w", cred, err)
+		}
+	}
+	return superseded, nil
+}
+
+// supersededFiles finds the key and certificate files finalizeStep wrote for
+// earlier rotations. The device's original files are left alone.
+func (h *CertRotationHandler) supersededFiles(keep int) ([]SupersededCredential, error) {
+	var superseded []SupersededCredential
+	patterns := [][3]string{
+		{"key", "pkey.*.pem", "import.tls_pkey_path"},
+		{"certificate", "client.*.pem", "import.tls_clientcert_path"},
+	}
+	for _, pattern := range patterns {
+		paths, err := filepath.Glob(filepath.Join(h.app.StorageDir, pattern[1]))
+		if err != nil {
+			return nil, err
+		}
+		inUse := h.app.sota.Get(pattern[2])
+		paths = slices.DeleteFunc(paths, func(path string) bool { return path == inUse })
+
+		modTimes := make(map[string]int64, len(paths))
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+			modTimes[path] = info.ModTime().UnixNano()
+		}
+		// Newest first, so the most recently superseded are retained
+		sort.SliceStable(paths, func(i, j int) bool { return modTimes[paths[i]] > modTimes[paths[j]] })
+		for _, path := range paths[min(keep, len(paths)):] {
+			superseded = append(superseded, SupersededCredential{Kind: pattern[0], Location: path})
+		}
+	}
+	return superseded, nil
+}
+
+// supersededPkcs11Objects finds the objects left in the rotation's slots
+// that aren't in use. Only slots recorded by a completed rotation are
+// considered, since other slots may belong to something else.
+func (h *CertRotationHandler) supersededPkcs11Objects(keep int) []SupersededCredential {
+	var superseded []SupersededCredential
+	slots := []struct {
+		kind  string
+		inUse string
+		prev  string
+		ids   []string
+	}{
+		{"key", h.app.sota.Get("p11.tls_pkey_id"), h.State.PrevKey, h.State.PkeySlotIds},
+		{"certificate", h.app.sota.Get("p11.tls_clientcert_id"), h.State.PrevCert, h.State.CertSlotIds},
+	}
+	for _, slot := range slots {
+		var unused []string
+		// The slot rotated away from most recently is retained first
+		if len(slot.prev) > 0 && slot.prev != slot.inUse && slices.Contains(slot.ids, slot.prev) {
+			unused = append(unused, slot.prev)
+		}
+		for _, id := range slot.ids {
+			if id != slot.inUse && !slices.Contains(unused, id) {
+				unused = append(unused, id)
+			}
+		}
+		for _, id := range unused[min(keep, len(unused)):] {
+			superseded = append(superseded, SupersededCredential{Kind: slot.kind, Location: id, Pkcs11: true})
+		}
+	}
+	return superseded
+}
+
+// secureRemove overwrites a file with zeros before removing it, so key
+// material doesn't linger in the freed blocks.
+func secureRemove(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err == nil {
+		_, err = f.Write(make([]byte, info.Size()))
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCleanupSupersededFiles(t *testing.T) {
+	testWrapper(t, nil, func(app *App, client *http.Client, tmpdir string) {
+		// Three rotations worth of files, the newest of which is in use
+		var keys, certs []string
+		for i := 0; i < 3; i++ {
+			key, err := writeUniqueFile(tmpdir, "pkey.*.pem", pkey_pem)
+			require.Nil(t, err)
+			cert, err := writeUniqueFile(tmpdir, "client.*.pem", client_pem)
+			require.Nil(t, err)
+			mtime := time.Now().Add(time.Duration(i-3) * time.Hour)
+			require.Nil(t, os.Chtimes(key, mtime, mtime))
+			require.Nil(t, os.Chtimes(cert, mtime, mtime))
+			keys = append(keys, key)
+			certs = append(certs, cert)
+		}
+		require.Nil(t, app.sota.UpdateKeys(map[string]string{
+			"import.tls_pkey_path":       keys[2],
+			"import.tls_clientcert_path": certs[2],
+		}))
+		stateFile := filepath.Join(tmpdir, "cert-rotation.state")
+
+		superseded, err := app.CleanupSupersededCredentials(stateFile, -1, true)
+		require.Nil(t, err)
+		require.Equal(t, []SupersededCredential{
+			{Kind: "key", Location: keys[0]},
+			{Kind: "certificate", Location: certs[0]},
+		}, superseded)
+		_, err = os.Stat(keys[0])
+		require.Nil(t, err)
+
+		superseded, err = app.CleanupSupersededCredentials(stateFile, 0, false)
+		require.Nil(t, err)
+		require.Len(t, superseded, 4)
+		for _, path := range []string{keys[0], keys[1], certs[0], certs[1]} {
+			_, err = os.Stat(path)
+			require.True(t, os.IsNotExist(err))
+		}
+		for _, path := range []string{keys[2], certs[2], filepath.Join(tmpdir, "pkey.pem")} {
+			_, err = os.Stat(path)
+			require.Nil(t, err)
+		}
+
+		// Nothing is removed while a rotation is in progress
+		require.Nil(t, os.WriteFile(stateFile, []byte("{}"), 0o644))
+		_, err = app.CleanupSupersededCredentials(stateFile, 0, false)
+		require.ErrorContains(t, err, "in progress")
+	})
+}
+
+func TestCleanupSupersededPkcs11(t *testing.T) {
+	testWrapper(t, nil, func(app *App, client *http.Client, tmpdir string) {
+		withPkcs11Slots(t, app, tmpdir)
+		stateFile := filepath.Join(tmpdir, "rotate.state.completed")
+		handler := NewCertRotationHandler(app, stateFile, "est-server-doesn't-matter")
+		hsm := &fakeHsm{DeviceCryptoHandler: handler.crypto}
+		handler.crypto = hsm
+
+		// Without a completed rotation the other slots aren't known to be ours
+		superseded, err := handler.cleanupSuperseded(0, false)
+		require.Nil(t, err)
+		require.Len(t, superseded, 0)
+
+		handler.State.PkeySlotIds = []string{"01", "07"}
+		handler.State.CertSlotIds = []string{"03", "09"}
+		handler.State.PrevKey = "07"
+		handler.State.PrevCert = "09"
+
+		superseded, err = handler.cleanupSuperseded(1, false)
+		require.Nil(t, err)
+		require.Len(t, superseded, 0)
+
+		superseded, err = handler.cleanupSuperseded(0, true)
+		require.Nil(t, err)
+		require.Equal(t, []SupersededCredential{
+			{Kind: "key", Location: "07", Pkcs11: true},
+			{Kind: "certificate", Location: "09", Pkcs11: true},
+		}, superseded)
+		require.Len(t, hsm.deletedKeys, 0)
+
+		_, err = handler.cleanupSuperseded(0, false)
+		require.Nil(t, err)
+		require.Equal(t, []string{"\x07"}, hsm.deletedKeys)
+		require.Equal(t, []string{"\x09"}, hsm.deletedCerts)
+	})
+}
@@ -1,12 +1,11 @@
 package internal
 
 import (
-	"crypto/x509"
 	"encoding/json"
-	"encoding/pem"
 	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
 
 	"github.com/foundriesio/fioconfig/transport"
@@ -19,6 +18,11 @@ func (s fullCfgStep) Name() string {
 }
 
 func (s fullCfgStep) Execute(handler *certRotationContext) error {
+	// Nothing local has changed yet
+	if err := rememberPrevious(handler); err != nil {
+		return err
+	}
+
 	crypto, err := getCryptoHandler(handler)
 	if err != nil {
 		return err
@@ -35,7 +39,7 @@ func (s fullCfgStep) Execute(handler *certRotationContext) error {
 	}
 
 	// Encrypt with new key
-	cfgBytes, err := encryptConfig(crypto, config)
+	cfgBytes, err := encryptConfig(crypto, config, handler.app.tagKeyIds())
 	if err != nil {
 		return err
 	}
@@ -56,35 +60,61 @@ func (s deviceCfgStep) Execute(handler *certRotationContext) error {
 		return err
 	}
 	defer crypto.Close()
-	pub := crypto.PrivKey.Public()
-	pubDer, err := x509.MarshalPKIXPublicKey(pub.ExportECDSA())
+
+	err = reencryptDeviceConfig(handler.app, handler.client, handler.crypto, crypto, "Rotating device client certificate")
+	if err != nil {
+		return err
+	}
+	handler.State.DeviceConfigUpdated = true
+	return nil
+}
+
+// reencryptDeviceConfig downloads the device specific config, decrypts it
+// with the `from` key and uploads it encrypted to the `to` key, which the
+// server will then expect the device to use. It does nothing if the config
+// is already encrypted to the `to` key.
+func reencryptDeviceConfig(app *App, client *http.Client, from, to DeviceCryptoHandler, reason string) error {
+	pubPem, err := publicKeyPem(to.Public())
 	if err != nil {
 		return err
 	}
-	pubPem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDer})
 
 	// Download/decrypt current device config with current key
-	url := handler.app.configUrl + "-device"
-	res, err := transport.HttpGet(handler.client, url, nil)
+	url := app.configUrl + "-device"
+	res, err := transport.HttpGet(client, url, map[string]string{"Accept": acceptHeader})
 	if err != nil {
 		return err
 	}
 	if res.StatusCode == 204 {
 		// Device has no configuration
-		handler.State.DeviceConfigUpdated = true
 		return nil
 	} else if res.StatusCode != 200 {
 		return fmt.Errorf("Unable to get device configuration: HTTP_%d - %s", res.StatusCode, res.String())
 	}
-	config, err := UnmarshallBuffer(handler.crypto, res.Body, true)
+	toId, err := KeyId(to.Public())
+	if err != nil {
+		return err
+	}
+	raw, err := UnmarshallBuffer(nil, res.Body, false)
+	if err != nil {
+		return err
+	}
+	if encryptedWith(raw, toId) {
+		// We uploaded this config with the new key and had a power failure
+		// before we saved the state to disk. We are good.
+		return nil
+	}
+
+	keys, err := NewMultiKeyCrypto(from, to)
+	if err != nil {
+		return err
+	}
+	config, err := UnmarshallBuffer(keys, res.Body, true)
 	if err != nil {
 		slog.Info("Unable to decrypt device config with old key, trying new key", "error", err)
-		// There's a chance that we'd uploaded this config with the new key and
-		// had a power failure before we saved the state to disk. Check if
-		// we can decrypt with that key before giving up.
-		if _, err = UnmarshallBuffer(crypto, res.Body, true); err == nil {
-			// We just failed to save the state. We are good.
-			handler.State.DeviceConfigUpdated = true
+		// Values uploaded by older versions of fioconfig are not tagged
+		// with a key id, so the only way to tell is to try the new key.
+		if _, err = UnmarshallBuffer(to, res.Body, true); err == nil {
 			return nil
 		} else {
 			return err
@@ -92,13 +122,13 @@ func (s deviceCfgStep) Execute(handler *certRotationContext) error {
 	}
 
 	// Encrypt with new key
-	if _, err := encryptConfig(crypto, config); err != nil {
+	if _, err := encryptConfig(to, config, app.tagKeyIds()); err != nil {
 		return err
 	}
 
 	// Upload to server
 	ccr := ConfigCreateRequest{
-		Reason: "Rotating device client certificate",
+		Reason: reason,
 		PubKey: string(pubPem),
 	}
 	for name, entry := range config {
@@ -109,21 +139,22 @@ func (s deviceCfgStep) Execute(handler *certRotationContext) error {
 			OnChanged:   entry.OnChanged,
 		})
 	}
-	res, err = transport.HttpPatch(handler.client, handler.app.configUrl, ccr)
+	res, err = transport.HttpPatch(client, app.configUrl, ccr)
 	if err != nil {
 		return err
 	}
 	if res.StatusCode < 200 || res.StatusCode > 204 {
 		return fmt.Errorf("Unable to patch device config: HTTP_%d - %s", res.StatusCode, res.String())
 	}
-	handler.State.DeviceConfigUpdated = true
 	return nil
 }
 
-func encryptConfig(crypto *EciesCrypto, config map[string]*ConfigFile) ([]byte, error) {
+// encryptConfig encrypts a config's values to a key. They are tagged with the
+// key's id when tag is set.
+func encryptConfig(crypto DeviceCryptoHandler, config map[string]*ConfigFile, tag bool) ([]byte, error) {
 	for _, cfgFile := range config {
 		if !cfgFile.Unencrypted {
-			val, err := crypto.Encrypt(cfgFile.Value)
+			val, err := encryptValue(crypto, cfgFile.Value, tag)
 			if err != nil {
 				return nil, fmt.Errorf("Unable to re-encrypt config: %w", err)
 			}
@@ -137,14 +168,32 @@ func encryptConfig(crypto *EciesCrypto, config map[string]*ConfigFile) ([]byte,
 	return val, nil
 }
 
-func getCryptoHandler(h *certRotationContext) (*EciesCrypto, error) {
+// encryptedWith returns true if every encrypted value in the config is tagged
+// with the given key id.
+func encryptedWith(config ConfigStruct, id string) bool {
+	found := false
+	for _, cfgFile := range config {
+		if cfgFile.Unencrypted {
+			continue
+		}
+		if valueId, _ := splitKeyId(cfgFile.Value); valueId != id {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+func getCryptoHandler(h *certRotationContext) (DeviceCryptoHandler, error) {
 	if !h.usePkcs11() {
-		block, _ := pem.Decode([]byte(h.State.NewKey))
-		key, err := x509.ParseECPrivateKey(block.Bytes)
+		key, err := parsePrivateKeyPem([]byte(h.State.NewKey))
 		if err != nil {
 			return nil, fmt.Errorf("Unable to parse new private key: %w", err)
 		}
-		return NewEciesLocalHandler(key).(*EciesCrypto), nil
+		if handler := NewLocalCryptoHandler(key); handler != nil {
+			return handler, nil
+		}
+		return nil, fmt.Errorf("Unsupported new private key type: %T", key)
 	}
 	return getPkcs11CryptoHandler(h)
 }
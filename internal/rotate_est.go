@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"crypto"
 	"crypto/ecdsa"
-	"crypto/elliptic"
+	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/asn1"
@@ -13,10 +15,8 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
-	"io"
 	"log/slog"
 	"net/http"
-	"strings"
 
 	"github.com/foundriesio/fioconfig/sotatoml"
 	"go.mozilla.org/pkcs7"
@@ -44,57 +44,37 @@ func (s estStep) Execute(handler *certRotationContext) error {
 		return nil
 	}
 
-	var signer crypto.Signer
-	var newKey string
-
-	// Generate a new private key
-	if handler.usePkcs11() {
-		newKey = s.nextPkeyId(handler)
-		signer, err = handler.crypto.GenerateKeyPair(sotatoml.IdToBytes(newKey), []byte("tls"))
-		if err != nil {
-			return err
-		}
-	} else {
-		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-		if err != nil {
-			return fmt.Errorf("Unable to generate new private key: %w", err)
-		}
-		keyBytes, err := x509.MarshalECPrivateKey(key)
-		if err != nil {
-			return fmt.Errorf("Unable to serialize new private key: %w", err)
-		}
-		keyBytes = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes})
-		newKey = string(keyBytes)
-		signer = key
-	}
-
-	// Ask EST server for new cert
-	csrBytes, err := createB64CsrDer(signer, cert)
+	pki, err := newEnroller(handler)
 	if err != nil {
 		return err
 	}
 
-	url := handler.State.EstServer + "/simplereenroll"
-	res, err := handler.client.Post(url, "application/pkcs10", bytes.NewBuffer(csrBytes))
-	if err != nil {
-		return fmt.Errorf("Unable to submit certificate signing request: %w", err)
+	if handler.usePkcs11() && !handler.State.EstStarted {
+		// Let Abort know the next slots may need to be cleaned up, even if
+		// we lose power before this step completes.
+		handler.State.EstStarted = true
+		if err = handler.Save(); err != nil {
+			return err
+		}
 	}
-	buf, err := io.ReadAll(res.Body)
+
+	// Find out if the server has any preferences for the new key and CSR
+	attrs, err := pki.csrAttrs()
 	if err != nil {
-		return fmt.Errorf("Unable to read certificate response body: HTTP_%d - %w", res.StatusCode, err)
+		slog.Warn("Unable to get CSR attributes from server, using defaults", "error", err)
 	}
 
-	// Older version of foundriesio/estserver returned the status code 201, which is also required by older versions of foundriesio/fioconfig
-	// The spec requires status code 200.
-	if res.StatusCode != 200 && res.StatusCode != 201 {
-		return fmt.Errorf("Unable to obtain new certificate: HTTP_%d - %s", res.StatusCode, string(buf))
-	}
-	ct := res.Header.Get("content-type")
-	if !strings.HasPrefix(ct, "application/pkcs7-mime") {
-		return fmt.Errorf("Unexpected content-type return in certificate response: %s", ct)
+	var newKey string
+	var estCert *x509.Certificate
+	if handler.State.ServerKeyGen {
+		keyGen, ok := pki.(serverKeyGenerator)
+		if !ok {
+			return errors.New("Server key generation is only supported with EST")
+		}
+		newKey, estCert, err = s.serverKeyGen(handler, keyGen, tlsCert, cert, attrs)
+	} else {
+		newKey, estCert, err = s.reenroll(handler, pki, tlsCert, cert, attrs)
 	}
-
-	estCert, err := decodeEstResponse(string(buf))
 	if err != nil {
 		return err
 	}
@@ -122,6 +102,99 @@ func (s estStep) Execute(handler *certRotationContext) error {
 	return nil
 }
 
+// reenroll generates a new key on the device and asks the server to issue a
+// certificate for it.
+func (s estStep) reenroll(handler *certRotationContext, pki enroller, tlsCert tls.Certificate, cert *x509.Certificate, attrs *csrAttrs) (string, *x509.Certificate, error) {
+	var signer crypto.Signer
+	var newKey string
+	var err error
+
+	// Generate a new private key. Unless told otherwise by the user or the
+	// EST server, its the same type as the current one.
+	keyType := handler.State.KeyType
+	if len(keyType) == 0 && attrs != nil && len(attrs.KeyType) > 0 {
+		if handler.usePkcs11() && keyTypeCurve(attrs.KeyType) == nil {
+			slog.Warn("Ignoring key type requested by EST server not supported by PKCS#11 keys", "type", attrs.KeyType)
+		} else {
+			keyType = attrs.KeyType
+		}
+	}
+	if len(keyType) == 0 {
+		if keyType, err = keyTypeOf(tlsCert.PrivateKey); err != nil {
+			return "", nil, err
+		}
+	}
+	if handler.usePkcs11() {
+		curve := keyTypeCurve(keyType)
+		if curve == nil {
+			return "", nil, fmt.Errorf("Unsupported key type for PKCS#11 keys: %s", keyType)
+		}
+		newKey = s.nextPkeyId(handler)
+		signer, err = handler.crypto.GenerateKeyPair(sotatoml.IdToBytes(newKey), []byte("tls"), curve)
+		if err != nil {
+			return "", nil, err
+		}
+	} else {
+		rsaBits := 0
+		if attrs != nil && attrs.RsaBits > 0 {
+			rsaBits = attrs.RsaBits
+		} else if rsaKey, ok := tlsCert.PrivateKey.(*rsa.PrivateKey); ok {
+			rsaBits = rsaKey.N.BitLen()
+		}
+		signer, newKey, err = generateLocalKey(keyType, rsaBits)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	// Ask the server for new cert
+	csrBytes, err := createCsrDer(signer, cert, attrs)
+	if err != nil {
+		return "", nil, err
+	}
+	estCert, err := pki.enroll(csrBytes)
+	if err != nil {
+		return "", nil, err
+	}
+	return newKey, estCert, nil
+}
+
+// serverKeyGen has the EST server generate the new key, for devices whose
+// entropy can't be trusted to. The key is then stored the same way a key
+// generated on the device would be.
+func (s estStep) serverKeyGen(handler *certRotationContext, keyGen serverKeyGenerator, tlsCert tls.Certificate, cert *x509.Certificate, attrs *csrAttrs) (string, *x509.Certificate, error) {
+	// The server ignores the public key in the CSR, so the CSR is signed
+	// with the current key.
+	signer, ok := tlsCert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return "", nil, fmt.Errorf("Unsupported private key type: %T", tlsCert.PrivateKey)
+	}
+	csrBytes, err := createCsrDer(signer, cert, attrs)
+	if err != nil {
+		return "", nil, err
+	}
+	key, estCert, err := keyGen.serverKeyGen(csrBytes, func(p7 *pkcs7.PKCS7) ([]byte, error) {
+		// pkcs7 can only decrypt with file based RSA keys
+		return p7.Decrypt(cert, tlsCert.PrivateKey)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	if handler.usePkcs11() {
+		newKey := s.nextPkeyId(handler)
+		if err = handler.crypto.ImportKeyPair(sotatoml.IdToBytes(newKey), []byte("tls"), key); err != nil {
+			return "", nil, fmt.Errorf("Unable to import server generated key into HSM: %w", err)
+		}
+		return newKey, estCert, nil
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", nil, fmt.Errorf("Unable to serialize server generated key: %w", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), estCert, nil
+}
+
 func (s estStep) nextPkeyId(handler *certRotationContext) string {
 	cur := handler.app.sota.GetOrDie("p11.tls_pkey_id")
 	for _, val := range handler.State.PkeySlotIds {
@@ -144,11 +217,60 @@ func (s estStep) nextCertId(handler *certRotationContext) string {
 	return "09"
 }
 
-// createB64CsrDer creates the payload for an EST simplereenroll payload. The
-// main thing the EST server will want is for the x509 subject to be the same.
-// Then we also need to ask for the proper x509 extensions.
-func createB64CsrDer(key crypto.Signer, cert *x509.Certificate) ([]byte, error) {
+// generateLocalKey creates a new file based private key of the given type
+// and returns it along with its PEM encoding. RSA keys are rsaBits in size,
+// or 2048 bits when it is zero.
+func generateLocalKey(keyType string, rsaBits int) (crypto.Signer, string, error) {
+	var signer crypto.Signer
+	var keyBlock *pem.Block
+	switch keyType {
+	case KeyTypeRsa:
+		if rsaBits == 0 {
+			rsaBits = 2048
+		}
+		key, err := rsa.GenerateKey(rand.Reader, rsaBits)
+		if err != nil {
+			return nil, "", fmt.Errorf("Unable to generate new private key: %w", err)
+		}
+		keyBlock = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+		signer = key
+	case KeyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, "", fmt.Errorf("Unable to generate new private key: %w", err)
+		}
+		keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, "", fmt.Errorf("Unable to serialize new private key: %w", err)
+		}
+		keyBlock = &pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}
+		signer = key
+	default:
+		curve := keyTypeCurve(keyType)
+		if curve == nil {
+			return nil, "", fmt.Errorf("Unsupported key type: %s", keyType)
+		}
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return nil, "", fmt.Errorf("Unable to generate new private key: %w", err)
+		}
+		keyBytes, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, "", fmt.Errorf("Unable to serialize new private key: %w", err)
+		}
+		keyBlock = &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}
+		signer = key
+	}
+	return signer, string(pem.EncodeToMemory(keyBlock)), nil
+}
+
+// createCsrDer creates the CSR for a re-enrollment. The main thing the
+// server will want is for the x509 subject to be the same. Then we also need
+// to ask for the proper x509 extensions. The signature algorithm requested in
+// the server's CSR attributes is used when it suits the key.
+func createCsrDer(key crypto.Signer, cert *x509.Certificate, attrs *csrAttrs) ([]byte, error) {
 	template := x509.CertificateRequest{
+		SignatureAlgorithm: attrs.signatureAlgorithmFor(key.Public()),
 		PublicKeyAlgorithm: 0,
 		PublicKey:          key.Public(),
 		RawSubject:         cert.RawSubject,
@@ -166,11 +288,7 @@ func createB64CsrDer(key crypto.Signer, cert *x509.Certificate) ([]byte, error)
 		},
 	}
 
-	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, &template, key)
-	if err != nil {
-		return nil, err
-	}
-	return []byte(base64.StdEncoding.EncodeToString(csrBytes)), nil
+	return x509.CreateCertificateRequest(rand.Reader, &template, key)
 }
 
 func decodeEstResponse(estResponse string) (*x509.Certificate, error) {
@@ -1,65 +1,156 @@
 package internal
 
 import (
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
 	"time"
 
 	"github.com/foundriesio/fioconfig/transport"
+	"github.com/foundriesio/fioconfig/workflow"
 	"github.com/google/uuid"
 )
 
 // EventSync in an interface for sending events to device-gateway. The abstraction
 // makes it easier to write unit tests
-type EventSync interface {
-	Notify(name string, err error)
-	SetCorrelationId(corId string)
-}
-
-type NoOpEventSync struct{}
+type EventSync = workflow.EventSink
 
-func (s NoOpEventSync) Notify(name string, err error) {}
-func (s NoOpEventSync) SetCorrelationId(corId string) {}
+type NoOpEventSync = workflow.NoOpEventSink
 
 type DgEventSync struct {
 	client        *http.Client
 	url           string
 	correlationId string
 	target        CurrentTarget
+	crypto        CryptoHandler // Set when the sync owns its client's key
+	queue         eventQueue
+	deferred      bool // Only queue events, for when the network may not be up
+}
+
+func newDgEventSync(app *App, client *http.Client) *DgEventSync {
+	target, err := LoadCurrentTarget(filepath.Join(app.StorageDir, "current-target"))
+	if err != nil {
+		slog.Error("Unable to parse current-target. Events posted to server will be missing content", "error", err)
+	}
+	sync := &DgEventSync{
+		client: client,
+		target: target,
+		queue:  app.eventQueue(),
+	}
+	if server := app.sota.Get("tls.server"); len(server) > 0 {
+		sync.url = server + "/events"
+	} else {
+		// Events are kept until a check-in with a configured server sends them
+		slog.Warn("No tls.server configured, events will only be queued")
+		sync.deferred = true
+	}
+	return sync
+}
+
+func (a *App) eventQueue() eventQueue {
+	return eventQueue{path: filepath.Join(a.StorageDir, EventQueueFile), max: eventQueueMax}
+}
+
+// flushEvents sends events queued while the device-gateway couldn't be
+// reached. It does nothing when the queue is empty.
+func (a *App) flushEvents(client *http.Client) {
+	queue := a.eventQueue()
+	server := a.sota.Get("tls.server")
+	if _, err := os.Stat(queue.path); err != nil || len(server) == 0 {
+		return
+	}
+	events := &DgEventSync{client: client, url: server + "/events", queue: queue}
+	if err := events.Flush(); err != nil {
+		slog.Warn("Unable to send queued events", "error", err)
+	}
+}
+
+// NewEventSync returns an EventSync that sends events to the device-gateway.
+// It must be closed when no longer needed.
+func (a *App) NewEventSync() *DgEventSync {
+	client, crypto := createClient(a.sota)
+	sync := newDgEventSync(a, client)
+	sync.crypto = crypto
+	return sync
+}
+
+// Close releases the device key used to authenticate with the device-gateway
+func (s *DgEventSync) Close() {
+	if s.crypto != nil {
+		s.crypto.Close()
+	}
 }
 
 func (s *DgEventSync) SetCorrelationId(corId string) {
 	s.correlationId = corId
 }
 func (s *DgEventSync) Notify(event string, err error) {
-	details := ""
+	s.NotifyDetails(event, "", err)
+}
+
+// NotifyDetails sends an event with details that are included even when it
+// succeeded. An error is appended to them.
+func (s *DgEventSync) NotifyDetails(event, details string, err error) {
 	if err != nil {
-		details = err.Error()
+		if len(details) > 0 {
+			details += ": "
+		}
+		details += err.Error()
 	}
-	evt := []DgUpdateEvent{
-		{
-			Id:         uuid.New().String(),
-			DeviceTime: time.Now().Format(time.RFC3339),
-			Event: DgEvent{
-				CorrelationId: s.correlationId,
-				Success:       err == nil,
-				TargetName:    s.target.Name,
-				Version:       strconv.Itoa(s.target.Version),
-				Details:       details,
-			},
-			EventType: DgEventType{
-				Id:      event,
-				Version: 0,
-			},
+	evt := DgUpdateEvent{
+		Id:         uuid.New().String(),
+		DeviceTime: time.Now().Format(time.RFC3339),
+		Event: DgEvent{
+			CorrelationId: s.correlationId,
+			Success:       err == nil,
+			TargetName:    s.target.Name,
+			Version:       strconv.Itoa(s.target.Version),
+			Details:       details,
 		},
+		EventType: DgEventType{
+			Id:      event,
+			Version: 0,
+		},
+	}
+	// Queue the event first so it isn't lost if it can't be sent now
+	if err = s.queue.push(evt); err != nil {
+		slog.Error("Unable to queue event, sending it directly", "event", event, "error", err)
+		if err = s.send([]DgUpdateEvent{evt}); err != nil {
+			slog.Error("Unable to send event", "event", event, "error", err)
+		}
+		return
+	}
+	if s.deferred {
+		return
+	}
+	if err = s.Flush(); err != nil {
+		slog.Warn("Unable to send events, they will be sent on the next connection", "error", err)
+	}
+}
+
+// Flush sends queued events to the device-gateway in the order they were
+// emitted. Events stay queued if the server can't be reached.
+func (s *DgEventSync) Flush() error {
+	return s.queue.flush(s.send)
+}
+
+func (s *DgEventSync) send(events []DgUpdateEvent) error {
+	if len(s.url) == 0 {
+		return errors.New("Unable to send events: no tls.server configured")
 	}
-	res, err := transport.HttpPost(s.client, s.url, evt)
+	res, err := transport.HttpPost(s.client, s.url, events)
 	if err != nil {
-		slog.Error("Unable to send event", "error", err)
+		return fmt.Errorf("Unable to send events: %w", err)
+	} else if res.StatusCode >= 500 {
+		return fmt.Errorf("Unable to send events: HTTP_%d - %s", res.StatusCode, res.String())
 	} else if res.StatusCode < 200 || res.StatusCode > 204 {
-		slog.Error("Server could not process event", "event", event, "status", res.StatusCode, "response", res.String())
+		return fmt.Errorf("%w: HTTP_%d - %s", errEventsRejected, res.StatusCode, res.String())
 	}
+	return nil
 }
 
 type DgEvent struct {
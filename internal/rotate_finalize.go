@@ -4,8 +4,6 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-
-	"github.com/foundriesio/fioconfig/sotatoml"
 )
 
 type finalizeStep struct{}
@@ -30,30 +28,57 @@ func (s finalizeStep) Execute(handler *certRotationContext) error {
 			{"client.*.pem", "import.tls_clientcert_path", handler.State.NewCert},
 		}
 		for _, pair := range files {
-			f, err := os.CreateTemp(storagePath, pair[0])
+			path, err := writeUniqueFile(storagePath, pair[0], pair[2])
 			if err != nil {
 				return err
 			}
-			defer f.Close()
-			if _, err = f.WriteString(pair[2]); err != nil {
-				return err
-			}
-			if err = f.Sync(); err != nil {
-				return err
-			}
-			keyvals[pair[1]] = f.Name()
+			keyvals[pair[1]] = path
+		}
+	}
+	if len(handler.State.NewCaCerts) > 0 {
+		path, err := writeUniqueFile(storagePath, "root.*.crt", handler.State.NewCaCerts)
+		if err != nil {
+			return err
 		}
+		keyvals["import.tls_cacert_path"] = path
 	}
 	if err := handler.app.sota.UpdateKeys(keyvals); err != nil {
 		return err
 	}
 
 	if len(handler.State.FullConfigEncrypted) > 0 {
+		var crypto DeviceCryptoHandler
+		if handler.app.sealConfig {
+			// A sealed config must be sealed with the new key
+			var err error
+			if crypto, err = getCryptoHandler(handler); err != nil {
+				return err
+			}
+			defer crypto.Close()
+		}
 		path := filepath.Join(storagePath, "config.encrypted")
-		if err := sotatoml.SafeWrite(path, []byte(handler.State.FullConfigEncrypted)); err != nil {
+		if err := handler.app.writeConfig(crypto, path, []byte(handler.State.FullConfigEncrypted)); err != nil {
 			return fmt.Errorf("Error updating config.encrypted: %w", err)
 		}
 	}
 	handler.State.Finalized = true
 	return nil
 }
+
+// writeUniqueFile writes content to a new file with a unique name based on
+// pattern. Files are never updated in place, so sota.toml keeps pointing at
+// a complete file until it is updated.
+func writeUniqueFile(dir, pattern, content string) (string, error) {
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err = f.WriteString(content); err != nil {
+		return "", err
+	}
+	if err = f.Sync(); err != nil {
+		return "", err
+	}
+	return f.Name(), nil
+}
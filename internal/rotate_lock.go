@@ -1,8 +1,6 @@
 package internal
 
 import (
-	"crypto/x509"
-	"encoding/pem"
 	"fmt"
 
 	"github.com/foundriesio/fioconfig/transport"
@@ -23,16 +21,12 @@ func (s lockStep) Execute(handler *certRotationContext) error {
 	if err != nil {
 		return err
 	}
-	pub := crypto.PrivKey.Public()
+	pubBytes, err := publicKeyPem(crypto.Public())
 	crypto.Close()
-
-	pubBytes, err := x509.MarshalPKIXPublicKey(pub.ExportECDSA())
 	if err != nil {
 		return err
 	}
 
-	pubBytes = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes})
-
 	url := handler.app.sota.GetOrDie("tls.server") + "/device"
 	if res, err := transport.HttpPatch(handler.client, url, DeviceUpdate{string(pubBytes)}); err != nil {
 		return err
@@ -0,0 +1,191 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+	"golang.org/x/sys/unix"
+)
+
+// Free space needed in the storage directory on top of two copies of
+// config.encrypted, for the new key, certificate, CA bundle, and state.
+const preflightMinFree = 1024 * 1024
+
+// PreflightResult is the outcome of one pre-flight check.
+type PreflightResult struct {
+	Check string
+	Err   error
+}
+
+// Preflight checks for the conditions that would make a rotation fail after
+// it has started changing things. It is safe to run at any time since it
+// only reads.
+func (h *CertRotationHandler) Preflight() []PreflightResult {
+	results := []PreflightResult{
+		{"Configuration is writable", h.checkConfigWritable()},
+		{"Storage directory has space", h.checkStorage()},
+	}
+	if h.usePkcs11() {
+		results = append(results, PreflightResult{"PKCS#11 slots are available", h.checkPkcs11Slots()})
+	}
+	// Once enrollment has completed, the server isn't needed to resume
+	if h.estStepPending() {
+		results = append(results, PreflightResult{"Enrollment server is reachable", h.checkServer()})
+	}
+	return results
+}
+
+// preflightError combines the failed checks into one error, or returns nil
+// if they all passed.
+func preflightError(results []PreflightResult) error {
+	var errs []error
+	for _, r := range results {
+		if r.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", r.Check, r.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// stepIndex returns the position of the step of type S in the rotation, or
+// -1 if it has no such step.
+func stepIndex[S certRotationStep](h *CertRotationHandler) int {
+	for idx, step := range h.steps {
+		if _, ok := step.(S); ok {
+			return idx
+		}
+	}
+	return -1
+}
+
+// lockStepPending returns true if the rotation has yet to run lockStep.
+func (h *CertRotationHandler) lockStepPending() bool {
+	idx := stepIndex[lockStep](h)
+	return idx >= 0 && h.State.GetCurrentStep() <= idx
+}
+
+// estStepPending returns true if the rotation has yet to complete estStep.
+func (h *CertRotationHandler) estStepPending() bool {
+	idx := stepIndex[estStep](h)
+	return idx >= 0 && h.State.GetCurrentStep() <= idx
+}
+
+// checkConfigWritable makes sure finalizeStep will be able to point sota.toml
+// at the new credentials.
+func (h *CertRotationHandler) checkConfigWritable() error {
+	keys := []string{"import.tls_pkey_path", "import.tls_clientcert_path"}
+	if h.usePkcs11() {
+		keys = []string{"p11.tls_pkey_id", "p11.tls_clientcert_id"}
+	}
+	if h.State.UpdateCaCerts {
+		keys = append(keys, "import.tls_cacert_path")
+	}
+	err := h.app.sota.CheckWritable(keys...)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, sotatoml.ErrConfigManaged):
+		return fmt.Errorf("%w. %s are set by a file fioctl manages, move them to sota.toml", err, strings.Join(keys, ", "))
+	case errors.Is(err, sotatoml.ErrNoWritableFound):
+		return fmt.Errorf("%s must be set in sota.toml so they can be updated", strings.Join(keys, ", "))
+	}
+	return fmt.Errorf("%w. Make sure fioconfig can write to it", err)
+}
+
+// checkStorage makes sure the new files can be written to the storage
+// directory.
+func (h *CertRotationHandler) checkStorage() error {
+	dir := h.app.StorageDir
+	f, err := os.CreateTemp(dir, ".preflight.*")
+	if err != nil {
+		return fmt.Errorf("Unable to write to %s: %w", dir, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	need := uint64(preflightMinFree)
+	if st, err := os.Stat(filepath.Join(dir, "config.encrypted")); err == nil {
+		need += 2 * uint64(st.Size())
+	}
+	var fs unix.Statfs_t
+	if err := unix.Statfs(dir, &fs); err != nil {
+		return fmt.Errorf("Unable to check free space in %s: %w", dir, err)
+	}
+	if free := fs.Bavail * uint64(fs.Bsize); free < need {
+		return fmt.Errorf("%s has %d bytes free, %d are needed. Free up space and try again", dir, free, need)
+	}
+	return nil
+}
+
+// checkPkcs11Slots makes sure the rotation has slots to put the new key and
+// certificate in that aren't holding the ones in use. Before estStep writes
+// to them, the HSM is also asked whether the slots it will pick already hold
+// objects that would be overwritten. Credentials an earlier rotation
+// superseded, once the server accepted their replacements, are expected to
+// be overwritten.
+func (h *CertRotationHandler) checkPkcs11Slots() error {
+	var prev *CertRotationState
+	checkHsm := h.estStepPending() && !h.State.EstStarted
+	var errs []error
+	if checkHsm {
+		var err error
+		if prev, err = loadCompletedState(h.stateFile + ".completed"); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if prev == nil || !prev.HealthChecked {
+		prev = &CertRotationState{}
+	}
+
+	step := estStep{}
+	slots := []struct {
+		kind   string
+		key    string
+		flag   string
+		ids    []string
+		next   func(*certRotationContext) string
+		has    func([]byte) (bool, error)
+		prevId string
+	}{
+		{"key", "p11.tls_pkey_id", "--pkcs11-key-ids", h.State.PkeySlotIds, step.nextPkeyId, h.crypto.HasKeyPair, prev.PrevKey},
+		{"certificate", "p11.tls_clientcert_id", "--pkcs11-cert-ids", h.State.CertSlotIds, step.nextCertId, h.crypto.HasCertificate, prev.PrevCert},
+	}
+	for _, slot := range slots {
+		cur := h.app.sota.Get(slot.key)
+		free := slices.DeleteFunc(slices.Clone(slot.ids), func(id string) bool { return id == cur || len(id) == 0 })
+		if len(free) == 0 {
+			errs = append(errs, fmt.Errorf("No free slot for the new %s in [%s], the current one is in slot %s. Choose another slot with %s", slot.kind, strings.Join(slot.ids, ","), cur, slot.flag))
+			continue
+		}
+		if !checkHsm {
+			continue
+		}
+		id := slot.next(&h.stateContext)
+		occupied, err := slot.has(sotatoml.IdToBytes(id))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Unable to look for a %s in slot %s: %w", slot.kind, id, err))
+		} else if occupied && id != slot.prevId {
+			errs = append(errs, fmt.Errorf("Slot %s already holds a %s that would be overwritten. Remove it or choose another slot with %s", id, slot.kind, slot.flag))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (h *CertRotationHandler) checkServer() error {
+	if len(h.State.EstServer) == 0 {
+		return errors.New("No enrollment server given")
+	}
+	pki, err := newEnroller(&h.stateContext)
+	if err != nil {
+		return err
+	}
+	if err = pki.reachable(); err != nil {
+		return fmt.Errorf("%w. Check the server URL and the device's network", err)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+	"github.com/foundriesio/fioconfig/workflow"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotatePreflight(t *testing.T) {
+	patched := false
+	doGet := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPatch {
+			patched = true
+		} else if strings.HasPrefix(r.URL.Path, "/est/") {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	})
+	WithEstServer(t, func(tc testClient) {
+		testWrapper(t, doGet, func(app *App, client *http.Client, tmpdir string) {
+			stateFile := filepath.Join(tmpdir, "rotate.state")
+			handler := NewCertRotationHandler(app, stateFile, tc.srv.URL+"/.well-known/est")
+			results := handler.Preflight()
+			require.Len(t, results, 3)
+			require.Nil(t, preflightError(results))
+
+			handler = NewCertRotationHandler(app, stateFile, app.sota.Get("tls.server")+"/est")
+			err := preflightError(handler.Preflight())
+			require.ErrorContains(t, err, "Enrollment server is reachable: ")
+			require.ErrorContains(t, err, "Check the server URL")
+
+			// A failed check stops the rotation before the server is changed
+			handler.eventSync = NoOpEventSync{}
+			handler.cienv = true
+			require.ErrorContains(t, handler.Rotate(), "Pre-flight checks failed")
+			require.False(t, patched)
+			_, err = os.Stat(stateFile)
+			require.True(t, os.IsNotExist(err))
+
+			// The credentials can't be updated when fioctl manages them
+			managed := "[import]\ntls_pkey_path = \"" + filepath.Join(tmpdir, "pkey.pem") + "\"\n"
+			require.Nil(t, os.WriteFile(filepath.Join(tmpdir, "z-50-fioctl.toml"), []byte(managed), 0o644))
+			app.sota, err = sotatoml.NewAppConfig([]string{tmpdir})
+			require.Nil(t, err)
+			handler = NewCertRotationHandler(app, stateFile, tc.srv.URL+"/.well-known/est")
+			err = preflightError(handler.Preflight())
+			require.ErrorIs(t, err, sotatoml.ErrConfigManaged)
+			require.ErrorContains(t, err, "move them to sota.toml")
+			require.Nil(t, os.Remove(filepath.Join(tmpdir, "z-50-fioctl.toml")))
+
+			// The new key and cert need a slot other than the current one
+			withPkcs11Slots(t, app, tmpdir)
+			handler = NewCertRotationHandler(app, stateFile, tc.srv.URL+"/.well-known/est")
+			handler.crypto = &fakeHsm{DeviceCryptoHandler: handler.crypto}
+			handler.State.PkeySlotIds = []string{"01", "07"}
+			handler.State.CertSlotIds = []string{"03", "09"}
+			results = handler.Preflight()
+			require.Len(t, results, 4)
+			require.Nil(t, preflightError(results))
+
+			// Objects already in the slots the rotation would use
+			hsm := handler.crypto.(*fakeHsm)
+			require.Nil(t, hsm.ImportKeyPair([]byte{7}, nil, "key"))
+			require.Nil(t, hsm.ImportCertificateWithLabel([]byte{9}, nil, testCaCert(t, false)))
+			err = preflightError(handler.Preflight())
+			require.ErrorContains(t, err, "Slot 07 already holds a key that would be overwritten")
+			require.ErrorContains(t, err, "Slot 09 already holds a certificate that would be overwritten")
+
+			// They are still needed until the server accepts the rotation
+			// that superseded them
+			completed := &CertRotationState{PrevKey: "07", PrevCert: "09"}
+			require.Nil(t, workflow.FileStore{Path: stateFile + ".completed"}.Save(completed))
+			require.ErrorContains(t, preflightError(handler.Preflight()), "Slot 07")
+			completed.HealthChecked = true
+			require.Nil(t, workflow.FileStore{Path: stateFile + ".completed"}.Save(completed))
+			require.Nil(t, preflightError(handler.Preflight()))
+			require.Nil(t, os.Remove(stateFile+".completed"))
+
+			// Resuming after enrollment neither needs the server nor
+			// minds the objects it wrote
+			handler.State.EstServer = app.sota.Get("tls.server") + "/est"
+			handler.State.StepIdx = stepIndex[estStep](handler) + 1
+			results = handler.Preflight()
+			require.Len(t, results, 3)
+			require.Nil(t, preflightError(results))
+			handler.State.StepIdx = 0
+
+			handler.State.PkeySlotIds = []string{"01"}
+			err = preflightError(handler.Preflight())
+			require.ErrorContains(t, err, "No free slot for the new key in [01], the current one is in slot 01")
+			require.NotContains(t, err.Error(), "new certificate")
+		})
+	})
+}
@@ -15,6 +15,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/foundriesio/fioconfig/sotatoml"
@@ -38,20 +39,70 @@ func (t testStep) Execute(_ *certRotationContext) error {
 type testClient struct {
 	srv    *httptest.Server
 	client *http.Client
+	est    *estStandIn
+}
+
+// estStandIn controls what the test EST server returns
+type estStandIn struct {
+	csrAttrs []byte // DER encoded /csrattrs response. 404 when nil
+	caCerts  []byte // DER encoded certs for /cacerts. 404 when nil
+	csr      *x509.CertificateRequest
+
+	// Content type and body for /serverkeygen
+	serverKeyGenType string
+	serverKeyGen     []byte
 }
 
 func WithEstServer(t *testing.T, testFunc func(tc testClient)) {
 	kp, err := tls.X509KeyPair([]byte(client_pem), []byte(pkey_pem))
 	require.Nil(t, err)
 
+	est := &estStandIn{}
 	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// A dumb server that just returns the same cert back to the requestor
-		w.Header().Add("content-type", "application/pkcs7-mime")
-		w.WriteHeader(201)
-		bytes, err := pkcs7.DegenerateCertificate(kp.Certificate[0])
-		require.Nil(t, err)
-		bytes = []byte(base64.StdEncoding.EncodeToString(bytes))
-		_, err = w.Write(bytes)
+		var bytes []byte
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/csrattrs"):
+			if est.csrAttrs == nil {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Add("content-type", "application/csrattrs")
+			bytes = est.csrAttrs
+		case strings.HasSuffix(r.URL.Path, "/cacerts"):
+			if est.caCerts == nil {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Add("content-type", "application/pkcs7-mime")
+			bytes, err = pkcs7.DegenerateCertificate(est.caCerts)
+			require.Nil(t, err)
+		case strings.HasSuffix(r.URL.Path, "/serverkeygen"):
+			body, err := io.ReadAll(r.Body)
+			require.Nil(t, err)
+			der, err := base64.StdEncoding.DecodeString(string(body))
+			require.Nil(t, err)
+			est.csr, err = x509.ParseCertificateRequest(der)
+			require.Nil(t, err)
+
+			w.Header().Add("content-type", est.serverKeyGenType)
+			_, err = w.Write(est.serverKeyGen)
+			require.Nil(t, err)
+			return
+		default:
+			// A dumb server that just returns the same cert back to the requestor
+			body, err := io.ReadAll(r.Body)
+			require.Nil(t, err)
+			der, err := base64.StdEncoding.DecodeString(string(body))
+			require.Nil(t, err)
+			est.csr, err = x509.ParseCertificateRequest(der)
+			require.Nil(t, err)
+
+			w.Header().Add("content-type", "application/pkcs7-mime")
+			w.WriteHeader(201)
+			bytes, err = pkcs7.DegenerateCertificate(kp.Certificate[0])
+			require.Nil(t, err)
+		}
+		_, err := w.Write([]byte(base64.StdEncoding.EncodeToString(bytes)))
 		require.Nil(t, err)
 	}))
 
@@ -68,6 +119,7 @@ func WithEstServer(t *testing.T, testFunc func(tc testClient)) {
 	tc := testClient{
 		srv:    srv,
 		client: client,
+		est:    est,
 	}
 
 	testFunc(tc)
@@ -238,6 +290,7 @@ func TestRotateDeviceConfig(t *testing.T) {
 
 	testWrapper(t, dgHandler, func(app *App, client *http.Client, tmpdir string) {
 		app.configUrl += "/"
+		withFioconfigSection(t, app, tmpdir, "tag_key_ids = \"true\"\n")
 		encbuf, err = os.ReadFile(app.EncryptedConfig)
 		require.Nil(t, err)
 		stateFile := filepath.Join(tmpdir, "rotate.state")
@@ -254,6 +307,11 @@ func TestRotateDeviceConfig(t *testing.T) {
 		require.Equal(t, "bar file value", config["bar"].Value)
 		require.NotEqual(t, "foo file value", config["foo"].Value)
 
+		newId, err := KeyId(key.Public())
+		require.Nil(t, err)
+		fooId, _ := splitKeyId(config["foo"].Value)
+		require.Equal(t, newId, fooId)
+
 		c := NewEciesLocalHandler(key)
 		config, err = UnmarshallBuffer(c, newcfg, true)
 		require.Nil(t, err)
@@ -268,6 +326,20 @@ func TestRotateDeviceConfig(t *testing.T) {
 		handler.State.DeviceConfigUpdated = false
 		require.Nil(t, step.Execute(&handler.stateContext))
 		require.Nil(t, newcfg) // We shouldn't have called PATCH /config-device
+
+		// Older versions uploaded untagged values, so the new key has to be
+		// tried to detect the same edge case.
+		config, err = UnmarshallBuffer(nil, encbuf, false)
+		require.Nil(t, err)
+		for _, cfgFile := range config {
+			_, cfgFile.Value = splitKeyId(cfgFile.Value)
+		}
+		encbuf, err = json.Marshal(config)
+		require.Nil(t, err)
+		handler.State.DeviceConfigUpdated = false
+		require.Nil(t, step.Execute(&handler.stateContext))
+		require.True(t, handler.State.DeviceConfigUpdated)
+		require.Nil(t, newcfg)
 	})
 }
 
@@ -301,3 +373,11 @@ func TestRotateFinalize(t *testing.T) {
 		require.Nil(t, err)
 	})
 }
+
+func TestRotationDefaultCorrelationId(t *testing.T) {
+	state := &CertRotationState{}
+	require.Contains(t, state.GetCorrelationId(), "certs-")
+	caState := &CaRotationState{}
+	require.Contains(t, caState.GetCorrelationId(), "ca-")
+	require.NotContains(t, caState.GetCorrelationId(), "certs-")
+}
@@ -0,0 +1,242 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+	"github.com/foundriesio/fioconfig/workflow"
+)
+
+var errCredentialsRejected = errors.New("Server rejected the device's credentials")
+
+type verifyStep struct{}
+
+func (s verifyStep) Name() string {
+	return "Verify new credentials with server"
+}
+
+func (s verifyStep) Execute(handler *certRotationContext) error {
+	var cert tls.Certificate
+	var err error
+	if handler.usePkcs11() {
+		cert, err = handler.crypto.FindTlsCertificate(sotatoml.IdToBytes(handler.State.NewKey), sotatoml.IdToBytes(handler.State.NewCert))
+	} else {
+		cert, err = tls.X509KeyPair([]byte(handler.State.NewCert), []byte(handler.State.NewKey))
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to load new credentials: %w", err)
+	}
+
+	transport := handler.client.Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	if len(handler.State.NewCaCerts) > 0 {
+		// Make sure the gateway is trusted with the bundle finalizeStep installs
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(handler.State.NewCaCerts)) {
+			return errors.New("Unable to parse new CA certificates")
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+	client := &http.Client{Timeout: handler.client.Timeout, Transport: transport}
+	if err := checkDeviceAuth(client, handler.app.sota.GetOrDie("tls.server")); err != nil {
+		return fmt.Errorf("Unable to use new credentials with server: %w", err)
+	}
+	return nil
+}
+
+// rememberPrevious records the credentials and config in use before the
+// rotation so the health check can revert to them. It has to run before
+// finalizeStep on every path, including the offline resume done by
+// `fioconfig extract`, or the new credentials would be recorded instead.
+func rememberPrevious(handler *certRotationContext) error {
+	if len(handler.State.PrevKey) > 0 {
+		return nil
+	}
+	if handler.usePkcs11() {
+		handler.State.PrevKey = handler.app.sota.Get("p11.tls_pkey_id")
+		handler.State.PrevCert = handler.app.sota.Get("p11.tls_clientcert_id")
+	} else {
+		handler.State.PrevKey = handler.app.sota.Get("import.tls_pkey_path")
+		handler.State.PrevCert = handler.app.sota.Get("import.tls_clientcert_path")
+	}
+	handler.State.PrevCaPath = handler.app.sota.Get("import.tls_cacert_path")
+	return copyFile(handler.app.EncryptedConfig, handler.app.EncryptedConfig+".prev")
+}
+
+// checkDeviceAuth makes sure the server accepts the client's credentials.
+func checkDeviceAuth(client *http.Client, server string) error {
+	res, err := client.Get(server + "/device")
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode == 401 || res.StatusCode == 403 {
+		return fmt.Errorf("%w: HTTP_%d", errCredentialsRejected, res.StatusCode)
+	}
+	return nil
+}
+
+// isCredentialError tells a server rejecting the device's credentials apart
+// from the network being down. Only the former is a reason to revert.
+func isCredentialError(err error) bool {
+	if errors.Is(err, errCredentialsRejected) {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "remote error" {
+		// The server sent a TLS alert, like bad_certificate
+		return true
+	}
+	var verifyErr *tls.CertificateVerificationError
+	return errors.As(err, &verifyErr)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer in.Close()
+	buf, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	return sotatoml.SafeWrite(dst, buf)
+}
+
+// CheckCertRotationHealth looks at the last completed rotation. If the
+// device has not been able to reach the server since, and the server rejects
+// the new credentials, the previous credentials are restored.
+func CheckCertRotationHealth(app *App, stateFile string) error {
+	completed := stateFile + ".completed"
+	state, err := loadCompletedState(completed)
+	if err != nil {
+		return err
+	}
+	if state == nil || state.HealthChecked || len(state.PrevKey) == 0 {
+		return nil
+	}
+	if state.Reverted && state.DeviceConfigReverted {
+		return nil
+	}
+	handler := NewCertRotationHandler(app, completed, "")
+	handler.State = state
+	if state.Reverted {
+		// The device is back on its previous credentials, but the server
+		// still has its config encrypted to the rejected key.
+		return handler.revertServer(handler.client, handler.crypto)
+	}
+	return handler.HealthCheck()
+}
+
+// loadCompletedState reads the state of a completed rotation without setting
+// up a handler, which needs the device's credentials. It returns nil if no
+// rotation has completed.
+func loadCompletedState(path string) (*CertRotationState, error) {
+	var state CertRotationState
+	found, err := workflow.FileStore{Path: path}.Load(&state)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load completed rotation state: %w", err)
+	}
+	if !found {
+		return nil, nil
+	}
+	return &state, nil
+}
+
+// HealthCheck makes sure the credentials put in place by this completed
+// rotation are accepted by the server and reverts to the previous ones if not.
+func (h *CertRotationHandler) HealthCheck() error {
+	err := checkDeviceAuth(h.client, h.app.sota.GetOrDie("tls.server"))
+	if err == nil {
+		slog.Info("Server accepts credentials from certificate rotation", "id", h.State.CorrelationId)
+		h.State.HealthChecked = true
+		if err := h.Save(); err != nil {
+			return err
+		}
+		// The previous credentials are no longer needed to revert
+		if keep, err := h.app.rotationKeep(); err != nil {
+			slog.Error("Unable to clean up superseded credentials", "error", err)
+		} else if _, err := h.cleanupSuperseded(keep, false); err != nil {
+			slog.Error("Unable to clean up superseded credentials", "error", err)
+		}
+		return nil
+	}
+	if !isCredentialError(err) {
+		slog.Warn("Unable to check credentials from certificate rotation, will try again later", "error", err)
+		return nil
+	}
+
+	slog.Error("Server rejects credentials from certificate rotation, reverting", "error", err)
+	keyvals := map[string]string{}
+	if h.usePkcs11() {
+		keyvals["p11.tls_pkey_id"] = h.State.PrevKey
+		keyvals["p11.tls_clientcert_id"] = h.State.PrevCert
+	} else {
+		keyvals["import.tls_pkey_path"] = h.State.PrevKey
+		keyvals["import.tls_clientcert_path"] = h.State.PrevCert
+	}
+	if len(h.State.PrevCaPath) > 0 {
+		keyvals["import.tls_cacert_path"] = h.State.PrevCaPath
+	}
+	if err := h.app.sota.UpdateKeys(keyvals); err != nil {
+		return fmt.Errorf("Unable to revert to previous credentials: %w", err)
+	}
+	prevConfig := h.app.EncryptedConfig + ".prev"
+	if _, statErr := os.Stat(prevConfig); statErr == nil {
+		if err := os.Rename(prevConfig, h.app.EncryptedConfig); err != nil {
+			return fmt.Errorf("Unable to restore previous config: %w", err)
+		}
+	}
+	h.State.Reverted = true
+	if err := h.Save(); err != nil {
+		return err
+	}
+
+	// The new credentials are rejected, so report this with the old ones
+	client, crypto := createClient(h.app.sota)
+	defer crypto.Close()
+	revertErr := h.revertServer(client, crypto)
+	h.eventSync = newDgEventSync(h.app, client)
+	events := h.journaled(h.eventSync)
+	events.SetCorrelationId(h.State.CorrelationId)
+	events.Notify("CertRotationReverted", errors.Join(err, revertErr))
+
+	h.RestartServices()
+	return revertErr
+}
+
+// revertServer puts the server back to expecting the device's previous key:
+// the device specific config is encrypted to it again, and the next public
+// key set by lockStep is cleared. Otherwise the reverted device couldn't
+// decrypt its next check-in. The client and crypto handler must be for the
+// previous credentials.
+func (h *CertRotationHandler) revertServer(client *http.Client, prev DeviceCryptoHandler) error {
+	if h.State.DeviceConfigUpdated {
+		next, err := getCryptoHandler(&h.stateContext)
+		if err != nil {
+			return fmt.Errorf("Unable to revert device config on server: %w", err)
+		}
+		defer next.Close()
+		err = reencryptDeviceConfig(h.app, client, next, prev, "Reverting device client certificate rotation")
+		if err != nil {
+			return fmt.Errorf("Unable to revert device config on server: %w", err)
+		}
+	}
+	if err := clearNextPubKey(h.app, client); err != nil {
+		return err
+	}
+	h.State.DeviceConfigReverted = true
+	return h.Save()
+}
@@ -0,0 +1,216 @@
+package internal
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotateVerify(t *testing.T) {
+	status := 200
+	doGet := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/device" {
+			w.WriteHeader(status)
+		}
+	})
+
+	testWrapper(t, doGet, func(app *App, client *http.Client, tmpdir string) {
+		stateFile := filepath.Join(tmpdir, "rotate.state")
+		handler := NewCertRotationHandler(app, stateFile, "est-server-doesn't-matter")
+		handler.State.NewKey = pkey_pem
+		handler.State.NewCert = client_pem
+
+		status = 403
+		require.ErrorContains(t, verifyStep{}.Execute(&handler.stateContext), "HTTP_403")
+
+		status = 200
+		require.Nil(t, verifyStep{}.Execute(&handler.stateContext))
+
+		// The gateway has to be trusted by the CA bundle that will be installed
+		handler.State.NewCaCerts = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: testCaCert(t, true).Raw}))
+		require.ErrorContains(t, verifyStep{}.Execute(&handler.stateContext), "certificate")
+		root, err := os.ReadFile(filepath.Join(tmpdir, "root.crt"))
+		require.Nil(t, err)
+		handler.State.NewCaCerts = string(root) + handler.State.NewCaCerts
+		require.Nil(t, verifyStep{}.Execute(&handler.stateContext))
+
+		handler.State.NewKey = "bad key"
+		require.ErrorContains(t, verifyStep{}.Execute(&handler.stateContext), "Unable to load new credentials")
+	})
+}
+
+func TestRotateVerifyAbortable(t *testing.T) {
+	configPatched := false
+	doGet := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/device" && r.Method == http.MethodGet:
+			w.WriteHeader(403)
+		case r.URL.Path != "/device":
+			configPatched = true
+		}
+	})
+
+	testWrapper(t, doGet, func(app *App, client *http.Client, tmpdir string) {
+		stateFile := filepath.Join(tmpdir, "rotate.state")
+		handler := NewCertRotationHandler(app, stateFile, "est-server-doesn't-matter")
+		handler.eventSync = NoOpEventSync{}
+		handler.cienv = true
+		handler.State.NewKey = pkey_pem
+		handler.State.NewCert = client_pem
+		for idx, step := range handler.steps {
+			if _, ok := step.(lockStep); ok {
+				handler.State.StepIdx = idx + 1
+			}
+		}
+
+		// The server rejects the new certificate before its copy of the
+		// device config is encrypted to the new key
+		require.ErrorContains(t, handler.Rotate(), "HTTP_403")
+		require.False(t, configPatched)
+		require.False(t, handler.State.DeviceConfigUpdated)
+		handler = RestoreCertRotationHandler(app, stateFile)
+		handler.eventSync = NoOpEventSync{}
+		require.Nil(t, handler.Abort())
+	})
+}
+
+func TestRotateRememberPrevious(t *testing.T) {
+	testWrapper(t, nil, func(app *App, client *http.Client, tmpdir string) {
+		origKey := app.sota.GetOrDie("import.tls_pkey_path")
+		origCert := app.sota.GetOrDie("import.tls_clientcert_path")
+		origCa := app.sota.GetOrDie("import.tls_cacert_path")
+		origConfig, err := os.ReadFile(app.EncryptedConfig)
+		require.Nil(t, err)
+
+		stateFile := filepath.Join(tmpdir, "rotate.state")
+		handler := NewCertRotationHandler(app, stateFile, "est-server-doesn't-matter")
+		handler.State.NewKey = pkey_pem
+		handler.State.NewCert = client_pem
+		require.Nil(t, fullCfgStep{}.Execute(&handler.stateContext))
+		require.Equal(t, origKey, handler.State.PrevKey)
+		require.Equal(t, origCert, handler.State.PrevCert)
+		require.Equal(t, origCa, handler.State.PrevCaPath)
+		assertFile(t, app.EncryptedConfig+".prev", origConfig)
+
+		// `fioconfig extract` finalizes offline once the server has the
+		// config for the new key. What was in use before is still recorded.
+		handler.State.StepIdx = 4
+		handler.State.DeviceConfigUpdated = true
+		require.Nil(t, handler.Save())
+		handler = RestoreCertRotationHandler(app, stateFile)
+		require.Nil(t, handler.ResumeRotation(false))
+		require.True(t, handler.State.Finalized)
+		require.NotEqual(t, origKey, app.sota.GetOrDie("import.tls_pkey_path"))
+		require.Equal(t, origKey, handler.State.PrevKey)
+		require.Equal(t, origCert, handler.State.PrevCert)
+
+		// Re-running the step doesn't replace them with the new credentials
+		require.Nil(t, fullCfgStep{}.Execute(&handler.stateContext))
+		require.Equal(t, origKey, handler.State.PrevKey)
+		assertFile(t, app.EncryptedConfig+".prev", origConfig)
+	})
+}
+
+func TestRotateHealthCheck(t *testing.T) {
+	status := 200
+	patchStatus := 200
+	var deviceCfg []byte
+	var ccr *ConfigCreateRequest
+	var nextPubKey *DeviceUpdate
+	doGet := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/device" && r.Method == http.MethodGet:
+			w.WriteHeader(status)
+		case r.URL.Path == "/device" && r.Method == http.MethodPatch:
+			nextPubKey = &DeviceUpdate{"not-cleared"}
+			require.Nil(t, json.NewDecoder(r.Body).Decode(nextPubKey))
+		case r.URL.Path == "/-device":
+			_, err := w.Write(deviceCfg)
+			require.Nil(t, err)
+		case r.URL.Path == "/" && r.Method == http.MethodPatch:
+			if patchStatus == 200 {
+				ccr = &ConfigCreateRequest{}
+				require.Nil(t, json.NewDecoder(r.Body).Decode(ccr))
+			}
+			w.WriteHeader(patchStatus)
+		}
+	})
+
+	testWrapper(t, doGet, func(app *App, client *http.Client, tmpdir string) {
+		app.configUrl += "/"
+		origKey := app.sota.GetOrDie("import.tls_pkey_path")
+		origCert := app.sota.GetOrDie("import.tls_clientcert_path")
+		origConfig, err := os.ReadFile(app.EncryptedConfig)
+		require.Nil(t, err)
+		deviceCfg = origConfig
+
+		// Nothing to check until a rotation has completed
+		stateFile := filepath.Join(tmpdir, "rotate.state")
+		require.Nil(t, CheckCertRotationHealth(app, stateFile))
+
+		completed := stateFile + ".completed"
+		handler := NewCertRotationHandler(app, completed, "est-server-doesn't-matter")
+		handler.cienv = true
+		handler.eventSync = NoOpEventSync{}
+		handler.State.NewKey = pkey_pem
+		handler.State.NewCert = client_pem
+		require.Nil(t, fullCfgStep{}.Execute(&handler.stateContext))
+		handler.State.DeviceConfigUpdated = true
+		require.Nil(t, finalizeStep{}.Execute(&handler.stateContext))
+		require.NotEqual(t, origKey, app.sota.GetOrDie("import.tls_pkey_path"))
+		require.Nil(t, os.WriteFile(app.EncryptedConfig, []byte("rotated config"), 0o644))
+
+		// Network problems are not a reason to revert
+		server := app.sota.GetOrDie("tls.server")
+		require.Nil(t, app.sota.UpdateKeys(map[string]string{"tls.server": "https://127.0.0.1:1"}))
+		require.Nil(t, handler.HealthCheck())
+		require.False(t, handler.State.HealthChecked)
+		require.False(t, handler.State.Reverted)
+		require.Nil(t, app.sota.UpdateKeys(map[string]string{"tls.server": server}))
+
+		// The server rejects the new credentials, and won't take the device
+		// config back yet
+		status = 403
+		patchStatus = 400
+		require.ErrorContains(t, handler.HealthCheck(), "Unable to revert device config on server")
+		require.True(t, handler.State.Reverted)
+		require.False(t, handler.State.DeviceConfigReverted)
+		require.Equal(t, origKey, app.sota.GetOrDie("import.tls_pkey_path"))
+		require.Equal(t, origCert, app.sota.GetOrDie("import.tls_clientcert_path"))
+		config, err := os.ReadFile(app.EncryptedConfig)
+		require.Nil(t, err)
+		require.Equal(t, origConfig, config)
+
+		// The server side of the revert is retried
+		patchStatus = 200
+		require.Nil(t, CheckCertRotationHealth(app, stateFile))
+		require.NotNil(t, ccr)
+		require.Equal(t, "Reverting device client certificate rotation", ccr.Reason)
+		pubPem, err := app.PublicKeyPem()
+		require.Nil(t, err)
+		require.Equal(t, string(pubPem), ccr.PubKey)
+		require.NotNil(t, nextPubKey)
+		require.Empty(t, nextPubKey.NextPubKey)
+		state, err := loadCompletedState(completed)
+		require.Nil(t, err)
+		require.True(t, state.DeviceConfigReverted)
+
+		// A reverted rotation isn't checked again
+		status = 200
+		ccr = nil
+		require.Nil(t, CheckCertRotationHealth(app, stateFile))
+		require.Nil(t, ccr)
+		require.Equal(t, origKey, app.sota.GetOrDie("import.tls_pkey_path"))
+
+		// A healthy rotation is only checked once
+		handler.State.Reverted = false
+		require.Nil(t, handler.HealthCheck())
+		require.True(t, handler.State.HealthChecked)
+		require.Nil(t, CheckCertRotationHealth(app, stateFile))
+	})
+}
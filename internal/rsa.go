@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"runtime"
+)
+
+// RsaCrypto handles config values for devices with RSA keys. RSA can't
+// encrypt arbitrarily sized data, so values use a hybrid envelope:
+//
+//	base64(RSA-OAEP-SHA256(aes-key) | GCM nonce | AES-256-GCM ciphertext)
+//
+// The wrapped key is always the size of the RSA modulus, so no length
+// prefix is needed.
+type RsaCrypto struct {
+	PrivKey *rsa.PrivateKey
+}
+
+func NewRsaLocalHandler(privKey *rsa.PrivateKey) *RsaCrypto {
+	return &RsaCrypto{privKey}
+}
+
+func (r *RsaCrypto) Decrypt(value string) ([]byte, error) {
+	value, err := untagValue(r.Public(), value)
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to base64 decode: %v", err)
+	}
+	keySize := r.PrivKey.Size()
+	if len(data) < keySize {
+		return nil, errors.New("Unable to RSA decrypt: value is too short")
+	}
+	aesKey, err := rsa.DecryptOAEP(sha256.New(), nil, r.PrivKey, data[:keySize], nil)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to RSA decrypt %v", err)
+	}
+	gcm, err := newGcm(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	data = data[keySize:]
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("Unable to RSA decrypt: value is too short")
+	}
+	decrypted, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to RSA decrypt %v", err)
+	}
+	return decrypted, nil
+}
+
+func (r *RsaCrypto) Encrypt(value string) (string, error) {
+	return rsaEncrypt(&r.PrivKey.PublicKey, []byte(value))
+}
+
+func (r *RsaCrypto) Public() crypto.PublicKey {
+	return &r.PrivKey.PublicKey
+}
+
+func (r *RsaCrypto) UsePkcs11() bool {
+	return false
+}
+
+// Concurrency returns how many values can be decrypted at once
+func (r *RsaCrypto) Concurrency() int {
+	return runtime.NumCPU()
+}
+
+func (r *RsaCrypto) DeleteKeyPair(id []byte, label []byte) error {
+	return ErrNoPkcs11
+}
+
+func (r *RsaCrypto) DeleteCertificate(id []byte, label []byte, serial *big.Int) error {
+	return ErrNoPkcs11
+}
+
+func (r *RsaCrypto) ImportCertificateWithLabel(id []byte, label []byte, certificate *x509.Certificate) error {
+	return ErrNoPkcs11
+}
+
+func (r *RsaCrypto) GenerateKeyPair(id []byte, label []byte, curve elliptic.Curve) (crypto.Signer, error) {
+	return nil, ErrNoPkcs11
+}
+
+func (r *RsaCrypto) FindTlsCertificate(keyId []byte, certId []byte) (tls.Certificate, error) {
+	return tls.Certificate{}, ErrNoPkcs11
+}
+
+func (r *RsaCrypto) ImportKeyPair(id []byte, label []byte, key crypto.PrivateKey) error {
+	return ErrNoPkcs11
+}
+
+func (r *RsaCrypto) HasKeyPair(id []byte) (bool, error) {
+	return false, ErrNoPkcs11
+}
+
+func (r *RsaCrypto) HasCertificate(id []byte) (bool, error) {
+	return false, ErrNoPkcs11
+}
+
+func (r *RsaCrypto) Close() {
+}
+
+func rsaEncrypt(pub *rsa.PublicKey, value []byte) (string, error) {
+	aesKey := make([]byte, 32)
+	if _, err := rand.Read(aesKey); err != nil {
+		return "", err
+	}
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, aesKey, nil)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGcm(aesKey)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	enc := append(wrapped, nonce...)
+	enc = gcm.Seal(enc, nonce, value, nil)
+	return base64.StdEncoding.EncodeToString(enc), nil
+}
+
+func newGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create AES cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
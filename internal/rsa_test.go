@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func rsaKeyPem(t *testing.T) (*rsa.PrivateKey, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	keyBytes := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return key, keyBytes
+}
+
+func TestRsaCrypto(t *testing.T) {
+	key, keyBytes := rsaKeyPem(t)
+
+	parsed, err := parsePrivateKeyPem(keyBytes)
+	require.Nil(t, err)
+	handler := NewLocalCryptoHandler(parsed)
+	require.IsType(t, &RsaCrypto{}, handler)
+
+	enc, err := handler.Encrypt("secret value")
+	require.Nil(t, err)
+	require.NotEqual(t, "secret value", enc)
+
+	dec, err := handler.Decrypt(enc)
+	require.Nil(t, err)
+	require.Equal(t, "secret value", string(dec))
+
+	// A different key must not be able to decrypt this
+	other, _ := rsaKeyPem(t)
+	_, err = NewRsaLocalHandler(other).Decrypt(enc)
+	require.NotNil(t, err)
+
+	// encryptConfig is what cert rotation uses to re-encrypt configs
+	config := ConfigStruct{
+		"foo": &ConfigFile{Value: "foo file value"},
+		"bar": &ConfigFile{Value: "bar file value", Unencrypted: true},
+	}
+	buf, err := encryptConfig(NewRsaLocalHandler(key), config, false)
+	require.Nil(t, err)
+	config, err = UnmarshallBuffer(handler, buf, true)
+	require.Nil(t, err)
+	require.Equal(t, "foo file value", config["foo"].Value)
+	require.Equal(t, "bar file value", config["bar"].Value)
+}
+
+func TestRsaCreateClient(t *testing.T) {
+	key, keyBytes := rsaKeyPem(t)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "rsa-device"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	require.Nil(t, err)
+	certBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	testWrapper(t, nil, func(app *App, client *http.Client, tmpdir string) {
+		keyFile := filepath.Join(tmpdir, "rsa-pkey.pem")
+		certFile := filepath.Join(tmpdir, "rsa-client.pem")
+		require.Nil(t, os.WriteFile(keyFile, keyBytes, 0o600))
+		require.Nil(t, os.WriteFile(certFile, certBytes, 0o644))
+		require.Nil(t, app.sota.UpdateKeys(map[string]string{
+			"import.tls_pkey_path":       keyFile,
+			"import.tls_clientcert_path": certFile,
+		}))
+
+		_, crypto := createClient(app.sota)
+		defer crypto.Close()
+		require.IsType(t, &RsaCrypto{}, crypto)
+
+		// Make sure a rotation's new key follows the current key's type
+		signer, newKey, err := generateLocalKey(KeyTypeRsa, key.N.BitLen())
+		require.Nil(t, err)
+		require.IsType(t, &rsa.PrivateKey{}, signer)
+
+		stateFile := filepath.Join(tmpdir, "rotate.state")
+		handler := NewCertRotationHandler(app, stateFile, "est-server-doesn't-matter")
+		handler.State.NewKey = newKey
+
+		// The encrypted config in testWrapper is for the EC key, so replace
+		// it with one encrypted for the current RSA key.
+		config := ConfigStruct{"foo": &ConfigFile{Value: "foo file value"}}
+		buf, err := encryptConfig(crypto.(DeviceCryptoHandler), config, false)
+		require.Nil(t, err)
+		require.Nil(t, os.WriteFile(app.EncryptedConfig, buf, 0o644))
+
+		step := fullCfgStep{}
+		require.Nil(t, step.Execute(&handler.stateContext))
+
+		var rotated ConfigStruct
+		require.Nil(t, json.Unmarshal([]byte(handler.State.FullConfigEncrypted), &rotated))
+		require.NotEqual(t, "foo file value", rotated["foo"].Value)
+		rotated, err = UnmarshallBuffer(NewRsaLocalHandler(signer.(*rsa.PrivateKey)), []byte(handler.State.FullConfigEncrypted), true)
+		require.Nil(t, err)
+		require.Equal(t, "foo file value", rotated["foo"].Value)
+	})
+}
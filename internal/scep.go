@@ -0,0 +1,351 @@
+package internal
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/foundriesio/fioconfig/transport"
+	"go.mozilla.org/pkcs7"
+)
+
+// SCEP (RFC 8894) message attributes and values
+var (
+	oidScepMessageType    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 2}
+	oidScepPkiStatus      = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 3}
+	oidScepFailInfo       = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 4}
+	oidScepSenderNonce    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 5}
+	oidScepRecipientNonce = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 6}
+	oidScepTransactionId  = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 7}
+
+	scepFailInfo = map[string]string{
+		"0": "badAlg",
+		"1": "badMessageCheck",
+		"2": "badRequest",
+		"3": "badTime",
+		"4": "badCertId",
+	}
+
+	// pkcs7.Encrypt takes its algorithm from a package global
+	scepEncryptLock sync.Mutex
+)
+
+const (
+	scepCertRep    = "3"
+	scepRenewalReq = "17"
+	scepPkcsReq    = "19"
+
+	scepStatusSuccess = "0"
+	scepStatusFailure = "2"
+	scepStatusPending = "3"
+)
+
+// scepEnroller implements SCEP (RFC 8894) enrollment. Requests are signed
+// with the device's current certificate and the issued certificate is
+// encrypted to it, so the current key must be a file based RSA key.
+type scepEnroller struct {
+	client *http.Client
+	server string
+	cert   *x509.Certificate
+	key    crypto.PrivateKey
+}
+
+// SCEP has no equivalent of EST's CSR attributes
+func (e *scepEnroller) csrAttrs() (*csrAttrs, error) {
+	return nil, nil
+}
+
+func (e *scepEnroller) enroll(csr []byte) (*x509.Certificate, error) {
+	if _, ok := e.key.(*rsa.PrivateKey); !ok {
+		return nil, fmt.Errorf("SCEP enrollment requires a file based RSA key, not %T", e.key)
+	}
+	req, err := x509.ParseCertificateRequest(csr)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse certificate signing request: %w", err)
+	}
+	caps, err := e.get("GetCACaps")
+	if err != nil {
+		slog.Warn("Unable to get SCEP server capabilities, assuming none", "error", err)
+	}
+	recipient, caCerts, err := e.getCaCert()
+	if err != nil {
+		return nil, err
+	}
+
+	msgType := scepPkcsReq
+	if scepHasCap(caps, "Renewal") {
+		msgType = scepRenewalReq
+	}
+	keyDer, err := x509.MarshalPKIXPublicKey(req.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to serialize CSR public key: %w", err)
+	}
+	sum := sha256.Sum256(keyDer)
+	transactionId := hex.EncodeToString(sum[:])
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	msg, err := e.pkiMessage(csr, recipient, msgType, transactionId, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	var body []byte
+	if scepHasCap(caps, "POSTPKIOperation") {
+		body, err = e.post(msg)
+	} else {
+		body, err = e.get("PKIOperation", "message", base64.StdEncoding.EncodeToString(msg))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return e.parseCertRep(body, caCerts, transactionId, nonce, req.PublicKey)
+}
+
+// caCerts returns the CA certificates from GetCACert. Any RA certificates
+// are left out since they are not trust anchors.
+func (e *scepEnroller) caCerts() ([]*x509.Certificate, error) {
+	_, certs, err := e.getCaCert()
+	if err != nil {
+		return nil, err
+	}
+	var cas []*x509.Certificate
+	for _, cert := range certs {
+		if cert.IsCA {
+			cas = append(cas, cert)
+		}
+	}
+	if len(cas) == 0 {
+		return nil, errors.New("SCEP server returned no CA certificates")
+	}
+	return cas, nil
+}
+
+func (e *scepEnroller) reachable() error {
+	_, _, err := e.getCaCert()
+	return err
+}
+
+// getCaCert returns the certificate requests should be encrypted to along
+// with all the certificates the server returned. When the server uses an RA,
+// that is the RA's encryption certificate, otherwise it is the CA.
+func (e *scepEnroller) getCaCert() (*x509.Certificate, []*x509.Certificate, error) {
+	res, err := transport.HttpGet(e.client, e.url("GetCACert"), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if res.StatusCode != 200 {
+		return nil, nil, fmt.Errorf("Unable to get SCEP CA certificate: HTTP_%d - %s", res.StatusCode, res.String())
+	}
+	switch ct := res.Header.Get("content-type"); {
+	case strings.HasPrefix(ct, "application/x-x509-ca-cert"):
+		cert, err := x509.ParseCertificate(res.Body)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid certificate in GetCACert response: %w", err)
+		}
+		return cert, []*x509.Certificate{cert}, nil
+	case strings.HasPrefix(ct, "application/x-x509-ca-ra-cert"):
+		p7, err := pkcs7.Parse(res.Body)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid pkcs7 data in GetCACert response: %w", err)
+		}
+		for _, cert := range p7.Certificates {
+			if !cert.IsCA && (cert.KeyUsage == 0 || cert.KeyUsage&(x509.KeyUsageKeyEncipherment|x509.KeyUsageDataEncipherment) != 0) {
+				return cert, p7.Certificates, nil
+			}
+		}
+		for _, cert := range p7.Certificates {
+			if cert.IsCA {
+				return cert, p7.Certificates, nil
+			}
+		}
+		return nil, nil, errors.New("SCEP server returned no usable CA or RA certificate")
+	default:
+		return nil, nil, fmt.Errorf("Unexpected content-type return in GetCACert response: %s", ct)
+	}
+}
+
+// pkiMessage wraps a CSR into a SCEP request: a CMS EnvelopedData encrypted
+// to the CA inside a SignedData signed by the device's current key.
+func (e *scepEnroller) pkiMessage(csr []byte, recipient *x509.Certificate, msgType, transactionId string, nonce []byte) ([]byte, error) {
+	scepEncryptLock.Lock()
+	prev := pkcs7.ContentEncryptionAlgorithm
+	pkcs7.ContentEncryptionAlgorithm = pkcs7.EncryptionAlgorithmAES128CBC
+	enveloped, err := pkcs7.Encrypt(csr, []*x509.Certificate{recipient})
+	pkcs7.ContentEncryptionAlgorithm = prev
+	scepEncryptLock.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to encrypt SCEP request: %w", err)
+	}
+
+	sd, err := pkcs7.NewSignedData(enveloped)
+	if err != nil {
+		return nil, err
+	}
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	cfg := pkcs7.SignerInfoConfig{
+		ExtraSignedAttributes: []pkcs7.Attribute{
+			{Type: oidScepMessageType, Value: msgType},
+			{Type: oidScepTransactionId, Value: transactionId},
+			{Type: oidScepSenderNonce, Value: nonce},
+		},
+	}
+	if err = sd.AddSigner(e.cert, e.key, cfg); err != nil {
+		return nil, fmt.Errorf("Unable to sign SCEP request: %w", err)
+	}
+	return sd.Finish()
+}
+
+// parseCertRep checks a CertRep response was signed by the CA or RA from
+// GetCACert and belongs to our request, and returns the certificate issued
+// for pubKey.
+func (e *scepEnroller) parseCertRep(body []byte, caCerts []*x509.Certificate, transactionId string, nonce []byte, pubKey crypto.PublicKey) (*x509.Certificate, error) {
+	p7, err := pkcs7.Parse(body)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid pkcs7 data in SCEP response: %w", err)
+	}
+	if err = p7.Verify(); err != nil {
+		return nil, fmt.Errorf("Unable to verify SCEP response signature: %w", err)
+	}
+	// Verify only checks the signature against the certificate included in
+	// the response, which anyone answering the request could have made.
+	if err = scepVerifySigner(p7, caCerts); err != nil {
+		return nil, err
+	}
+	var msgType, status, respId string
+	var respNonce []byte
+	if err = p7.UnmarshalSignedAttribute(oidScepMessageType, &msgType); err != nil || msgType != scepCertRep {
+		return nil, fmt.Errorf("Unexpected SCEP message type in response: %s", msgType)
+	}
+	if err = p7.UnmarshalSignedAttribute(oidScepTransactionId, &respId); err != nil || respId != transactionId {
+		return nil, errors.New("SCEP response is for a different transaction")
+	}
+	if err = p7.UnmarshalSignedAttribute(oidScepRecipientNonce, &respNonce); err != nil || !bytes.Equal(respNonce, nonce) {
+		return nil, errors.New("SCEP response does not match the request's nonce")
+	}
+	if err = p7.UnmarshalSignedAttribute(oidScepPkiStatus, &status); err != nil {
+		return nil, fmt.Errorf("Missing status in SCEP response: %w", err)
+	}
+	switch status {
+	case scepStatusSuccess:
+	case scepStatusPending:
+		return nil, errors.New("SCEP request is pending manual approval")
+	case scepStatusFailure:
+		var failInfo string
+		_ = p7.UnmarshalSignedAttribute(oidScepFailInfo, &failInfo)
+		return nil, fmt.Errorf("SCEP server rejected the request: %s", scepFailInfo[failInfo])
+	default:
+		return nil, fmt.Errorf("Unknown status in SCEP response: %s", status)
+	}
+
+	enveloped, err := pkcs7.Parse(p7.Content)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid encrypted data in SCEP response: %w", err)
+	}
+	buf, err := enveloped.Decrypt(e.cert, e.key)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decrypt SCEP response: %w", err)
+	}
+	certs, err := pkcs7.Parse(buf)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid pkcs7 data in SCEP response: %w", err)
+	}
+	for _, cert := range certs.Certificates {
+		if key, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); ok && key.Equal(pubKey) {
+			return cert, nil
+		}
+	}
+	return nil, errors.New("SCEP response does not include a certificate for the new key")
+}
+
+// scepVerifySigner makes sure a response was signed by one of the
+// certificates from GetCACert, or by a certificate that chains to one of its
+// CA certificates.
+func scepVerifySigner(p7 *pkcs7.PKCS7, caCerts []*x509.Certificate) error {
+	signer := p7.GetOnlySigner()
+	if signer == nil {
+		return errors.New("SCEP response must have exactly one signer")
+	}
+	if slices.ContainsFunc(caCerts, signer.Equal) {
+		return nil
+	}
+	roots := x509.NewCertPool()
+	intermediates := x509.NewCertPool()
+	for _, cert := range caCerts {
+		if cert.IsCA {
+			roots.AddCert(cert)
+		}
+	}
+	for _, cert := range p7.Certificates {
+		intermediates.AddCert(cert)
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	if _, err := signer.Verify(opts); err != nil {
+		return fmt.Errorf("SCEP response is not signed by the SCEP server's CA: %w", err)
+	}
+	return nil
+}
+
+func (e *scepEnroller) url(operation string, params ...string) string {
+	query := url.Values{"operation": {operation}}
+	for i := 0; i+1 < len(params); i += 2 {
+		query.Set(params[i], params[i+1])
+	}
+	return e.server + "?" + query.Encode()
+}
+
+func (e *scepEnroller) get(operation string, params ...string) ([]byte, error) {
+	res, err := transport.HttpGet(e.client, e.url(operation, params...), nil)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("Unable to complete SCEP %s: HTTP_%d - %s", operation, res.StatusCode, res.String())
+	}
+	return res.Body, nil
+}
+
+func (e *scepEnroller) post(msg []byte) ([]byte, error) {
+	res, err := e.client.Post(e.url("PKIOperation"), "application/x-pki-message", bytes.NewBuffer(msg))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to submit SCEP request: %w", err)
+	}
+	defer res.Body.Close()
+	buf, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read SCEP response body: HTTP_%d - %w", res.StatusCode, err)
+	}
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("Unable to complete SCEP PKIOperation: HTTP_%d - %s", res.StatusCode, string(buf))
+	}
+	return buf, nil
+}
+
+func scepHasCap(caps []byte, capability string) bool {
+	for _, line := range strings.Fields(string(caps)) {
+		if strings.EqualFold(line, capability) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,262 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mozilla.org/pkcs7"
+)
+
+// scepStandIn is a minimal SCEP CA that issues a certificate for any request
+type scepStandIn struct {
+	caKey  *rsa.PrivateKey
+	caCert *x509.Certificate
+	caps   string
+	status string // pkiStatus to respond with
+	method string // HTTP method of the last PKIOperation
+	// Sign responses with these instead of the CA when set
+	signerKey  *rsa.PrivateKey
+	signerCert *x509.Certificate
+	msgType    string
+}
+
+func withScepServer(t *testing.T, testFunc func(srv *httptest.Server, scep *scepStandIn)) {
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "scep-ca"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageKeyEncipherment,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &caKey.PublicKey, caKey)
+	require.Nil(t, err)
+	caCert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+
+	scep := &scepStandIn{
+		caKey:  caKey,
+		caCert: caCert,
+		caps:   "POSTPKIOperation\nRenewal\nSHA-256\nAES\n",
+		status: scepStatusSuccess,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("operation") {
+		case "GetCACaps":
+			_, err := w.Write([]byte(scep.caps))
+			require.Nil(t, err)
+		case "GetCACert":
+			w.Header().Add("content-type", "application/x-x509-ca-cert")
+			_, err := w.Write(scep.caCert.Raw)
+			require.Nil(t, err)
+		case "PKIOperation":
+			scep.method = r.Method
+			var msg []byte
+			var err error
+			if r.Method == http.MethodPost {
+				msg, err = io.ReadAll(r.Body)
+			} else {
+				msg, err = base64.StdEncoding.DecodeString(r.URL.Query().Get("message"))
+			}
+			require.Nil(t, err)
+			w.Header().Add("content-type", "application/x-pki-message")
+			_, err = w.Write(scep.certRep(t, msg))
+			require.Nil(t, err)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	testFunc(srv, scep)
+}
+
+func (s *scepStandIn) certRep(t *testing.T, msg []byte) []byte {
+	p7, err := pkcs7.Parse(msg)
+	require.Nil(t, err)
+	require.Nil(t, p7.Verify())
+	var transactionId string
+	var nonce []byte
+	require.Nil(t, p7.UnmarshalSignedAttribute(oidScepMessageType, &s.msgType))
+	require.Nil(t, p7.UnmarshalSignedAttribute(oidScepTransactionId, &transactionId))
+	require.Nil(t, p7.UnmarshalSignedAttribute(oidScepSenderNonce, &nonce))
+
+	attrs := []pkcs7.Attribute{
+		{Type: oidScepMessageType, Value: scepCertRep},
+		{Type: oidScepPkiStatus, Value: s.status},
+		{Type: oidScepTransactionId, Value: transactionId},
+		{Type: oidScepRecipientNonce, Value: nonce},
+	}
+	var content []byte
+	if s.status == scepStatusSuccess {
+		enveloped, err := pkcs7.Parse(p7.Content)
+		require.Nil(t, err)
+		der, err := enveloped.Decrypt(s.caCert, s.caKey)
+		require.Nil(t, err)
+		csr, err := x509.ParseCertificateRequest(der)
+		require.Nil(t, err)
+		template := x509.Certificate{
+			SerialNumber:    big.NewInt(2),
+			RawSubject:      csr.RawSubject,
+			NotBefore:       time.Now(),
+			NotAfter:        time.Now().Add(time.Hour),
+			ExtraExtensions: csr.Extensions,
+		}
+		der, err = x509.CreateCertificate(rand.Reader, &template, s.caCert, csr.PublicKey, s.caKey)
+		require.Nil(t, err)
+		degenerate, err := pkcs7.DegenerateCertificate(der)
+		require.Nil(t, err)
+		content, err = pkcs7.Encrypt(degenerate, []*x509.Certificate{p7.GetOnlySigner()})
+		require.Nil(t, err)
+	} else {
+		attrs = append(attrs, pkcs7.Attribute{Type: oidScepFailInfo, Value: "2"})
+	}
+
+	sd, err := pkcs7.NewSignedData(content)
+	require.Nil(t, err)
+	signerCert, signerKey := s.caCert, s.caKey
+	if s.signerCert != nil {
+		signerCert, signerKey = s.signerCert, s.signerKey
+	}
+	require.Nil(t, sd.AddSigner(signerCert, signerKey, pkcs7.SignerInfoConfig{ExtraSignedAttributes: attrs}))
+	buf, err := sd.Finish()
+	require.Nil(t, err)
+	return buf
+}
+
+func TestEnrollProtocol(t *testing.T) {
+	protocol, server, err := enrollProtocol("", "https://est.example.com/.well-known/est")
+	require.Nil(t, err)
+	require.Equal(t, EnrollProtocolEst, protocol)
+	require.Equal(t, "https://est.example.com/.well-known/est", server)
+
+	protocol, server, err = enrollProtocol("", "scep+https://ca.example.com/scep")
+	require.Nil(t, err)
+	require.Equal(t, EnrollProtocolScep, protocol)
+	require.Equal(t, "https://ca.example.com/scep", server)
+
+	protocol, server, err = enrollProtocol(EnrollProtocolScep, "https://ca.example.com/a+b")
+	require.Nil(t, err)
+	require.Equal(t, EnrollProtocolScep, protocol)
+	require.Equal(t, "https://ca.example.com/a+b", server)
+
+	_, _, err = enrollProtocol("", "cmp+https://ca.example.com")
+	require.ErrorContains(t, err, "Unsupported enrollment protocol: cmp")
+}
+
+func TestScepEnroll(t *testing.T) {
+	key, keyBytes := rsaKeyPem(t)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "rsa-device"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	require.Nil(t, err)
+	certBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	withScepServer(t, func(srv *httptest.Server, scep *scepStandIn) {
+		testWrapper(t, nil, func(app *App, client *http.Client, tmpdir string) {
+			stateFile := filepath.Join(tmpdir, "rotate.state")
+
+			// SCEP needs the current key to decrypt the response
+			handler := NewCertRotationHandler(app, stateFile, "scep+"+srv.URL+"/scep")
+			require.ErrorContains(t, estStep{}.Execute(&handler.stateContext), "requires a file based RSA key")
+
+			keyFile := filepath.Join(tmpdir, "rsa-pkey.pem")
+			certFile := filepath.Join(tmpdir, "rsa-client.pem")
+			require.Nil(t, os.WriteFile(keyFile, keyBytes, 0o600))
+			require.Nil(t, os.WriteFile(certFile, certBytes, 0o644))
+			require.Nil(t, app.sota.UpdateKeys(map[string]string{
+				"import.tls_pkey_path":       keyFile,
+				"import.tls_clientcert_path": certFile,
+			}))
+
+			handler = NewCertRotationHandler(app, stateFile, "scep+"+srv.URL+"/scep")
+			handler.State.UpdateCaCerts = true
+			require.Nil(t, estStep{}.Execute(&handler.stateContext))
+			require.Equal(t, http.MethodPost, scep.method)
+			require.Equal(t, scepRenewalReq, scep.msgType)
+
+			newKey, err := parsePrivateKeyPem([]byte(handler.State.NewKey))
+			require.Nil(t, err)
+			require.IsType(t, &rsa.PrivateKey{}, newKey)
+			block, _ := pem.Decode([]byte(handler.State.NewCert))
+			newCert, err := x509.ParseCertificate(block.Bytes)
+			require.Nil(t, err)
+			require.True(t, newKey.(*rsa.PrivateKey).PublicKey.Equal(newCert.PublicKey))
+			require.Nil(t, newCert.CheckSignatureFrom(scep.caCert))
+
+			// The CA bundle gets the certs from GetCACert
+			require.Nil(t, caCertsStep{}.Execute(&handler.stateContext))
+			require.True(t, strings.HasSuffix(handler.State.NewCaCerts, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: scep.caCert.Raw}))))
+
+			// A response signed by anything but the SCEP server's CA is
+			// rejected, even though its signature is valid
+			rogueKey, err := rsa.GenerateKey(rand.Reader, 2048)
+			require.Nil(t, err)
+			rogue := x509.Certificate{
+				SerialNumber: big.NewInt(3),
+				Subject:      pkix.Name{CommonName: "scep-ca"},
+				NotBefore:    time.Now(),
+				NotAfter:     time.Now().Add(time.Hour),
+			}
+			der, err := x509.CreateCertificate(rand.Reader, &rogue, &rogue, &rogueKey.PublicKey, rogueKey)
+			require.Nil(t, err)
+			scep.signerKey = rogueKey
+			scep.signerCert, err = x509.ParseCertificate(der)
+			require.Nil(t, err)
+			handler = NewCertRotationHandler(app, stateFile, "scep+"+srv.URL+"/scep")
+			require.ErrorContains(t, estStep{}.Execute(&handler.stateContext), "not signed by the SCEP server's CA")
+
+			// An RA certificate issued by the CA may sign responses
+			ra := x509.Certificate{
+				SerialNumber: big.NewInt(4),
+				Subject:      pkix.Name{CommonName: "scep-ra"},
+				NotBefore:    time.Now(),
+				NotAfter:     time.Now().Add(time.Hour),
+				KeyUsage:     x509.KeyUsageDigitalSignature,
+			}
+			der, err = x509.CreateCertificate(rand.Reader, &ra, scep.caCert, &rogueKey.PublicKey, scep.caKey)
+			require.Nil(t, err)
+			scep.signerCert, err = x509.ParseCertificate(der)
+			require.Nil(t, err)
+			require.Nil(t, estStep{}.Execute(&handler.stateContext))
+			scep.signerKey, scep.signerCert = nil, nil
+
+			// Servers without POST support or renewal get a GET PKCSReq
+			scep.caps = ""
+			handler = NewCertRotationHandler(app, stateFile, srv.URL+"/scep")
+			handler.State.Protocol = EnrollProtocolScep
+			require.Nil(t, estStep{}.Execute(&handler.stateContext))
+			require.Equal(t, http.MethodGet, scep.method)
+			require.Equal(t, scepPkcsReq, scep.msgType)
+
+			scep.status = scepStatusFailure
+			require.ErrorContains(t, estStep{}.Execute(&handler.stateContext), "SCEP server rejected the request: badRequest")
+
+			scep.status = scepStatusPending
+			require.ErrorContains(t, estStep{}.Execute(&handler.stateContext), "pending manual approval")
+
+			handler.State.ServerKeyGen = true
+			require.ErrorContains(t, estStep{}.Execute(&handler.stateContext), "only supported with EST")
+		})
+	})
+}
@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// A sealed config is the entire content of config.encrypted encrypted to the
+// device's own key. This keeps "Unencrypted" entries from being stored in
+// plain text on persistent storage. The header distinguishes sealed files
+// from the JSON the server sends.
+var sealedHeader = []byte("fioconfig-sealed:1\n")
+
+var ErrConfigSealed = errors.New("Config is sealed and no crypto handler was provided to unseal it")
+
+func isSealed(content []byte) bool {
+	return bytes.HasPrefix(content, sealedHeader)
+}
+
+func sealConfig(crypto DeviceCryptoHandler, content []byte) ([]byte, error) {
+	sealed, err := crypto.Encrypt(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to seal config: %w", err)
+	}
+	return append(append([]byte{}, sealedHeader...), sealed...), nil
+}
+
+func unsealConfig(crypto CryptoHandler, content []byte) ([]byte, error) {
+	if crypto == nil {
+		return nil, ErrConfigSealed
+	}
+	unsealed, err := crypto.Decrypt(string(content[len(sealedHeader):]))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to unseal config: %w", err)
+	}
+	return unsealed, nil
+}
@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSealMigration(t *testing.T) {
+	testWrapper(t, nil, func(app *App, client *http.Client, tempdir string) {
+		orig, err := os.ReadFile(app.EncryptedConfig)
+		require.Nil(t, err)
+		before, err := os.Stat(app.EncryptedConfig)
+		require.Nil(t, err)
+
+		// Existing plain text files get sealed on the next extract
+		app.sealConfig = true
+		_, err = app.Extract()
+		require.Nil(t, err)
+		assertFile(t, filepath.Join(tempdir, "bar"), []byte("bar file value"))
+
+		sealed, err := os.ReadFile(app.EncryptedConfig)
+		require.Nil(t, err)
+		require.True(t, isSealed(sealed))
+		require.NotContains(t, string(sealed), "bar file value")
+		after, err := os.Stat(app.EncryptedConfig)
+		require.Nil(t, err)
+		require.Equal(t, before.ModTime(), after.ModTime())
+
+		_, err = UnmarshallFile(nil, app.EncryptedConfig, false)
+		require.True(t, errors.Is(err, ErrConfigSealed))
+
+		// Turning it off restores the original content
+		app.sealConfig = false
+		_, err = app.Extract()
+		require.Nil(t, err)
+		unsealed, err := os.ReadFile(app.EncryptedConfig)
+		require.Nil(t, err)
+		require.False(t, isSealed(unsealed))
+		origConfig, err := UnmarshallBuffer(nil, orig, false)
+		require.Nil(t, err)
+		unsealedConfig, err := UnmarshallBuffer(nil, unsealed, false)
+		require.Nil(t, err)
+		require.Equal(t, origConfig, unsealedConfig)
+	})
+}
+
+func TestSealCheckin(t *testing.T) {
+	var encbuf []byte
+	doGet := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.Header.Get("If-Modified-Since")) > 0 {
+			w.WriteHeader(304)
+			return
+		}
+		_, err := w.Write(encbuf)
+		require.Nil(t, err)
+	})
+
+	testWrapper(t, doGet, func(app *App, client *http.Client, tempdir string) {
+		_, crypto := createClient(app.sota)
+		defer crypto.Close()
+		var err error
+		encbuf, err = os.ReadFile(app.EncryptedConfig)
+		require.Nil(t, err)
+		require.Nil(t, os.Remove(app.EncryptedConfig))
+
+		app.sealConfig = true
+		changed, err := app.checkin(client, crypto)
+		require.Nil(t, err)
+		require.True(t, changed)
+		assertFile(t, filepath.Join(tempdir, "foo"), []byte("foo file value"))
+
+		sealed, err := os.ReadFile(app.EncryptedConfig)
+		require.Nil(t, err)
+		require.True(t, isSealed(sealed))
+
+		// The sealed file is used as the previous version of the config
+		_, err = app.checkin(client, crypto)
+		require.Equal(t, NotModifiedError, err)
+
+		config, err := UnmarshallFile(crypto, app.EncryptedConfig, false)
+		require.Nil(t, err)
+		var expected ConfigStruct
+		require.Nil(t, json.Unmarshal(encbuf, &expected))
+		require.Equal(t, expected, config)
+	})
+}
@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/foundriesio/fioconfig/transport"
+)
+
+func validateConfigName(name string) error {
+	if len(name) == 0 {
+		return errors.New("Config file name must not be empty")
+	}
+	if !filepath.IsLocal(name) {
+		return fmt.Errorf("Invalid config file name: %s", name)
+	}
+	return nil
+}
+
+// SetConfig publishes a value to this device's config on the server. The value
+// is encrypted with the device key unless unencrypted is set. The server's
+// response body is returned so it can be reported to the caller.
+func (a *App) SetConfig(name string, value []byte, unencrypted bool, onChanged []string) (string, error) {
+	if err := validateConfigName(name); err != nil {
+		return "", err
+	}
+	client, crypto := createClient(a.sota)
+	defer crypto.Close()
+
+	file := ConfigFileReq{
+		Name:        name,
+		Value:       string(value),
+		Unencrypted: unencrypted,
+		OnChanged:   onChanged,
+	}
+	if !unencrypted {
+		enc, err := encryptValue(crypto, file.Value, a.tagKeyIds())
+		if err != nil {
+			return "", fmt.Errorf("Unable to encrypt %s: %w", name, err)
+		}
+		file.Value = enc
+	}
+	// The server merges the files of a PATCH into the device's config, so
+	// the device's other files are left as they are.
+	ccr := ConfigCreateRequest{
+		Reason: "Set " + name + " from device",
+		Files:  []ConfigFileReq{file},
+	}
+	res, err := transport.HttpPatch(client, a.configUrl, ccr)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 204 {
+		return "", fmt.Errorf("Unable to set %s: HTTP_%d - %s", name, res.StatusCode, res.String())
+	}
+	return res.String(), nil
+}
+
+// UnsetConfig removes a file from this device's config on the server the
+// same way `fioctl devices config rm` does, with a DELETE of the file.
+func (a *App) UnsetConfig(name string) (string, error) {
+	if err := validateConfigName(name); err != nil {
+		return "", err
+	}
+	client, crypto := createClient(a.sota)
+	defer crypto.Close()
+
+	res, err := transport.HttpDo(client, http.MethodDelete, configFileUrl(a.configUrl, name), nil, nil)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode == 404 {
+		return "", fmt.Errorf("Unable to unset %s: not in the device's config", name)
+	} else if res.StatusCode < 200 || res.StatusCode > 204 {
+		return "", fmt.Errorf("Unable to unset %s: HTTP_%d - %s", name, res.StatusCode, res.String())
+	}
+	return res.String(), nil
+}
+
+// configFileUrl returns the URL of a file in the device's config. Each part
+// of a name in a subdirectory is escaped on its own so the "/" is kept.
+func configFileUrl(configUrl, name string) string {
+	parts := strings.Split(name, "/")
+	for i := range parts {
+		parts[i] = url.PathEscape(parts[i])
+	}
+	return strings.TrimSuffix(configUrl, "/") + "/" + strings.Join(parts, "/")
+}
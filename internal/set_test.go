@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetConfig(t *testing.T) {
+	var ccr ConfigCreateRequest
+	device := ConfigStruct{"other": &ConfigFile{Value: "from fioctl", Unencrypted: true}}
+	status := 201
+	doGet := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPatch:
+			// Like the server, the files are merged into the device's config
+			require.Equal(t, "/", r.URL.Path)
+			body, err := io.ReadAll(r.Body)
+			require.Nil(t, err)
+			require.Nil(t, json.Unmarshal(body, &ccr))
+			if status == 201 {
+				for _, file := range ccr.Files {
+					device[file.Name] = &ConfigFile{Value: file.Value, Unencrypted: file.Unencrypted, OnChanged: file.OnChanged}
+				}
+			}
+		case http.MethodDelete:
+			name := strings.TrimPrefix(r.URL.Path, "/")
+			if _, ok := device[name]; !ok {
+				w.WriteHeader(404)
+				return
+			}
+			if status == 201 {
+				delete(device, name)
+			}
+		}
+		w.WriteHeader(status)
+		_, err := w.Write([]byte("server said ok"))
+		require.Nil(t, err)
+	})
+
+	testWrapper(t, doGet, func(app *App, client *http.Client, tempdir string) {
+		_, crypto := createClient(app.sota)
+		defer crypto.Close()
+
+		res, err := app.SetConfig("secret", []byte("device value"), false, []string{"/usr/bin/true"})
+		require.Nil(t, err)
+		require.Equal(t, "server said ok", res)
+		require.Equal(t, "Set secret from device", ccr.Reason)
+		require.Len(t, ccr.Files, 1)
+		require.Equal(t, "secret", ccr.Files[0].Name)
+		require.False(t, ccr.Files[0].Unencrypted)
+		require.Equal(t, []string{"/usr/bin/true"}, ccr.Files[0].OnChanged)
+		dec, err := crypto.Decrypt(ccr.Files[0].Value)
+		require.Nil(t, err)
+		require.Equal(t, "device value", string(dec))
+
+		// Only the file being set is sent, the rest of the config is kept
+		_, err = app.SetConfig("sub/plain", []byte("plain value"), true, nil)
+		require.Nil(t, err)
+		require.Len(t, ccr.Files, 1)
+		require.Equal(t, "sub/plain", ccr.Files[0].Name)
+		require.Equal(t, "plain value", ccr.Files[0].Value)
+		require.True(t, ccr.Files[0].Unencrypted)
+		require.Len(t, device, 3)
+		require.Equal(t, "from fioctl", device["other"].Value)
+
+		res, err = app.UnsetConfig("sub/plain")
+		require.Nil(t, err)
+		require.Equal(t, "server said ok", res)
+		require.Len(t, device, 2)
+		require.NotContains(t, device, "sub/plain")
+
+		_, err = app.UnsetConfig("sub/plain")
+		require.ErrorContains(t, err, "not in the device's config")
+
+		_, err = app.UnsetConfig("secret")
+		require.Nil(t, err)
+		require.Equal(t, ConfigStruct{"other": &ConfigFile{Value: "from fioctl", Unencrypted: true}}, device)
+
+		_, err = app.SetConfig("../escape", []byte("value"), true, nil)
+		require.NotNil(t, err)
+		_, err = app.UnsetConfig("")
+		require.NotNil(t, err)
+
+		status = 403
+		_, err = app.SetConfig("plain", []byte("value"), true, nil)
+		require.ErrorContains(t, err, "HTTP_403 - server said ok")
+		_, err = app.UnsetConfig("other")
+		require.ErrorContains(t, err, "HTTP_403 - server said ok")
+	})
+}
+
+func TestConfigFileUrl(t *testing.T) {
+	require.Equal(t, "https://gw/config/foo", configFileUrl("https://gw/config", "foo"))
+	require.Equal(t, "https://gw/config/dir/a%20b", configFileUrl("https://gw/config/", "dir/a b"))
+}
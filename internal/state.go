@@ -2,54 +2,38 @@ package internal
 
 import (
 	"context"
-	"encoding/json"
-	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
-	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
-	"github.com/coreos/go-systemd/v22/dbus"
-	"github.com/foundriesio/fioconfig/sotatoml"
+	"github.com/foundriesio/fioconfig/workflow"
 )
 
-type BaseState struct {
-	// A unique ID to identify this operation - RotationId inside a file for backward compatibility
-	CorrelationId string `json:"RotationId"`
-	StepIdx       int
-}
+// BaseState is embedded by the rotation states. Its CorrelationId is stored
+// as RotationId, which older versions of fioconfig wrote state files with.
+type BaseState = workflow.BaseState
 
-type state interface {
-	GetCorrelationId() string
-	GetCurrentStep() int
-	MoveToNextStep() int
-}
+type state = workflow.State
 
-func (s *BaseState) GetCorrelationId() string {
+// defaultCorrelationId gives a rotation started without a correlation ID the
+// same kind of ID older versions of fioconfig did, e.g. "certs-<timestamp>".
+func defaultCorrelationId(s *BaseState, prefix string) string {
 	if len(s.CorrelationId) == 0 {
-		s.CorrelationId = fmt.Sprintf("certs-%d", time.Now().Unix())
+		s.CorrelationId = fmt.Sprintf("%s-%d", prefix, time.Now().Unix())
 		slog.Info("Setting default correlation id", "id", s.CorrelationId)
 	}
 	return s.CorrelationId
 }
 
-func (s *BaseState) GetCurrentStep() int {
-	return s.StepIdx
-}
-
-func (s *BaseState) MoveToNextStep() int {
-	s.StepIdx += 1
-	return s.StepIdx
-}
-
 type stateContext[T state] struct {
 	State     T
 	stateFile string
 	app       *App
 	client    *http.Client
-	crypto    *EciesCrypto
+	crypto    DeviceCryptoHandler
 	eventSync EventSync
 	cienv     bool
 }
@@ -66,25 +50,14 @@ type stateHandler[T state] struct {
 }
 
 func newStateContext[T state](app *App, stateFile string, state T) stateContext[T] {
-	eventUrl := app.sota.GetOrDie("tls.server") + "/events"
-
-	target, err := LoadCurrentTarget(filepath.Join(app.StorageDir, "current-target"))
-	if err != nil {
-		slog.Error("Unable to parse current-target. Events posted to server will be missing content", "error", err)
-	}
-
 	client, crypto := createClient(app.sota)
 	return stateContext[T]{
 		State:     state,
 		stateFile: stateFile,
 		app:       app,
 		client:    client,
-		crypto:    crypto.(*EciesCrypto),
-		eventSync: &DgEventSync{
-			client: client,
-			url:    eventUrl,
-			target: target,
-		},
+		crypto:    crypto,
+		eventSync: newDgEventSync(app, client),
 	}
 }
 
@@ -93,102 +66,69 @@ func (h stateContext[T]) usePkcs11() bool {
 	return h.crypto.UsePkcs11()
 }
 
+func (h *stateContext[T]) store() workflow.FileStore {
+	return workflow.FileStore{Path: h.stateFile}
+}
+
 func (h *stateContext[T]) Save() error {
-	bytes, err := json.Marshal(h.State)
-	if err != nil {
-		return err
-	}
-	return sotatoml.SafeWrite(h.stateFile, bytes)
+	return h.store().Save(h.State)
 }
 
 func (h *stateContext[T]) Restore() (loaded bool) {
-	bytes, err := os.ReadFile(h.stateFile)
+	loaded, err := h.store().Load(&h.State)
 	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return false
-		} else {
-			// Looks like we started a rotation, we should try and finish it
-			slog.Error("Unable to read state file", "file", h.stateFile, "error", err)
-		}
+		// Looks like we started a rotation, we should try and finish it
+		slog.Error("Unable to load state file", "file", h.stateFile, "error", err)
+	}
+	return loaded
+}
+
+// journaled wraps events so they are also written to the workflow journal.
+func (h *stateContext[T]) journaled(events EventSync) EventSync {
+	name, _, _ := strings.Cut(filepath.Base(h.stateFile), ".state")
+	sink := &workflow.JournalSink{
+		Journal:  h.app.Journal(),
+		Workflow: name,
+		Next:     events,
 	}
-	if err = json.Unmarshal(bytes, &h.State); err != nil {
-		slog.Error("Unable to unmarshall state file", "file", h.stateFile, "error", err)
+	if details, ok := any(h.State).(interface{ journalDetails() map[string]string }); ok {
+		sink.Details = details.journalDetails
 	}
-	return true
+	return sink
 }
 
 func (h *stateHandler[T]) execute(startEvent, completeEvent string, restart bool) error {
-	h.eventSync.SetCorrelationId(h.State.GetCorrelationId())
-	var err error
-	defer h.eventSync.Notify(completeEvent, err)
-	h.eventSync.Notify(startEvent, nil)
-
-	// Before we even start - we should save our initial state (ie EstServer)
-	// and also make sure we *can* save our state.
-	if err = h.Save(); err != nil {
-		return fmt.Errorf("Unable to save initial state: %w", err)
+	wf := workflow.Workflow[T, *stateContext[T]]{
+		State:   h.State,
+		Context: &h.stateContext,
+		Store:   h.store(),
+		Events:  h.journaled(h.eventSync),
 	}
-	currentIdx := h.State.GetCurrentStep()
-	for idx, step := range h.steps {
-		if idx < currentIdx {
-			slog.Info("Step already completed", "step", step.Name())
-		} else {
-			slog.Info("Executing step", "step", step.Name())
-			if err = step.Execute(&h.stateContext); err != nil {
-				h.eventSync.Notify(step.Name(), err)
-				return err
-			}
-			currentIdx = h.State.MoveToNextStep()
-			h.eventSync.Notify(step.Name(), nil)
-			if err = h.Save(); err != nil {
-				return fmt.Errorf("Unable to save state: %w", err)
-			}
-		}
+	for _, step := range h.steps {
+		wf.Steps = append(wf.Steps, step)
 	}
-	err = os.Rename(h.stateFile, h.stateFile+".completed")
-
 	if restart {
 		// Restart aklite and fioconfig *after* being "complete".
-		// Otherwise, we could wind up in a loop of:
-		// try-to-complete-rotation, restart-ourself before marking complete.
-		h.RestartServices()
+		wf.OnComplete = append(wf.OnComplete, h.RestartServices)
 	}
-
-	return err
+	return wf.Run(startEvent, completeEvent)
 }
 
+// RestartServices restarts the services configured in sota.toml so they pick
+// up the workflow's changes. A failure is reported as an event rather than
+// ending the process, since the workflow has already completed.
 func (h *stateHandler[T]) RestartServices() {
 	if h.cienv {
 		fmt.Println("Skipping systemctl restarts for CI")
 		return
 	}
 
-	ctx := context.Background()
-	con, err := dbus.NewSystemConnectionContext(ctx)
-	if err != nil {
-		Fatal("Unable to connect to DBUS for service restarts", "error", err)
-	}
-	services := []string{"aktualizr-lite.service", "fioconfig.service"}
-	units, err := con.ListUnitsByNamesContext(ctx, []string{services[0]})
-	if err != nil {
-		Fatal("Unable to query status of units", "error", err)
-	}
-	akliteSvc := units[0]
-	for _, svc := range services {
-		restartChan := make(chan string)
-		if svc == akliteSvc.Name && (akliteSvc.ActiveState == "inactive" || akliteSvc.SubState == "dead") {
-			continue
-		}
-		_, err = con.RestartUnitContext(ctx, svc, "replace", restartChan)
-		if err != nil {
-			Fatal("Unable to restart service", "service", svc, "error", err)
-		}
-		result := <-restartChan
-		switch result {
-		case "done":
-			continue
-		default:
-			Fatal("Error restarting service", "service", svc, "error", result)
-		}
-	}
+	// Failures are reported as they happen, since fioconfig itself may be
+	// one of the services restarted.
+	_ = h.app.restartServices(context.Background(), func(err error) {
+		slog.Error("Unable to restart services", "error", err)
+		events := h.journaled(h.eventSync)
+		events.SetCorrelationId(h.State.GetCorrelationId())
+		events.Notify("ServiceRestartFailed", err)
+	})
 }
@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+)
+
+// writeConfig saves a config to `path`. The content is stored in the format
+// the server sent it in, unless upgrading to the current
+// ConfigDocumentVersion is enabled, and is sealed if configured to.
+func (a *App) writeConfig(crypto DeviceCryptoHandler, path string, content []byte) error {
+	var err error
+	if a.upgradeConfig {
+		if content, _, err = upgradeDocument(content); err != nil {
+			return err
+		}
+	}
+	if a.sealConfig {
+		if content, err = sealConfig(crypto, content); err != nil {
+			return err
+		}
+	}
+	return sotatoml.SafeWrite(path, content)
+}
+
+// migrateStoredConfig brings an existing config.encrypted up to date with
+// how this version of fioconfig is configured to store it: sealed or
+// unsealed, and in the current document version when upgrading is enabled.
+// Older versions of fioconfig can't read an upgraded document, so it's left
+// in the format the server sent by default. The file's modification time
+// is kept since it is used for the If-Modified-Since header when checking in.
+func (a *App) migrateStoredConfig(crypto DeviceCryptoHandler) error {
+	content, err := os.ReadFile(a.EncryptedConfig)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	sealed := isSealed(content)
+	if sealed {
+		if content, err = unsealConfig(crypto, content); err != nil {
+			return err
+		}
+	}
+	upgraded := false
+	if a.upgradeConfig {
+		if _, upgraded, err = upgradeDocument(content); err != nil {
+			return err
+		}
+	}
+	if !upgraded && sealed == a.sealConfig {
+		return nil
+	}
+	fi, err := os.Stat(a.EncryptedConfig)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Migrating stored config", "path", a.EncryptedConfig, "upgraded", upgraded, "sealed", a.sealConfig)
+	if err = a.writeConfig(crypto, a.EncryptedConfig, content); err != nil {
+		return err
+	}
+	return os.Chtimes(a.EncryptedConfig, fi.ModTime(), fi.ModTime())
+}
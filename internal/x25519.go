@@ -0,0 +1,165 @@
+package internal
+
+import (
+	"crypto"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"runtime"
+)
+
+const x25519KeySize = 32
+
+// X25519Crypto handles config values for devices with file based Ed25519
+// keys. Ed25519 keys can only sign, so values are encrypted to the X25519
+// form of the key (RFC 7748 / RFC 8032 map the same secret to both curves):
+//
+//	base64(ephemeral X25519 public key | GCM nonce | AES-256-GCM ciphertext)
+//
+// The AES key is SHA-256(shared secret | ephemeral public | device public).
+type X25519Crypto struct {
+	PrivKey *ecdh.PrivateKey
+	signer  ed25519.PrivateKey
+}
+
+func NewX25519LocalHandler(privKey ed25519.PrivateKey) (*X25519Crypto, error) {
+	// This is the same derivation libsodium uses in
+	// crypto_sign_ed25519_sk_to_curve25519. Clamping happens in ecdh.
+	digest := sha512.Sum512(privKey.Seed())
+	key, err := ecdh.X25519().NewPrivateKey(digest[:x25519KeySize])
+	if err != nil {
+		return nil, fmt.Errorf("Unable to derive X25519 key: %w", err)
+	}
+	return &X25519Crypto{key, privKey}, nil
+}
+
+func (x *X25519Crypto) Decrypt(value string) ([]byte, error) {
+	value, err := untagValue(x.Public(), value)
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to base64 decode: %v", err)
+	}
+	if len(data) < x25519KeySize {
+		return nil, errors.New("Unable to X25519 decrypt: value is too short")
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(data[:x25519KeySize])
+	if err != nil {
+		return nil, fmt.Errorf("Unable to X25519 decrypt %v", err)
+	}
+	gcm, err := x25519Gcm(x.PrivKey, ephemeral, x.PrivKey.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+	data = data[x25519KeySize:]
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("Unable to X25519 decrypt: value is too short")
+	}
+	decrypted, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to X25519 decrypt %v", err)
+	}
+	return decrypted, nil
+}
+
+func (x *X25519Crypto) Encrypt(value string) (string, error) {
+	return x25519Encrypt(x.PrivKey.PublicKey(), []byte(value))
+}
+
+// Public returns the device's Ed25519 public key since that is what
+// identifies the device to the server.
+func (x *X25519Crypto) Public() crypto.PublicKey {
+	return x.signer.Public()
+}
+
+func (x *X25519Crypto) UsePkcs11() bool {
+	return false
+}
+
+// Concurrency returns how many values can be decrypted at once
+func (x *X25519Crypto) Concurrency() int {
+	return runtime.NumCPU()
+}
+
+func (x *X25519Crypto) DeleteKeyPair(id []byte, label []byte) error {
+	return ErrNoPkcs11
+}
+
+func (x *X25519Crypto) DeleteCertificate(id []byte, label []byte, serial *big.Int) error {
+	return ErrNoPkcs11
+}
+
+func (x *X25519Crypto) ImportCertificateWithLabel(id []byte, label []byte, certificate *x509.Certificate) error {
+	return ErrNoPkcs11
+}
+
+func (x *X25519Crypto) GenerateKeyPair(id []byte, label []byte, curve elliptic.Curve) (crypto.Signer, error) {
+	return nil, ErrNoPkcs11
+}
+
+func (x *X25519Crypto) FindTlsCertificate(keyId []byte, certId []byte) (tls.Certificate, error) {
+	return tls.Certificate{}, ErrNoPkcs11
+}
+
+func (x *X25519Crypto) ImportKeyPair(id []byte, label []byte, key crypto.PrivateKey) error {
+	return ErrNoPkcs11
+}
+
+func (x *X25519Crypto) HasKeyPair(id []byte) (bool, error) {
+	return false, ErrNoPkcs11
+}
+
+func (x *X25519Crypto) HasCertificate(id []byte) (bool, error) {
+	return false, ErrNoPkcs11
+}
+
+func (x *X25519Crypto) Close() {
+}
+
+func x25519Encrypt(pub *ecdh.PublicKey, value []byte) (string, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := x25519Gcm(ephemeral, ephemeral.PublicKey(), pub)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	enc := append(ephemeral.PublicKey().Bytes(), nonce...)
+	enc = gcm.Seal(enc, nonce, value, nil)
+	return base64.StdEncoding.EncodeToString(enc), nil
+}
+
+// x25519Gcm performs the ECDH exchange between `priv` and the other party's
+// public key and returns the AEAD keyed from the result.
+func x25519Gcm(priv *ecdh.PrivateKey, ephemeral, device *ecdh.PublicKey) (cipher.AEAD, error) {
+	peer := device
+	if priv.PublicKey().Equal(device) {
+		peer = ephemeral
+	}
+	shared, err := priv.ECDH(peer)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to compute X25519 shared secret: %w", err)
+	}
+	h := sha256.New()
+	h.Write(shared)
+	h.Write(ephemeral.Bytes())
+	h.Write(device.Bytes())
+	return newGcm(h.Sum(nil))
+}
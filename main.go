@@ -3,11 +3,15 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"sort"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/foundriesio/fioconfig/app"
@@ -34,14 +38,19 @@ func NewApp(c *cli.Context) (*internal.App, error) {
 	if err != nil {
 		return nil, err
 	}
-	if c.Command.Name == "renew-cert" {
+	switch c.Command.Name {
+	case "renew-cert", "rotate-ca", "cleanup-certs", "rotation-status", "inspect", "pubkey", "encrypt", "set", "unset":
 		return app, nil
 	}
 	stateFile := filepath.Join(app.StorageDir, "cert-rotation.state")
+	online := c.Command.Name != "extract"
 	handler := internal.RestoreCertRotationHandler(app, stateFile)
 	if handler != nil {
-		online := c.Command.Name != "extract"
 		err = handler.ResumeRotation(online)
+	} else if online {
+		if err := internal.CheckCertRotationHealth(app, stateFile); err != nil {
+			slog.Error("Unable to check health of certificate rotation", "error", err)
+		}
 	}
 	return app, err
 }
@@ -69,6 +78,119 @@ func extract(c *cli.Context) error {
 	return nil
 }
 
+func inspect(c *cli.Context) error {
+	app, err := NewApp(c)
+	if err != nil {
+		return err
+	}
+
+	config, err := app.Inspect()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(config))
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tENCRYPTED\tLAYER\tOVERRIDES")
+	for _, name := range names {
+		cfgFile := config[name]
+		layer := cfgFile.Layer
+		if len(layer) == 0 {
+			layer = "-"
+		}
+		overrides := strings.Join(cfgFile.Overrides, ",")
+		if len(overrides) == 0 {
+			overrides = "-"
+		}
+		fmt.Fprintf(w, "%s\t%t\t%s\t%s\n", name, !cfgFile.Unencrypted, layer, overrides)
+	}
+	return w.Flush()
+}
+
+func pubkey(c *cli.Context) error {
+	app, err := NewApp(c)
+	if err != nil {
+		return err
+	}
+	pubPem, err := app.PublicKeyPem()
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(pubPem)
+	return err
+}
+
+func encrypt(c *cli.Context) error {
+	app, err := NewApp(c)
+	if err != nil {
+		return err
+	}
+	var pubPem []byte
+	if path := c.String("pubkey"); len(path) > 0 {
+		if pubPem, err = os.ReadFile(path); err != nil {
+			return fmt.Errorf("Unable to read public key: %w", err)
+		}
+	}
+	value, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("Unable to read value from stdin: %w", err)
+	}
+	enc, err := app.Encrypt(value, pubPem)
+	if err != nil {
+		return err
+	}
+	fmt.Println(enc)
+	return nil
+}
+
+func setConfig(c *cli.Context) error {
+	name := c.Args().First()
+	if c.NArg() != 1 {
+		cli.ShowCommandHelpAndExit(c, "set", 1)
+	}
+	app, err := NewApp(c)
+	if err != nil {
+		return err
+	}
+
+	var value []byte
+	if path := c.String("file"); len(path) > 0 {
+		value, err = os.ReadFile(path)
+	} else {
+		value, err = io.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to read value: %w", err)
+	}
+	onChanged := strings.Fields(c.String("on-changed"))
+	res, err := app.SetConfig(name, value, c.Bool("unencrypted"), onChanged)
+	if err != nil {
+		return err
+	}
+	slog.Info("Config updated", "file", name, "response", res)
+	return nil
+}
+
+func unsetConfig(c *cli.Context) error {
+	name := c.Args().First()
+	if c.NArg() != 1 {
+		cli.ShowCommandHelpAndExit(c, "unset", 1)
+	}
+	app, err := NewApp(c)
+	if err != nil {
+		return err
+	}
+	res, err := app.UnsetConfig(name)
+	if err != nil {
+		return err
+	}
+	slog.Info("Config removed", "file", name, "response", res)
+	return nil
+}
+
 func checkin(c *cli.Context) error {
 	app, err := NewApp(c)
 	if err != nil {
@@ -79,7 +201,7 @@ func checkin(c *cli.Context) error {
 	if _, err := app.CheckIn(); err != nil && !errors.Is(err, internal.NotModifiedError) {
 		return err
 	}
-	return nil
+	return app.RenewCertIfRequested()
 }
 
 func daemon(c *cli.Context) error {
@@ -88,12 +210,24 @@ func daemon(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	stateFile := filepath.Join(app.StorageDir, "cert-rotation.state")
 	slog.Info("Running as daemon", "interval", c.Int("interval"))
 	for {
 		slog.Info("Checking in with server")
 		if _, err := app.CheckIn(); err != nil && !errors.Is(err, internal.NotModifiedError) {
 			slog.Error("Check-in failed", "error", err)
 		}
+		if err := app.RenewCertIfRequested(); err != nil {
+			slog.Error("Requested certificate renewal failed", "error", err)
+		}
+		if err := app.RenewCertIfDue(); err != nil {
+			slog.Error("Automatic certificate renewal failed", "error", err)
+		}
+		// Retried until the server accepts the rotated credentials or the
+		// device has fully reverted to its previous ones
+		if err := internal.CheckCertRotationHealth(app, stateFile); err != nil {
+			slog.Error("Unable to check health of certificate rotation", "error", err)
+		}
 		time.Sleep(interval)
 	}
 }
@@ -103,17 +237,47 @@ func renewCert(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	stateFile := filepath.Join(app.StorageDir, "cert-rotation.state")
+	if c.Bool("abort") {
+		handler := internal.RestoreCertRotationHandler(app, stateFile)
+		if handler == nil {
+			return errors.New("No certificate rotation in progress")
+		}
+		slog.Info("Aborting certificate rotation", "id", handler.State.CorrelationId)
+		return handler.Abort()
+	}
+
 	if c.NArg() != 1 && c.NArg() != 2 {
 		cli.ShowCommandHelpAndExit(c, "renew-cert", 1)
 	}
 	server := c.Args().Get(0)
-	stateFile := filepath.Join(app.StorageDir, "cert-rotation.state")
 	handler := internal.NewCertRotationHandler(app, stateFile, server)
 	idsStr := c.String("pkcs11-key-ids")
 	handler.State.PkeySlotIds = strings.Split(idsStr, ",")
 	idsStr = c.String("pkcs11-cert-ids")
 	handler.State.CertSlotIds = strings.Split(idsStr, ",")
 
+	if keyType := c.String("key-type"); len(keyType) > 0 {
+		if !slices.Contains(internal.KeyTypes, keyType) {
+			return fmt.Errorf("Invalid key type: %s, must be one of: %s", keyType, strings.Join(internal.KeyTypes, ", "))
+		}
+		handler.State.KeyType = keyType
+	}
+
+	if protocol := c.String("protocol"); len(protocol) > 0 {
+		if !slices.Contains(internal.EnrollProtocols, protocol) {
+			return fmt.Errorf("Invalid protocol: %s, must be one of: %s", protocol, strings.Join(internal.EnrollProtocols, ", "))
+		}
+		handler.State.Protocol = protocol
+	}
+
+	handler.State.UpdateCaCerts = c.Bool("update-ca-certs")
+	handler.State.ServerKeyGen = c.Bool("server-keygen")
+
+	if c.Bool("check") {
+		return preflight(handler)
+	}
+
 	if c.NArg() == 2 {
 		handler.State.CorrelationId = c.Args().Get(1)
 	}
@@ -125,6 +289,140 @@ func renewCert(c *cli.Context) error {
 	return err
 }
 
+func preflight(handler *internal.CertRotationHandler) error {
+	failed := false
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CHECK\tRESULT")
+	for _, result := range handler.Preflight() {
+		status := "ok"
+		if result.Err != nil {
+			status = result.Err.Error()
+			failed = true
+		}
+		fmt.Fprintf(w, "%s\t%s\n", result.Check, status)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if failed {
+		return errors.New("Pre-flight checks failed")
+	}
+	return nil
+}
+
+func rotateCa(c *cli.Context) error {
+	app, err := NewApp(c)
+	if err != nil {
+		return err
+	}
+	if c.NArg() > 1 {
+		cli.ShowCommandHelpAndExit(c, "rotate-ca", 1)
+	}
+	stateFile := filepath.Join(app.StorageDir, "ca-rotation.state")
+	handler := internal.RestoreCaRotationHandler(app, stateFile)
+	if handler != nil {
+		slog.Warn("Incomplete CA rotation state found. Will attempt to complete")
+	} else {
+		handler = internal.NewCaRotationHandler(app, stateFile, c.Args().First())
+	}
+
+	slog.Info("Performing CA rotation")
+	if err = handler.Rotate(); err == nil {
+		slog.Info("CA rotation sequence complete")
+	}
+	return err
+}
+
+func cleanupCerts(c *cli.Context) error {
+	app, err := NewApp(c)
+	if err != nil {
+		return err
+	}
+	keep := -1
+	if c.IsSet("keep") {
+		keep = c.Int("keep")
+		if keep < 0 {
+			return fmt.Errorf("Invalid value for --keep: %d", keep)
+		}
+	}
+	stateFile := filepath.Join(app.StorageDir, "cert-rotation.state")
+	dryRun := c.Bool("dry-run")
+	superseded, err := app.CleanupSupersededCredentials(stateFile, keep, dryRun)
+	if err != nil {
+		return err
+	}
+	for _, cred := range superseded {
+		if dryRun {
+			fmt.Println("Would remove", cred)
+		} else {
+			fmt.Println("Removed", cred)
+		}
+	}
+	return nil
+}
+
+func rotationStatus(c *cli.Context) error {
+	app, err := NewApp(c)
+	if err != nil {
+		return err
+	}
+	if c.NArg() > 1 {
+		cli.ShowCommandHelpAndExit(c, "rotation-status", 1)
+	}
+	runs, err := app.WorkflowRuns()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if id := c.Args().First(); len(id) > 0 {
+		found := false
+		fmt.Fprintln(w, "TIME\tEVENT\tERROR\tDETAILS")
+		for _, run := range runs {
+			if run.CorrelationId != id {
+				continue
+			}
+			found = true
+			for _, entry := range run.Entries {
+				details := make([]string, 0, len(entry.Details))
+				for k, v := range entry.Details {
+					details = append(details, k+"="+v)
+				}
+				sort.Strings(details)
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", entry.Time.Format(time.RFC3339), entry.Event, orDash(entry.Error), orDash(strings.Join(details, " ")))
+			}
+		}
+		if !found {
+			return fmt.Errorf("No rotation found with id: %s", id)
+		}
+		return w.Flush()
+	}
+
+	fmt.Fprintln(w, "ID\tWORKFLOW\tSTARTED\tUPDATED\tSTATUS\tLAST EVENT\tERROR")
+	for _, run := range runs {
+		status := "done"
+		if run.InProgress {
+			status = "in progress"
+		} else if len(run.Error) > 0 {
+			status = "failed"
+		}
+		started, updated := "-", "-"
+		if !run.Started.IsZero() {
+			started = run.Started.Format(time.RFC3339)
+			updated = run.Updated.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", run.CorrelationId, run.Workflow, started, updated, status, orDash(run.LastEvent), orDash(run.Error))
+	}
+	return w.Flush()
+}
+
+func orDash(val string) string {
+	if len(val) == 0 {
+		return "-"
+	}
+	return val
+}
+
 func runAndReport(c *cli.Context) error {
 	testId := c.String("id")
 	testName := c.String("name")
@@ -186,6 +484,33 @@ func main() {
 					return extract(c)
 				},
 			},
+			{
+				Name:  "inspect",
+				Usage: "List the files in the stored config and the layers they came from",
+				Action: func(c *cli.Context) error {
+					return inspect(c)
+				},
+			},
+			{
+				Name:  "pubkey",
+				Usage: "Print the PEM encoded public key that config values are encrypted to",
+				Action: func(c *cli.Context) error {
+					return pubkey(c)
+				},
+			},
+			{
+				Name:  "encrypt",
+				Usage: "Encrypt stdin to this device's key the same way the server does",
+				Action: func(c *cli.Context) error {
+					return encrypt(c)
+				},
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "pubkey",
+						Usage: "Encrypt to the PEM public key or certificate in this file instead",
+					},
+				},
+			},
 			{
 				Name:  "check-in",
 				Usage: "Check in with the server and update the local config",
@@ -193,6 +518,36 @@ func main() {
 					return checkin(c)
 				},
 			},
+			{
+				Name:     "set",
+				HelpName: "set <name>",
+				Usage:    "Publish a value read from stdin to this device's config",
+				Action: func(c *cli.Context) error {
+					return setConfig(c)
+				},
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "file",
+						Usage: "Read the value from this file instead of stdin",
+					},
+					&cli.BoolFlag{
+						Name:  "unencrypted",
+						Usage: "Store the value unencrypted. By default it is encrypted with the device key",
+					},
+					&cli.StringFlag{
+						Name:  "on-changed",
+						Usage: "Command to run on the device when the value changes",
+					},
+				},
+			},
+			{
+				Name:     "unset",
+				HelpName: "unset <name>",
+				Usage:    "Remove a file from this device's config",
+				Action: func(c *cli.Context) error {
+					return unsetConfig(c)
+				},
+			},
 			{
 				Name:  "daemon",
 				Usage: "Run check-in's with the server in an endless loop",
@@ -211,7 +566,7 @@ func main() {
 			},
 			{
 				Name:     "renew-cert",
-				HelpName: "renew-cert <EST Server> [<rotation-id>]",
+				HelpName: "renew-cert <EST or SCEP Server> [<rotation-id>] | renew-cert --check <EST or SCEP Server> | renew-cert --abort",
 				Usage:    "Renew device's TLS keypair used with device-gateway",
 				Action: func(c *cli.Context) error {
 					return renewCert(c)
@@ -219,14 +574,71 @@ func main() {
 				Flags: []cli.Flag{
 					&cli.StringFlag{
 						Name:  "pkcs11-key-ids",
-						Value: "01,07",
+						Value: internal.DefaultPkcs11KeyIds,
 						Usage: "The two pkcs11 slot IDs to use for private keys",
 					},
 					&cli.StringFlag{
 						Name:  "pkcs11-cert-ids",
-						Value: "03,09",
+						Value: internal.DefaultPkcs11CertIds,
 						Usage: "The two pkcs11 slot IDs to use for client certificates",
 					},
+					&cli.StringFlag{
+						Name:  "key-type",
+						Usage: "Type of key to generate: p256, p384, rsa, or ed25519 (file based keys only). Defaults to the current key's type",
+					},
+					&cli.StringFlag{
+						Name:  "protocol",
+						Usage: "Enrollment protocol: est or scep. Defaults to est unless the server URL starts with scep+",
+					},
+					&cli.BoolFlag{
+						Name:  "check",
+						Usage: "Only run the pre-flight checks a rotation starts with and report the results",
+					},
+					&cli.BoolFlag{
+						Name:  "abort",
+						Usage: "Abort an incomplete rotation and remove the key material it generated",
+					},
+					&cli.BoolFlag{
+						Name:  "update-ca-certs",
+						Usage: "Add the server's CA certificates to the device's CA bundle",
+					},
+					&cli.BoolFlag{
+						Name:  "server-keygen",
+						Usage: "Have the EST server generate the new key with /serverkeygen",
+					},
+				},
+			},
+			{
+				Name:     "rotate-ca",
+				HelpName: "rotate-ca [<EST Server>]",
+				Usage:    "Add a new CA bundle for the device-gateway from the EST server or the fio-ca-bundle config entry",
+				Action: func(c *cli.Context) error {
+					return rotateCa(c)
+				},
+			},
+			{
+				Name:  "cleanup-certs",
+				Usage: "Remove keys and certificates superseded by certificate rotations",
+				Action: func(c *cli.Context) error {
+					return cleanupCerts(c)
+				},
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "List what would be removed without removing it",
+					},
+					&cli.IntFlag{
+						Name:  "keep",
+						Usage: "Number of superseded keys and certificates to retain. Defaults to fioconfig.rotation_keep from sota.toml, or 1",
+					},
+				},
+			},
+			{
+				Name:     "rotation-status",
+				HelpName: "rotation-status [<rotation-id>]",
+				Usage:    "Show current and past certificate and CA rotations, or the events of one rotation",
+				Action: func(c *cli.Context) error {
+					return rotationStatus(c)
 				},
 			},
 			{
@@ -18,7 +18,10 @@ var DEF_CONFIG_ORDER = []string{
 	"/etc/sota/conf.d/",
 }
 
-var ErrNoWritableFound = errors.New("no writable TOML file found")
+var (
+	ErrNoWritableFound = errors.New("no writable TOML file found")
+	ErrConfigManaged   = errors.New("unable to override config-managed file")
+)
 
 type cfgFile struct {
 	name string
@@ -166,7 +169,7 @@ func (c AppConfig) findWritableFile(keyVals map[string]string) (*cfgFile, error)
 		for k := range keyVals {
 			if c.cfgs[i].tree.Has(k) {
 				if isConfigManaged(c.cfgs[i].name) {
-					return nil, fmt.Errorf("unable to override config-managed file: %s", c.cfgs[i].path)
+					return nil, fmt.Errorf("%w: %s", ErrConfigManaged, c.cfgs[i].path)
 				}
 
 				if !isWritable(c.cfgs[i].path) {
@@ -186,6 +189,17 @@ func (c AppConfig) findWritableFile(keyVals map[string]string) (*cfgFile, error)
 	return nil, ErrNoWritableFound
 }
 
+// CheckWritable returns the error UpdateKeys would fail with when updating
+// the keys, without changing anything.
+func (c AppConfig) CheckWritable(keys ...string) error {
+	keyVals := make(map[string]string, len(keys))
+	for _, k := range keys {
+		keyVals[k] = ""
+	}
+	_, err := c.findWritableFile(keyVals)
+	return err
+}
+
 func (c AppConfig) UpdateKeys(keyVals map[string]string) error {
 	cfgFile, err := c.findWritableFile(keyVals)
 	if err != nil {
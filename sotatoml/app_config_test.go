@@ -67,6 +67,8 @@ key = "val"`
 		"updates.key": "this must fail",
 	}
 	require.NotNil(t, cfg.UpdateKeys(keyvals))
+	require.ErrorIs(t, cfg.CheckWritable("updates.key"), ErrConfigManaged)
+	require.Nil(t, cfg.CheckWritable("main.bar"))
 
 	// We must reject a keyval that does not exist - this api is for *updates* only
 	keyvals = map[string]string{
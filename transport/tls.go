@@ -5,6 +5,7 @@ import (
 	"crypto/x509"
 	"fmt"
 	"os"
+	"strconv"
 
 	"github.com/foundriesio/fioconfig/sotatoml"
 )
@@ -63,3 +64,15 @@ func loadCertLocal(cfg *sotatoml.AppConfig) (tls.Certificate, error) {
 	}
 	return tls.LoadX509KeyPair(certFile, keyFile)
 }
+
+// Pkcs11MaxSessions returns the maximum number of PKCS#11 sessions fioconfig
+// may open from `fioconfig.p11_max_sessions`. crypto11 keeps one session for
+// itself, so the minimum (and default) is 2.
+func Pkcs11MaxSessions(cfg *sotatoml.AppConfig) int {
+	val := cfg.GetDefault("fioconfig.p11_max_sessions", "2")
+	sessions, err := strconv.Atoi(val)
+	if err != nil || sessions < 2 {
+		return 2
+	}
+	return sessions
+}
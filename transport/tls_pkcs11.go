@@ -24,7 +24,7 @@ func loadCertPkcs11(cfg *sotatoml.AppConfig) (*crypto11.Context, tls.Certificate
 		Path:        module,
 		TokenLabel:  cfg.GetDefault("p11.label", "aktualizr"),
 		Pin:         pin,
-		MaxSessions: 2,
+		MaxSessions: Pkcs11MaxSessions(cfg),
 	}
 
 	ctx, err := crypto11.Configure(&c11)
@@ -0,0 +1,113 @@
+package workflow
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// JournalEntry records one event of a workflow execution.
+type JournalEntry struct {
+	Time          time.Time
+	Workflow      string
+	CorrelationId string
+	Event         string
+	Error         string            `json:",omitempty"`
+	Details       map[string]string `json:",omitempty"`
+}
+
+// Journal is an append-only history of workflow executions kept as one JSON
+// entry per line in Path. Unlike the state of a workflow, which is replaced
+// by the next execution, the journal keeps every execution.
+type Journal struct {
+	Path string
+}
+
+// Append adds an entry to the end of the journal.
+func (j Journal) Append(entry JournalEntry) error {
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(j.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(buf, '\n')); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Read returns the journal's entries, oldest first. A line that can't be
+// parsed, like one cut short by a power failure, is skipped.
+func (j Journal) Read() ([]JournalEntry, error) {
+	f, err := os.Open(j.Path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			slog.Warn("Skipping invalid journal entry", "path", j.Path, "error", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// JournalSink is an EventSink that writes every event to a Journal before
+// passing it on to Next. Details, if set, is called for each event to record
+// identifiers such as the keys a workflow works with.
+type JournalSink struct {
+	Journal  Journal
+	Workflow string
+	Next     EventSink
+	Details  func() map[string]string
+
+	corId string
+}
+
+func (s *JournalSink) Notify(name string, err error) {
+	entry := JournalEntry{
+		Time:          time.Now().UTC(),
+		Workflow:      s.Workflow,
+		CorrelationId: s.corId,
+		Event:         name,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if s.Details != nil {
+		entry.Details = s.Details()
+	}
+	// The journal is for reference. Failing to write it must not fail the workflow
+	if journalErr := s.Journal.Append(entry); journalErr != nil {
+		slog.Warn("Unable to write journal entry", "path", s.Journal.Path, "error", journalErr)
+	}
+	if s.Next != nil {
+		s.Next.Notify(name, err)
+	}
+}
+
+func (s *JournalSink) SetCorrelationId(corId string) {
+	s.corId = corId
+	if s.Next != nil {
+		s.Next.SetCorrelationId(corId)
+	}
+}
@@ -0,0 +1,68 @@
+package workflow
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournal(t *testing.T) {
+	tmpdir := t.TempDir()
+	journal := Journal{Path: filepath.Join(tmpdir, "journal")}
+	entries, err := journal.Read()
+	require.Nil(t, err)
+	require.Len(t, entries, 0)
+
+	next := &testSink{}
+	sink := &JournalSink{
+		Journal:  journal,
+		Workflow: "test",
+		Next:     next,
+		Details:  func() map[string]string { return map[string]string{"key": "slot-07"} },
+	}
+	for i, fail := range []bool{false, true} {
+		state := &testState{BaseState: BaseState{CorrelationId: []string{"run-1", "run-2"}[i]}}
+		ctx := &testContext{state: state}
+		if fail {
+			ctx.fail = map[string]error{"two": errors.New("step two failed")}
+		}
+		wf := Workflow[*testState, *testContext]{
+			State:   state,
+			Context: ctx,
+			Steps:   []Step[*testContext]{testStep("one"), testStep("two")},
+			Store:   FileStore{Path: filepath.Join(tmpdir, "test.state")},
+			Events:  sink,
+		}
+		_ = wf.Run("started", "completed")
+	}
+	require.Equal(t, "run-2", next.corId)
+	require.Len(t, next.events, 8)
+
+	// A partial line from a power failure is skipped
+	f, err := os.OpenFile(journal.Path, os.O_APPEND|os.O_WRONLY, 0)
+	require.Nil(t, err)
+	_, err = f.WriteString("{\"Time\":")
+	require.Nil(t, err)
+	require.Nil(t, f.Close())
+
+	entries, err = journal.Read()
+	require.Nil(t, err)
+	require.Len(t, entries, 8)
+	var events []string
+	for _, entry := range entries {
+		require.Equal(t, "test", entry.Workflow)
+		require.Equal(t, "slot-07", entry.Details["key"])
+		require.False(t, entry.Time.IsZero())
+		events = append(events, entry.CorrelationId+":"+entry.Event)
+	}
+	require.Equal(t, []string{
+		"run-1:started", "run-1:one", "run-1:two", "run-1:completed",
+		"run-2:started", "run-2:one", "run-2:two", "run-2:completed",
+	}, events)
+	require.Equal(t, "step two failed", entries[6].Error)
+	require.Equal(t, "step two failed", entries[7].Error)
+	require.Equal(t, "", entries[3].Error)
+}
@@ -0,0 +1,55 @@
+package workflow
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+
+	"github.com/foundriesio/fioconfig/sotatoml"
+)
+
+// Store persists the state of a workflow.
+type Store interface {
+	// Save atomically replaces the stored state.
+	Save(state any) error
+	// Load reads the stored state into state. It returns false if there is
+	// no stored state.
+	Load(state any) (bool, error)
+	// Complete marks the stored state as completed so it is no longer
+	// loaded.
+	Complete() error
+}
+
+// FileStore stores the state as JSON in Path. Completed states are kept for
+// reference with a `.completed` suffix.
+type FileStore struct {
+	Path string
+}
+
+func (s FileStore) Save(state any) error {
+	bytes, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return sotatoml.SafeWrite(s.Path, bytes)
+}
+
+func (s FileStore) Load(state any) (bool, error) {
+	bytes, err := os.ReadFile(s.Path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return true, err
+	}
+	return true, json.Unmarshal(bytes, state)
+}
+
+func (s FileStore) Complete() error {
+	return s.Archive(".completed")
+}
+
+// Archive moves the stored state aside by adding suffix to its name.
+func (s FileStore) Archive(suffix string) error {
+	return os.Rename(s.Path, s.Path+suffix)
+}
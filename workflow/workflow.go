@@ -0,0 +1,123 @@
+// Package workflow runs resumable, multi-step device operations. The state of
+// a workflow is persisted after every step so that a workflow interrupted by
+// a crash or power failure can be resumed from the step it got to. Progress
+// is reported as events, which fioconfig sends to the device-gateway.
+package workflow
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// State is the persisted state of a workflow. Workflows typically embed
+// BaseState in their own state struct and add the fields their steps need.
+type State interface {
+	GetCorrelationId() string
+	GetCurrentStep() int
+	MoveToNextStep() int
+}
+
+type BaseState struct {
+	// A unique ID to identify this operation in events. It is stored as
+	// RotationId, the name fioconfig's certificate rotations have always
+	// used, so their state files stay compatible.
+	CorrelationId string `json:"RotationId"`
+	StepIdx       int
+}
+
+func (s *BaseState) GetCorrelationId() string {
+	if len(s.CorrelationId) == 0 {
+		s.CorrelationId = fmt.Sprintf("workflow-%d", time.Now().Unix())
+		slog.Info("Setting default correlation id", "id", s.CorrelationId)
+	}
+	return s.CorrelationId
+}
+
+func (s *BaseState) GetCurrentStep() int {
+	return s.StepIdx
+}
+
+func (s *BaseState) MoveToNextStep() int {
+	s.StepIdx += 1
+	return s.StepIdx
+}
+
+// Step is one unit of work in a workflow. A step may be executed again if
+// the device loses power before the workflow records it as done, so it must
+// be safe to re-run. C is whatever context the workflow's steps share.
+type Step[C any] interface {
+	Name() string
+	Execute(C) error
+}
+
+// EventSink receives the events a workflow emits.
+type EventSink interface {
+	Notify(name string, err error)
+	SetCorrelationId(corId string)
+}
+
+type NoOpEventSink struct{}
+
+func (s NoOpEventSink) Notify(name string, err error) {}
+func (s NoOpEventSink) SetCorrelationId(corId string) {}
+
+// Workflow executes Steps in order, persisting State to Store after each one.
+type Workflow[S State, C any] struct {
+	State   S
+	Context C
+	Steps   []Step[C]
+	Store   Store
+	Events  EventSink
+
+	// OnComplete actions run after the workflow's state has been marked as
+	// completed. Doing things like restarting services here rather than in a
+	// step avoids getting into a loop of: try-to-complete, restart, resume.
+	OnComplete []func()
+}
+
+// Run executes the steps that have not been completed yet. It emits
+// startEvent, an event named after each step executed, and completeEvent
+// with the final result.
+func (w *Workflow[S, C]) Run(startEvent, completeEvent string) (err error) {
+	events := w.Events
+	if events == nil {
+		events = NoOpEventSink{}
+	}
+	events.SetCorrelationId(w.State.GetCorrelationId())
+	defer func() {
+		events.Notify(completeEvent, err)
+	}()
+	events.Notify(startEvent, nil)
+
+	// Before we even start - we should save our initial state and also make
+	// sure we *can* save our state.
+	if err = w.Store.Save(w.State); err != nil {
+		return fmt.Errorf("Unable to save initial state: %w", err)
+	}
+	currentIdx := w.State.GetCurrentStep()
+	for idx, step := range w.Steps {
+		if idx < currentIdx {
+			slog.Info("Step already completed", "step", step.Name())
+			continue
+		}
+		slog.Info("Executing step", "step", step.Name())
+		if err = step.Execute(w.Context); err != nil {
+			events.Notify(step.Name(), err)
+			return err
+		}
+		currentIdx = w.State.MoveToNextStep()
+		events.Notify(step.Name(), nil)
+		if err = w.Store.Save(w.State); err != nil {
+			return fmt.Errorf("Unable to save state: %w", err)
+		}
+	}
+	if err = w.Store.Complete(); err != nil {
+		return fmt.Errorf("Unable to mark workflow complete: %w", err)
+	}
+
+	for _, action := range w.OnComplete {
+		action()
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package workflow
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testState struct {
+	BaseState
+	Ran []string
+}
+
+type testContext struct {
+	state *testState
+	fail  map[string]error
+}
+
+type testStep string
+
+func (s testStep) Name() string {
+	return string(s)
+}
+
+func (s testStep) Execute(c *testContext) error {
+	if err := c.fail[string(s)]; err != nil {
+		return err
+	}
+	c.state.Ran = append(c.state.Ran, string(s))
+	return nil
+}
+
+type testEvent struct {
+	name string
+	err  error
+}
+
+type testSink struct {
+	corId  string
+	events []testEvent
+}
+
+func (s *testSink) Notify(name string, err error) {
+	s.events = append(s.events, testEvent{name, err})
+}
+
+func (s *testSink) SetCorrelationId(corId string) {
+	s.corId = corId
+}
+
+func TestWorkflow(t *testing.T) {
+	store := FileStore{Path: filepath.Join(t.TempDir(), "test.state")}
+	state := &testState{BaseState: BaseState{CorrelationId: "test-1"}}
+	ctx := &testContext{state: state, fail: map[string]error{"two": errors.New("step two failed")}}
+	sink := &testSink{}
+	completed := 0
+	wf := Workflow[*testState, *testContext]{
+		State:      state,
+		Context:    ctx,
+		Steps:      []Step[*testContext]{testStep("one"), testStep("two"), testStep("three")},
+		Store:      store,
+		Events:     sink,
+		OnComplete: []func(){func() { completed++ }},
+	}
+
+	// A failed step leaves the state behind so it can be resumed
+	err := wf.Run("Started", "Completed")
+	require.Equal(t, ctx.fail["two"], err)
+	require.Equal(t, "test-1", sink.corId)
+	require.Equal(t, []testEvent{
+		{"Started", nil},
+		{"one", nil},
+		{"two", err},
+		{"Completed", err},
+	}, sink.events)
+	require.Zero(t, completed)
+
+	var loaded testState
+	found, err := store.Load(&loaded)
+	require.Nil(t, err)
+	require.True(t, found)
+	require.Equal(t, 1, loaded.StepIdx)
+	require.Equal(t, []string{"one"}, loaded.Ran)
+
+	// Resume from the stored state, like after a reboot
+	delete(ctx.fail, "two")
+	sink.events = nil
+	ctx.state = &loaded
+	wf.State = &loaded
+	require.Nil(t, wf.Run("Started", "Completed"))
+	require.Equal(t, []string{"one", "two", "three"}, loaded.Ran)
+	require.Equal(t, []testEvent{
+		{"Started", nil},
+		{"two", nil},
+		{"three", nil},
+		{"Completed", nil},
+	}, sink.events)
+	require.Equal(t, 1, completed)
+
+	found, err = store.Load(&loaded)
+	require.Nil(t, err)
+	require.False(t, found)
+	_, err = os.Stat(store.Path + ".completed")
+	require.Nil(t, err)
+}
+
+func TestWorkflowUnsavable(t *testing.T) {
+	store := FileStore{Path: filepath.Join(t.TempDir(), "missing", "test.state")}
+	state := &testState{}
+	wf := Workflow[*testState, *testContext]{
+		State:   state,
+		Context: &testContext{state: state},
+		Steps:   []Step[*testContext]{testStep("one")},
+		Store:   store,
+	}
+	require.ErrorContains(t, wf.Run("Started", "Completed"), "Unable to save initial state")
+	require.Empty(t, state.Ran)
+	require.Contains(t, state.CorrelationId, "workflow-")
+}
+
+func TestBaseStateJson(t *testing.T) {
+	// fioconfig's rotation state files name the correlation ID RotationId
+	dir := t.TempDir()
+	store := FileStore{Path: filepath.Join(dir, "test.state")}
+	require.Nil(t, os.WriteFile(store.Path, []byte(`{"RotationId": "rotation-1", "StepIdx": 2, "Ran": ["a"]}`), 0o640))
+	var state testState
+	found, err := store.Load(&state)
+	require.Nil(t, err)
+	require.True(t, found)
+	require.Equal(t, "rotation-1", state.GetCorrelationId())
+	require.Equal(t, 2, state.GetCurrentStep())
+}